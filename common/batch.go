@@ -0,0 +1,50 @@
+package common
+
+import (
+	"time"
+
+	"github.com/samalba/dockerclient"
+)
+
+const (
+	BatchStateRunning   = "running"
+	BatchStateSucceeded = "succeeded"
+	BatchStateFailed    = "failed"
+
+	TaskStatePending   = "pending"
+	TaskStateScheduled = "scheduled"
+	TaskStateRunning   = "running"
+	TaskStateSucceeded = "succeeded"
+	TaskStateFailed    = "failed"
+)
+
+type (
+	// Batch runs a number of run-to-completion tasks.  Each task container
+	// gets its index in GRID_TASK_INDEX.
+	Batch struct {
+		Id              string                        `json:"id"`
+		Date            time.Time                     `json:"date"`
+		ContainerConfig *dockerclient.ContainerConfig `json:"container_config,omitempty"`
+		Tasks           int                           `json:"tasks"`
+		// Parallelism limits the tasks running at once (zero for all)
+		Parallelism int `json:"parallelism,omitempty"`
+		// MaxRetries is the number of times a failed task is retried
+		MaxRetries  int          `json:"max_retries,omitempty"`
+		State       string       `json:"state,omitempty"`
+		Succeeded   int          `json:"succeeded"`
+		Failed      int          `json:"failed"`
+		CompletedAt time.Time    `json:"completed_at,omitempty"`
+		TaskStatus  []*BatchTask `json:"task_status,omitempty"`
+	}
+
+	BatchTask struct {
+		Index       int    `json:"index"`
+		State       string `json:"state"`
+		Attempts    int    `json:"attempts"`
+		JobId       string `json:"job_id,omitempty"`
+		NodeId      string `json:"node_id,omitempty"`
+		ContainerId string `json:"container_id,omitempty"`
+		ExitCode    *int   `json:"exit_code,omitempty"`
+		Error       string `json:"error,omitempty"`
+	}
+)
@@ -0,0 +1,53 @@
+package common
+
+import (
+	"time"
+
+	"github.com/samalba/dockerclient"
+)
+
+const (
+	ConcurrencyAllow   = "allow"
+	ConcurrencyForbid  = "forbid"
+	ConcurrencyReplace = "replace"
+
+	RunStatePending   = "pending"
+	RunStateRunning   = "running"
+	RunStateSucceeded = "succeeded"
+	RunStateFailed    = "failed"
+	RunStateSkipped   = "skipped"
+	RunStateReplaced  = "replaced"
+)
+
+type (
+	// CronJob runs a container on a cron schedule.
+	CronJob struct {
+		Name            string                        `json:"name"`
+		Schedule        string                        `json:"schedule"`
+		ContainerConfig *dockerclient.ContainerConfig `json:"container_config,omitempty"`
+		// ConcurrencyPolicy is allow, forbid or replace when the
+		// previous run has not finished
+		ConcurrencyPolicy string `json:"concurrency_policy,omitempty"`
+		Suspended         bool   `json:"suspended,omitempty"`
+		// HistoryLimit is the number of finished runs kept
+		HistoryLimit int        `json:"history_limit,omitempty"`
+		LastSchedule time.Time  `json:"last_schedule,omitempty"`
+		NextSchedule time.Time  `json:"next_schedule,omitempty"`
+		History      []*CronRun `json:"history,omitempty"`
+	}
+
+	CronRun struct {
+		JobId       string    `json:"job_id,omitempty"`
+		Date        time.Time `json:"date"`
+		State       string    `json:"state"`
+		NodeId      string    `json:"node_id,omitempty"`
+		ContainerId string    `json:"container_id,omitempty"`
+		ExitCode    *int      `json:"exit_code,omitempty"`
+		Error       string    `json:"error,omitempty"`
+	}
+)
+
+// Active reports whether the run has not finished.
+func (r *CronRun) Active() bool {
+	return r.State == RunStatePending || r.State == RunStateRunning
+}
@@ -1,17 +1,71 @@
 package common
 
 import (
+	"time"
+
 	"github.com/samalba/dockerclient"
 )
 
+const (
+	NodeStatePending   = "pending"
+	NodeStateHealthy   = "healthy"
+	NodeStateUnhealthy = "unhealthy"
+	NodeStateCordoned  = "cordoned"
+	NodeStateDraining  = "draining"
+	NodeStateDown      = "down"
+)
+
 type (
 	NodeData struct {
-		NodeId     string                    `json:"node_id,omitempty"`
-		Cpus       float64                   `json:"cpus,omitempty"`
-		Memory     float64                   `json:"memory,omitempty"`
-		Containers []*dockerclient.Container `json:"containers,omitempty"`
-		Version    string                    `json:"version,omitempty"`
-		IP         string                    `json:"ip,omitempty"`
+		NodeId            string                    `json:"node_id,omitempty"`
+		Cpus              float64                   `json:"cpus,omitempty"`
+		Memory            float64                   `json:"memory,omitempty"`
+		Containers        []*dockerclient.Container `json:"containers,omitempty"`
+		Version           string                    `json:"version,omitempty"`
+		IP                string                    `json:"ip,omitempty"`
+		State             string                    `json:"state,omitempty"`
+		HeartbeatInterval int                       `json:"heartbeat_interval,omitempty"`
+		LastHeartbeat     time.Time                 `json:"last_heartbeat,omitempty"`
+		Drain             *DrainStatus              `json:"drain,omitempty"`
+		// Exits are the grid containers that exited since the last
+		// heartbeat
+		Exits []*ContainerExit `json:"exits,omitempty"`
+		// Images are the images on the node.  They are only sent when
+		// ImagesHash changes.
+		Images     []*dockerclient.Image `json:"images,omitempty"`
+		ImagesHash string                `json:"images_hash,omitempty"`
+		// ProxyURL is the node proxy to its Docker daemon for exec; the
+		// controller sends ProxyToken with each request and trusts the
+		// ProxyCert certificate.  The token and certificate are only sent
+		// when the node registers.
+		ProxyURL   string `json:"proxy_url,omitempty"`
+		ProxyToken string `json:"proxy_token,omitempty"`
+		ProxyCert  string `json:"proxy_cert,omitempty"`
+		// Usage is the measured usage of the grid containers
+		Usage *NodeUsage `json:"usage,omitempty"`
+		// Events are the Docker events since the last heartbeat
+		Events []*Event `json:"events,omitempty"`
+	}
+
+	// NodeUpdateReply is the controller reply to a heartbeat
+	NodeUpdateReply struct {
+		// Resend asks the node to send the details it only sends when
+		// they change
+		Resend bool `json:"resend,omitempty"`
+	}
+
+	ContainerExit struct {
+		ContainerId string    `json:"container_id"`
+		ExitCode    int       `json:"exit_code"`
+		FinishedAt  time.Time `json:"finished_at,omitempty"`
+		// Logs are collected for batch tasks
+		Logs string `json:"logs,omitempty"`
+	}
+
+	DrainStatus struct {
+		Reschedule bool `json:"reschedule,omitempty"`
+		Total      int  `json:"total"`
+		Remaining  int  `json:"remaining"`
 	}
 
 	Nodes []*NodeData
@@ -1,7 +1,105 @@
 package common
 
+import (
+	"github.com/samalba/dockerclient"
+)
+
+const (
+	RegistryAuthHeader = "X-Registry-Auth"
+	// ProxyTokenHeader authenticates the controller to the node proxy
+	ProxyTokenHeader = "X-Grid-Proxy-Token"
+	// JobHeader is the job of a create response; its pull progress is at
+	// /grid/jobs/<id>/progress
+	JobHeader = "X-Grid-Job"
+)
+
 type (
 	WaitResponse struct {
 		StatusCode int
 	}
+
+	// NodeImage is an image listed through the grid with the node it is on.
+	NodeImage struct {
+		dockerclient.Image
+		Node string
+	}
+
+	// Info is the Docker /info response for the grid.
+	Info struct {
+		ID                string
+		Name              string
+		Containers        int
+		ContainersRunning int `json:",omitempty"`
+		ContainersStopped int `json:",omitempty"`
+		Images            int
+		Driver            string
+		DriverStatus      [][2]string
+		NCPU              int
+		MemTotal          int64
+		OperatingSystem   string
+		KernelVersion     string
+		ServerVersion     string
+		NEventsListener   int
+		Debug             bool
+		Labels            []string
+	}
+
+	// Version is the Docker /version response with the grid version.
+	Version struct {
+		Version       string
+		ApiVersion    string
+		GitCommit     string
+		GoVersion     string
+		Os            string
+		Arch          string
+		KernelVersion string
+		GridVersion   string
+	}
+
+	// PullProgress is a message of the Docker pull progress stream.
+	PullProgress struct {
+		Id             string          `json:"id,omitempty"`
+		Status         string          `json:"status,omitempty"`
+		Progress       string          `json:"progress,omitempty"`
+		ProgressDetail *ProgressDetail `json:"progressDetail,omitempty"`
+		Error          string          `json:"error,omitempty"`
+		ErrorDetail    *ErrorDetail    `json:"errorDetail,omitempty"`
+	}
+
+	ProgressDetail struct {
+		Current int64 `json:"current,omitempty"`
+		Total   int64 `json:"total,omitempty"`
+	}
+
+	ErrorDetail struct {
+		Message string `json:"message"`
+	}
 )
+
+// MergeProgress keeps the latest message of each layer.  Messages of new
+// layers are appended so the layers stay in the order they appeared.
+func MergeProgress(progress []*PullProgress, msgs ...*PullProgress) []*PullProgress {
+	for _, msg := range msgs {
+		found := false
+		for i, p := range progress {
+			if p.key() == msg.key() {
+				progress[i] = msg
+				found = true
+				break
+			}
+		}
+		if !found {
+			progress = append(progress, msg)
+		}
+	}
+	return progress
+}
+
+// key identifies the layer of the message.  Messages for the whole image
+// have no id and are told apart by their status.
+func (p *PullProgress) key() string {
+	if p.Id != "" {
+		return p.Id
+	}
+	return p.Status
+}
@@ -0,0 +1,49 @@
+package common
+
+import (
+	"strings"
+
+	"github.com/samalba/dockerclient"
+)
+
+const (
+	// GridEnv is injected into every container run on the grid
+	GridEnv = "DOCKER_GRID"
+	// RescheduleEnv set to "true" reschedules the container on another
+	// node when its node goes down
+	RescheduleEnv = "GRID_RESCHEDULE"
+	// RestartEnv sets the grid restart policy of the container
+	// (no, on-failure[:max-retries] or always)
+	RestartEnv = "GRID_RESTART"
+	// BatchEnv is the batch id of a batch task container
+	BatchEnv = "GRID_BATCH"
+	// TaskIndexEnv is the index of a batch task (0 to GRID_TASK_COUNT-1)
+	TaskIndexEnv = "GRID_TASK_INDEX"
+	// TaskCountEnv is the number of tasks in the batch
+	TaskCountEnv = "GRID_TASK_COUNT"
+	// CronEnv is the cron job name of a scheduled container
+	CronEnv = "GRID_CRON"
+	// PriorityEnv sets the priority class of the container
+	PriorityEnv = "GRID_PRIORITY"
+	// TenantEnv selects the tenant default priority class
+	TenantEnv = "GRID_TENANT"
+	// PullPolicyEnv sets when the node pulls the image (always,
+	// if-not-present or never)
+	PullPolicyEnv = "GRID_PULL_POLICY"
+)
+
+// EnvValue returns the value of the environment variable in the config.
+// Grid options are passed to containers as environment variables
+// (e.g. docker run -e GRID_RESCHEDULE=true).
+func EnvValue(config *dockerclient.ContainerConfig, key string) string {
+	if config == nil {
+		return ""
+	}
+	for _, e := range config.Env {
+		k := strings.SplitN(e, "=", 2)
+		if k[0] == key && len(k) == 2 {
+			return k[1]
+		}
+	}
+	return ""
+}
@@ -0,0 +1,86 @@
+package common
+
+import (
+	"time"
+)
+
+const (
+	// EventTypeNode and EventTypeJob are the grid event types; Docker
+	// events from the nodes keep their own type (container, image, ...)
+	EventTypeNode = "node"
+	EventTypeJob  = "job"
+
+	EventNodeJoin    = "join"
+	EventNodeExpire  = "expire"
+	EventJobQueue    = "queue"
+	EventJobSchedule = "schedule"
+	EventJobFail     = "fail"
+)
+
+type (
+	// Event is a Docker event of a node or a grid event.  Status, ID and
+	// From are set for clients older than API 1.22.
+	Event struct {
+		Status   string      `json:"status,omitempty"`
+		ID       string      `json:"id,omitempty"`
+		From     string      `json:"from,omitempty"`
+		Type     string      `json:"Type,omitempty"`
+		Action   string      `json:"Action,omitempty"`
+		Actor    *EventActor `json:"Actor,omitempty"`
+		Time     int64       `json:"time,omitempty"`
+		TimeNano int64       `json:"timeNano,omitempty"`
+		// NodeId is the node the event happened on
+		NodeId string `json:"node_id,omitempty"`
+	}
+
+	EventActor struct {
+		ID         string
+		Attributes map[string]string
+	}
+)
+
+// SetNode records the node of the event.  The node is also added to the
+// actor attributes so the Docker client shows it.
+func (e *Event) SetNode(nodeId string) {
+	e.NodeId = nodeId
+	if e.Actor == nil {
+		e.Actor = &EventActor{ID: e.ID}
+	}
+	if e.Actor.Attributes == nil {
+		e.Actor.Attributes = map[string]string{}
+	}
+	e.Actor.Attributes["node"] = nodeId
+}
+
+// EventType returns the type of the event.  Events of daemons older than
+// API 1.22 have no type and are container events.
+func (e *Event) EventType() string {
+	if e.Type == "" {
+		return "container"
+	}
+	return e.Type
+}
+
+// EventAction returns the action of the event.
+func (e *Event) EventAction() string {
+	if e.Action == "" {
+		return e.Status
+	}
+	return e.Action
+}
+
+// Attribute returns the actor attribute or "".
+func (e *Event) Attribute(key string) string {
+	if e.Actor == nil {
+		return ""
+	}
+	return e.Actor.Attributes[key]
+}
+
+// Date returns the time of the event.
+func (e *Event) Date() time.Time {
+	if e.TimeNano != 0 {
+		return time.Unix(0, e.TimeNano)
+	}
+	return time.Unix(e.Time, 0)
+}
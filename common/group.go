@@ -0,0 +1,35 @@
+package common
+
+import (
+	"github.com/samalba/dockerclient"
+)
+
+type (
+	// Group is a set of containers placed on one node as a unit.  The
+	// first member owns the network namespace the others join.
+	Group struct {
+		Name    string         `json:"name,omitempty"`
+		Members []*GroupMember `json:"members"`
+	}
+
+	GroupMember struct {
+		Name            string                        `json:"name"`
+		ContainerConfig *dockerclient.ContainerConfig `json:"container_config"`
+	}
+
+	// GroupResponse is returned once the group is created.
+	GroupResponse struct {
+		Id         string   `json:"id"`
+		Containers []string `json:"containers"`
+		Warnings   []string `json:"warnings"`
+	}
+)
+
+// MemberName returns the container name of the member.  Members of an
+// unnamed group are unnamed.
+func (g *Group) MemberName(m *GroupMember) string {
+	if g.Name == "" {
+		return ""
+	}
+	return g.Name + "_" + m.Name
+}
@@ -0,0 +1,108 @@
+package common
+
+import (
+	"fmt"
+	"path"
+	"strings"
+)
+
+const (
+	DefaultRegistry = "docker.io"
+
+	PullAlways       = "always"
+	PullIfNotPresent = "if-not-present"
+	PullNever        = "never"
+)
+
+type (
+	ImageRef struct {
+		Registry   string
+		Repository string
+		Tag        string
+		Digest     string
+	}
+)
+
+// ParseImageRegistry splits an image name into its registry and the
+// remaining repository reference.
+func ParseImageRegistry(image string) (string, string) {
+	parts := strings.SplitN(image, "/", 2)
+	if len(parts) == 1 {
+		return DefaultRegistry, image
+	}
+	host := parts[0]
+	if strings.ContainsAny(host, ".:") || host == "localhost" {
+		return host, parts[1]
+	}
+	return DefaultRegistry, image
+}
+
+// ParseImage splits an image reference such as
+// "registry:5000/user/repo:tag" or "user/repo@sha256:..." into its parts.
+func ParseImage(image string) *ImageRef {
+	ref := &ImageRef{}
+	registry, remainder := ParseImageRegistry(image)
+	ref.Registry = registry
+
+	if i := strings.Index(remainder, "@"); i != -1 {
+		ref.Digest = remainder[i+1:]
+		remainder = remainder[:i]
+	}
+	if i := strings.LastIndex(remainder, ":"); i != -1 {
+		ref.Tag = remainder[i+1:]
+		remainder = remainder[:i]
+	}
+	ref.Repository = remainder
+	if ref.Tag == "" && ref.Digest == "" {
+		ref.Tag = "latest"
+	}
+	return ref
+}
+
+// Name returns the fully qualified repository name (without tag or digest).
+func (r *ImageRef) Name() string {
+	repo := r.Repository
+	if r.Registry == DefaultRegistry && !strings.Contains(repo, "/") {
+		repo = "library/" + repo
+	}
+	return fmt.Sprintf("%s/%s", r.Registry, repo)
+}
+
+// String returns the fully qualified reference so the same image written
+// differently ("redis", "docker.io/library/redis:latest") compares equal.
+func (r *ImageRef) String() string {
+	if r.Digest != "" {
+		return fmt.Sprintf("%s@%s", r.Name(), r.Digest)
+	}
+	return fmt.Sprintf("%s:%s", r.Name(), r.Tag)
+}
+
+// ParsePullPolicy validates a pull policy.  The default is if-not-present.
+func ParsePullPolicy(policy string) (string, error) {
+	switch policy {
+	case "":
+		return PullIfNotPresent, nil
+	case PullAlways, PullIfNotPresent, PullNever:
+		return policy, nil
+	}
+	return "", fmt.Errorf("invalid pull policy: %s", policy)
+}
+
+// MatchImage reports whether the image matches any of the glob patterns.
+// Patterns are matched against the repository as given (e.g. "ehazlett/*")
+// and the fully qualified name (e.g. "docker.io/library/*").
+func MatchImage(patterns []string, image string) bool {
+	ref := ParseImage(image)
+	repo := ref.Repository
+	if ref.Registry != DefaultRegistry {
+		repo = fmt.Sprintf("%s/%s", ref.Registry, repo)
+	}
+	for _, p := range patterns {
+		for _, name := range []string{image, repo, ref.Name()} {
+			if ok, _ := path.Match(p, name); ok {
+				return true
+			}
+		}
+	}
+	return false
+}
@@ -6,12 +6,63 @@ import (
 	"github.com/samalba/dockerclient"
 )
 
+const (
+	JobActionCreate = "create"
+	JobActionStop   = "stop"
+	JobActionRemove = "remove"
+	JobActionPull   = "pull"
+)
+
 type (
 	Job struct {
 		Id              string                        `json:"id,omitempty"`
 		Date            time.Time                     `json:"date,omitempty"`
+		Action          string                        `json:"action,omitempty"`
+		NodeId          string                        `json:"node_id,omitempty"`
+		ContainerId     string                        `json:"container_id,omitempty"`
 		ContainerName   string                        `json:"container_name"`
 		ContainerConfig *dockerclient.ContainerConfig `json:"container_config,omitempty"`
+		Rejections      map[string]string             `json:"rejections,omitempty"`
+		Service         string                        `json:"service,omitempty"`
+		ServiceVersion  int                           `json:"service_version,omitempty"`
+		Placement       *Placement                    `json:"placement,omitempty"`
+		RestartPolicy   *RestartPolicy                `json:"restart_policy,omitempty"`
+		// Restarts is the number of times the container was restarted
+		Restarts int `json:"restarts,omitempty"`
+		// NotBefore delays scheduling the job (restart backoff)
+		NotBefore time.Time `json:"not_before,omitempty"`
+		// RetryNodes are the rejecting nodes that may accept the job later
+		RetryNodes map[string]bool `json:"retry_nodes,omitempty"`
+		Batch      string          `json:"batch,omitempty"`
+		Task       int             `json:"task,omitempty"`
+		Cron       string          `json:"cron,omitempty"`
+		// PriorityClass and Priority order the queue (higher first)
+		PriorityClass string `json:"priority_class,omitempty"`
+		Priority      int    `json:"priority,omitempty"`
+		// Group places all its members on one node; ContainerConfig is
+		// the config of the first member
+		Group *Group `json:"group,omitempty"`
+		// RegistryAuth is the X-Registry-Auth of the request.  It is kept
+		// in memory only and sent to the node the job is dispatched to in
+		// the RegistryAuthHeader.
+		RegistryAuth string `json:"-"`
+		// PullPolicy decides when the node pulls the image
+		PullPolicy string `json:"pull_policy,omitempty"`
+	}
+
+	// JobProgress is the pull progress a node reports while it runs a job.
+	JobProgress struct {
+		JobId    string          `json:"id"`
+		NodeId   string          `json:"node_id"`
+		Progress []*PullProgress `json:"progress"`
+	}
+
+	JobNack struct {
+		JobId  string `json:"id,omitempty"`
+		NodeId string `json:"node_id,omitempty"`
+		Reason string `json:"reason,omitempty"`
+		// Temporary is set when the node may accept the job later
+		Temporary bool `json:"temporary,omitempty"`
 	}
 
 	JobResult struct {
@@ -20,5 +71,22 @@ type (
 		ContainerId   string                      `json:"container_id"`
 		ContainerInfo *dockerclient.ContainerInfo `json:"container_info,omitempty"`
 		Warnings      []string                    `json:"warnings"`
+		Error         string                      `json:"error,omitempty"`
+		// Containers are the group member containers in order
+		Containers []string `json:"containers,omitempty"`
 	}
 )
+
+// IsCreate reports whether the job creates a container.  Other actions
+// operate on an existing container and are sent to the node in NodeId.
+func (j *Job) IsCreate() bool {
+	return j.Action == "" || j.Action == JobActionCreate
+}
+
+// Image returns the image of the container being created.
+func (j *Job) Image() string {
+	if j.ContainerConfig == nil {
+		return ""
+	}
+	return j.ContainerConfig.Image
+}
@@ -0,0 +1,196 @@
+package common
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+
+	"github.com/samalba/dockerclient"
+)
+
+const (
+	PolicyAllow   PolicyAction = "allow"
+	PolicyDeny    PolicyAction = "deny"
+	PolicyRewrite PolicyAction = "rewrite"
+)
+
+type (
+	PolicyAction string
+
+	// Policy is a set of rules applied to container configs before they
+	// are run on the grid.  An empty action allows the setting.
+	Policy struct {
+		Privileged          PolicyAction      `json:"privileged,omitempty"`
+		Binds               PolicyAction      `json:"binds,omitempty"`
+		AllowedBinds        []string          `json:"allowed_binds,omitempty"`
+		Devices             PolicyAction      `json:"devices,omitempty"`
+		CapAdd              PolicyAction      `json:"cap_add,omitempty"`
+		AllowedCapabilities []string          `json:"allowed_capabilities,omitempty"`
+		HostNetwork         PolicyAction      `json:"host_network,omitempty"`
+		HostPid             PolicyAction      `json:"host_pid,omitempty"`
+		Registries          PolicyAction      `json:"registries,omitempty"`
+		AllowedRegistries   []string          `json:"allowed_registries,omitempty"`
+		RegistryRewrites    map[string]string `json:"registry_rewrites,omitempty"`
+		AllowedImages       []string          `json:"allowed_images,omitempty"`
+		DeniedImages        []string          `json:"denied_images,omitempty"`
+		RequireDigest       bool              `json:"require_digest,omitempty"`
+	}
+
+	PolicyError struct {
+		Reasons []string
+	}
+)
+
+func (e *PolicyError) Error() string {
+	return fmt.Sprintf("rejected by policy: %s", strings.Join(e.Reasons, "; "))
+}
+
+func LoadPolicy(path string) (*Policy, error) {
+	b, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	policy := &Policy{}
+	if err := json.Unmarshal(b, policy); err != nil {
+		return nil, fmt.Errorf("error parsing policy %s: %s", path, err)
+	}
+	return policy, nil
+}
+
+// Apply checks the config against the policy.  Rewrites are made in place
+// and returned as warnings; denied settings are returned as a PolicyError.
+func (p *Policy) Apply(config *dockerclient.ContainerConfig) ([]string, error) {
+	var (
+		reasons  []string
+		warnings []string
+	)
+	hostCfg := &config.HostConfig
+
+	check := func(action PolicyAction, setting string, rewrite func()) {
+		switch action {
+		case PolicyDeny:
+			reasons = append(reasons, fmt.Sprintf("%s is not allowed", setting))
+		case PolicyRewrite:
+			rewrite()
+			warnings = append(warnings, fmt.Sprintf("%s was removed by policy", setting))
+		}
+	}
+
+	if hostCfg.Privileged {
+		check(p.Privileged, "privileged mode", func() {
+			hostCfg.Privileged = false
+		})
+	}
+
+	if binds := p.disallowedBinds(hostCfg.Binds); len(binds) > 0 {
+		check(p.Binds, fmt.Sprintf("bind mount %s", strings.Join(binds, ",")), func() {
+			allowed := []string{}
+			for _, b := range hostCfg.Binds {
+				if p.bindAllowed(b) {
+					allowed = append(allowed, b)
+				}
+			}
+			hostCfg.Binds = allowed
+		})
+	}
+
+	if len(hostCfg.Devices) > 0 {
+		check(p.Devices, "device mapping", func() {
+			hostCfg.Devices = nil
+		})
+	}
+
+	if caps := p.disallowedCapabilities(hostCfg.CapAdd); len(caps) > 0 {
+		check(p.CapAdd, fmt.Sprintf("cap-add %s", strings.Join(caps, ",")), func() {
+			allowed := []string{}
+			for _, c := range hostCfg.CapAdd {
+				if containsFold(p.AllowedCapabilities, c) {
+					allowed = append(allowed, c)
+				}
+			}
+			hostCfg.CapAdd = allowed
+		})
+	}
+
+	if hostCfg.NetworkMode == "host" {
+		check(p.HostNetwork, "host networking", func() {
+			hostCfg.NetworkMode = "bridge"
+		})
+	}
+
+	if hostCfg.PidMode == "host" {
+		check(p.HostPid, "host pid namespace", func() {
+			hostCfg.PidMode = ""
+		})
+	}
+
+	registry, repo := ParseImageRegistry(config.Image)
+	if mirror, ok := p.RegistryRewrites[registry]; ok {
+		config.Image = fmt.Sprintf("%s/%s", mirror, repo)
+		warnings = append(warnings, fmt.Sprintf("registry %s rewritten to %s", registry, mirror))
+		registry = mirror
+	}
+	if p.Registries == PolicyDeny && !containsFold(p.AllowedRegistries, registry) {
+		reasons = append(reasons, fmt.Sprintf("registry %s is not allowed", registry))
+	}
+
+	if len(p.AllowedImages) > 0 && !MatchImage(p.AllowedImages, config.Image) {
+		reasons = append(reasons, fmt.Sprintf("image %s is not in the allowed images", config.Image))
+	}
+	if MatchImage(p.DeniedImages, config.Image) {
+		reasons = append(reasons, fmt.Sprintf("image %s is denied", config.Image))
+	}
+	if p.RequireDigest && ParseImage(config.Image).Digest == "" {
+		reasons = append(reasons, fmt.Sprintf("image %s must be referenced by digest", config.Image))
+	}
+
+	if len(reasons) > 0 {
+		return warnings, &PolicyError{Reasons: reasons}
+	}
+	return warnings, nil
+}
+
+// bindAllowed reports whether the host path of the bind is one of the
+// allowed paths or below one.  The path is cleaned first so that ".." cannot
+// escape an allowed directory.
+func (p *Policy) bindAllowed(bind string) bool {
+	hostPath := filepath.Clean(strings.Split(bind, ":")[0])
+	for _, prefix := range p.AllowedBinds {
+		prefix = filepath.Clean(prefix)
+		if hostPath == prefix || strings.HasPrefix(hostPath, strings.TrimSuffix(prefix, "/")+"/") {
+			return true
+		}
+	}
+	return false
+}
+
+func (p *Policy) disallowedBinds(binds []string) []string {
+	var denied []string
+	for _, b := range binds {
+		if !p.bindAllowed(b) {
+			denied = append(denied, b)
+		}
+	}
+	return denied
+}
+
+func (p *Policy) disallowedCapabilities(caps []string) []string {
+	var denied []string
+	for _, c := range caps {
+		if !containsFold(p.AllowedCapabilities, c) {
+			denied = append(denied, c)
+		}
+	}
+	return denied
+}
+
+func containsFold(list []string, s string) bool {
+	for _, v := range list {
+		if strings.EqualFold(v, s) {
+			return true
+		}
+	}
+	return false
+}
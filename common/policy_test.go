@@ -0,0 +1,214 @@
+package common
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/samalba/dockerclient"
+)
+
+func TestPolicyApply(t *testing.T) {
+	tests := []struct {
+		name     string
+		policy   *Policy
+		config   *dockerclient.ContainerConfig
+		warnings int
+		reasons  []string
+		image    string
+	}{
+		{
+			name:   "empty policy allows everything",
+			policy: &Policy{},
+			config: &dockerclient.ContainerConfig{
+				Image: "redis",
+				HostConfig: dockerclient.HostConfig{
+					Privileged:  true,
+					Binds:       []string{"/:/host"},
+					CapAdd:      []string{"SYS_ADMIN"},
+					NetworkMode: "host",
+				},
+			},
+		},
+		{
+			name:    "deny privileged",
+			policy:  &Policy{Privileged: PolicyDeny},
+			config:  &dockerclient.ContainerConfig{Image: "redis", HostConfig: dockerclient.HostConfig{Privileged: true}},
+			reasons: []string{"privileged mode is not allowed"},
+		},
+		{
+			name:     "rewrite privileged",
+			policy:   &Policy{Privileged: PolicyRewrite},
+			config:   &dockerclient.ContainerConfig{Image: "redis", HostConfig: dockerclient.HostConfig{Privileged: true}},
+			warnings: 1,
+		},
+		{
+			name:   "allowed bind prefix",
+			policy: &Policy{Binds: PolicyDeny, AllowedBinds: []string{"/data"}},
+			config: &dockerclient.ContainerConfig{Image: "redis", HostConfig: dockerclient.HostConfig{Binds: []string{"/data/redis:/data"}}},
+		},
+		{
+			name:    "denied bind",
+			policy:  &Policy{Binds: PolicyDeny, AllowedBinds: []string{"/data"}},
+			config:  &dockerclient.ContainerConfig{Image: "redis", HostConfig: dockerclient.HostConfig{Binds: []string{"/etc:/etc"}}},
+			reasons: []string{"bind mount /etc:/etc is not allowed"},
+		},
+		{
+			name:   "allowed bind path",
+			policy: &Policy{Binds: PolicyDeny, AllowedBinds: []string{"/data/"}},
+			config: &dockerclient.ContainerConfig{Image: "redis", HostConfig: dockerclient.HostConfig{Binds: []string{"/data:/data:ro"}}},
+		},
+		{
+			name:    "bind escaping the allowed path",
+			policy:  &Policy{Binds: PolicyDeny, AllowedBinds: []string{"/data"}},
+			config:  &dockerclient.ContainerConfig{Image: "redis", HostConfig: dockerclient.HostConfig{Binds: []string{"/data/../etc:/etc"}}},
+			reasons: []string{"bind mount /data/../etc:/etc is not allowed"},
+		},
+		{
+			name:    "bind sharing the allowed prefix",
+			policy:  &Policy{Binds: PolicyDeny, AllowedBinds: []string{"/data"}},
+			config:  &dockerclient.ContainerConfig{Image: "redis", HostConfig: dockerclient.HostConfig{Binds: []string{"/database:/data"}}},
+			reasons: []string{"bind mount /database:/data is not allowed"},
+		},
+		{
+			name:   "allowed capability ignores case",
+			policy: &Policy{CapAdd: PolicyDeny, AllowedCapabilities: []string{"net_admin"}},
+			config: &dockerclient.ContainerConfig{Image: "redis", HostConfig: dockerclient.HostConfig{CapAdd: []string{"NET_ADMIN"}}},
+		},
+		{
+			name:     "rewrite host network",
+			policy:   &Policy{HostNetwork: PolicyRewrite},
+			config:   &dockerclient.ContainerConfig{Image: "redis", HostConfig: dockerclient.HostConfig{NetworkMode: "host"}},
+			warnings: 1,
+		},
+		{
+			name: "registry rewrite before allowed registries",
+			policy: &Policy{
+				Registries:        PolicyDeny,
+				AllowedRegistries: []string{"mirror.local:5000"},
+				RegistryRewrites:  map[string]string{"docker.io": "mirror.local:5000"},
+			},
+			config:   &dockerclient.ContainerConfig{Image: "redis:3.0"},
+			warnings: 1,
+			image:    "mirror.local:5000/redis:3.0",
+		},
+		{
+			name:    "registry not allowed",
+			policy:  &Policy{Registries: PolicyDeny, AllowedRegistries: []string{"registry.local"}},
+			config:  &dockerclient.ContainerConfig{Image: "redis"},
+			reasons: []string{"registry docker.io is not allowed"},
+		},
+		{
+			name:   "allowed images glob on repository",
+			policy: &Policy{AllowedImages: []string{"ehazlett/*"}},
+			config: &dockerclient.ContainerConfig{Image: "ehazlett/grid:latest"},
+		},
+		{
+			name:   "allowed images glob on qualified name",
+			policy: &Policy{AllowedImages: []string{"docker.io/library/*"}},
+			config: &dockerclient.ContainerConfig{Image: "redis"},
+		},
+		{
+			name:    "image not allowed",
+			policy:  &Policy{AllowedImages: []string{"ehazlett/*"}},
+			config:  &dockerclient.ContainerConfig{Image: "redis"},
+			reasons: []string{"image redis is not in the allowed images"},
+		},
+		{
+			name:    "denied image wins over allowed image",
+			policy:  &Policy{AllowedImages: []string{"ehazlett/*"}, DeniedImages: []string{"ehazlett/bad*"}},
+			config:  &dockerclient.ContainerConfig{Image: "ehazlett/badimage"},
+			reasons: []string{"image ehazlett/badimage is denied"},
+		},
+		{
+			name:    "require digest",
+			policy:  &Policy{RequireDigest: true},
+			config:  &dockerclient.ContainerConfig{Image: "redis:3.0"},
+			reasons: []string{"image redis:3.0 must be referenced by digest"},
+		},
+		{
+			name:   "digest reference",
+			policy: &Policy{RequireDigest: true},
+			config: &dockerclient.ContainerConfig{Image: "redis@sha256:abc"},
+		},
+		{
+			name: "reasons are collected in order",
+			policy: &Policy{
+				Privileged:  PolicyDeny,
+				HostNetwork: PolicyRewrite,
+				HostPid:     PolicyDeny,
+			},
+			config: &dockerclient.ContainerConfig{
+				Image: "redis",
+				HostConfig: dockerclient.HostConfig{
+					Privileged:  true,
+					NetworkMode: "host",
+					PidMode:     "host",
+				},
+			},
+			warnings: 1,
+			reasons:  []string{"privileged mode is not allowed", "host pid namespace is not allowed"},
+		},
+	}
+
+	for _, test := range tests {
+		warnings, err := test.policy.Apply(test.config)
+		if len(warnings) != test.warnings {
+			t.Errorf("%s: expected %d warnings; received %v", test.name, test.warnings, warnings)
+		}
+		var reasons []string
+		if err != nil {
+			perr, ok := err.(*PolicyError)
+			if !ok {
+				t.Errorf("%s: expected PolicyError; received %v", test.name, err)
+				continue
+			}
+			reasons = perr.Reasons
+		}
+		if !reflect.DeepEqual(reasons, test.reasons) {
+			t.Errorf("%s: expected reasons %v; received %v", test.name, test.reasons, reasons)
+		}
+		if test.image != "" && test.config.Image != test.image {
+			t.Errorf("%s: expected image %s; received %s", test.name, test.image, test.config.Image)
+		}
+	}
+}
+
+func TestPolicyRewrite(t *testing.T) {
+	policy := &Policy{
+		Privileged:          PolicyRewrite,
+		Binds:               PolicyRewrite,
+		AllowedBinds:        []string{"/data"},
+		CapAdd:              PolicyRewrite,
+		AllowedCapabilities: []string{"NET_ADMIN"},
+		HostNetwork:         PolicyRewrite,
+	}
+	config := &dockerclient.ContainerConfig{
+		Image: "redis",
+		HostConfig: dockerclient.HostConfig{
+			Privileged:  true,
+			Binds:       []string{"/data/redis:/data", "/etc:/etc"},
+			CapAdd:      []string{"NET_ADMIN", "SYS_ADMIN"},
+			NetworkMode: "host",
+		},
+	}
+	warnings, err := policy.Apply(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(warnings) != 4 {
+		t.Fatalf("expected 4 warnings; received %v", warnings)
+	}
+	hostCfg := config.HostConfig
+	if hostCfg.Privileged {
+		t.Errorf("expected privileged to be removed")
+	}
+	if !reflect.DeepEqual(hostCfg.Binds, []string{"/data/redis:/data"}) {
+		t.Errorf("expected only the allowed bind; received %v", hostCfg.Binds)
+	}
+	if !reflect.DeepEqual(hostCfg.CapAdd, []string{"NET_ADMIN"}) {
+		t.Errorf("expected only the allowed capability; received %v", hostCfg.CapAdd)
+	}
+	if hostCfg.NetworkMode != "bridge" {
+		t.Errorf("expected bridge networking; received %s", hostCfg.NetworkMode)
+	}
+}
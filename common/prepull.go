@@ -0,0 +1,36 @@
+package common
+
+import (
+	"time"
+)
+
+const (
+	PullStatePending  = "pending"
+	PullStateComplete = "complete"
+	PullStateFailed   = "failed"
+)
+
+type (
+	// Prepull pulls an image on a set of nodes ahead of the containers
+	// that use it.
+	Prepull struct {
+		Id          string      `json:"id"`
+		Image       string      `json:"image"`
+		Nodes       []string    `json:"nodes,omitempty"`
+		Date        time.Time   `json:"date"`
+		State       string      `json:"state"`
+		Total       int         `json:"total"`
+		Completed   int         `json:"completed"`
+		Failed      int         `json:"failed"`
+		CompletedAt time.Time   `json:"completed_at,omitempty"`
+		NodeStatus  []*NodePull `json:"node_status,omitempty"`
+	}
+
+	NodePull struct {
+		NodeId      string    `json:"node_id"`
+		JobId       string    `json:"job_id"`
+		State       string    `json:"state"`
+		Error       string    `json:"error,omitempty"`
+		CompletedAt time.Time `json:"completed_at,omitempty"`
+	}
+)
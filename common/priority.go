@@ -0,0 +1,75 @@
+package common
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+
+	"github.com/samalba/dockerclient"
+)
+
+type (
+	// PriorityConfig defines the job priority classes.  A job uses the
+	// class in GRID_PRIORITY, the default class of its GRID_TENANT or the
+	// default class.
+	PriorityConfig struct {
+		// Classes map class names to priorities (higher runs first)
+		Classes map[string]int `json:"classes"`
+		// Default is the class of jobs without a class or tenant default
+		Default string `json:"default,omitempty"`
+		// Tenants map tenants to their default class
+		Tenants map[string]string `json:"tenants,omitempty"`
+		// Preemption lets jobs that cannot be placed remove containers
+		// with a lower priority
+		Preemption bool `json:"preemption,omitempty"`
+	}
+)
+
+func LoadPriorityConfig(path string) (*PriorityConfig, error) {
+	b, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	config := &PriorityConfig{}
+	if err := json.Unmarshal(b, config); err != nil {
+		return nil, fmt.Errorf("error parsing priority classes %s: %s", path, err)
+	}
+	if err := config.validate(); err != nil {
+		return nil, fmt.Errorf("error parsing priority classes %s: %s", path, err)
+	}
+	return config, nil
+}
+
+func (p *PriorityConfig) validate() error {
+	if _, ok := p.Classes[p.Default]; p.Default != "" && !ok {
+		return fmt.Errorf("unknown default class: %s", p.Default)
+	}
+	for tenant, class := range p.Tenants {
+		if _, ok := p.Classes[class]; !ok {
+			return fmt.Errorf("unknown class %s for tenant %s", class, tenant)
+		}
+	}
+	return nil
+}
+
+// Priority returns the priority class and priority of the container.
+func (p *PriorityConfig) Priority(config *dockerclient.ContainerConfig) (string, int, error) {
+	if p == nil {
+		return "", 0, nil
+	}
+	class := EnvValue(config, PriorityEnv)
+	if class == "" {
+		class = p.Tenants[EnvValue(config, TenantEnv)]
+	}
+	if class == "" {
+		class = p.Default
+	}
+	if class == "" {
+		return "", 0, nil
+	}
+	priority, ok := p.Classes[class]
+	if !ok {
+		return "", 0, fmt.Errorf("unknown priority class: %s", class)
+	}
+	return class, priority, nil
+}
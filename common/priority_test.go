@@ -0,0 +1,130 @@
+package common
+
+import (
+	"testing"
+
+	"github.com/samalba/dockerclient"
+)
+
+func TestPriority(t *testing.T) {
+	config := &PriorityConfig{
+		Classes: map[string]int{
+			"low":    -10,
+			"normal": 0,
+			"high":   100,
+		},
+		Default: "normal",
+		Tenants: map[string]string{
+			"ops": "high",
+		},
+	}
+	tests := []struct {
+		name     string
+		config   *PriorityConfig
+		env      []string
+		class    string
+		priority int
+		err      bool
+	}{
+		{
+			name: "no config",
+			env:  []string{PriorityEnv + "=high"},
+		},
+		{
+			name:     "default class",
+			config:   config,
+			class:    "normal",
+			priority: 0,
+		},
+		{
+			name:     "class from env",
+			config:   config,
+			env:      []string{"FOO=bar", PriorityEnv + "=low"},
+			class:    "low",
+			priority: -10,
+		},
+		{
+			name:     "tenant default",
+			config:   config,
+			env:      []string{TenantEnv + "=ops"},
+			class:    "high",
+			priority: 100,
+		},
+		{
+			name:     "env class over tenant default",
+			config:   config,
+			env:      []string{TenantEnv + "=ops", PriorityEnv + "=low"},
+			class:    "low",
+			priority: -10,
+		},
+		{
+			name:     "unknown tenant uses the default class",
+			config:   config,
+			env:      []string{TenantEnv + "=dev"},
+			class:    "normal",
+			priority: 0,
+		},
+		{
+			name:   "no default class",
+			config: &PriorityConfig{Classes: map[string]int{"high": 100}},
+		},
+		{
+			name:   "unknown class",
+			config: config,
+			env:    []string{PriorityEnv + "=urgent"},
+			err:    true,
+		},
+	}
+	for _, test := range tests {
+		class, priority, err := test.config.Priority(&dockerclient.ContainerConfig{Env: test.env})
+		if test.err {
+			if err == nil {
+				t.Fatalf("%s: expected error", test.name)
+			}
+			continue
+		}
+		if err != nil {
+			t.Fatalf("%s: unexpected error: %s", test.name, err)
+		}
+		if class != test.class || priority != test.priority {
+			t.Fatalf("%s: expected %s (%d); received %s (%d)", test.name, test.class, test.priority, class, priority)
+		}
+	}
+}
+
+func TestPriorityConfigValidate(t *testing.T) {
+	classes := map[string]int{"normal": 0}
+	tests := []struct {
+		name   string
+		config *PriorityConfig
+		err    bool
+	}{
+		{
+			name:   "empty",
+			config: &PriorityConfig{},
+		},
+		{
+			name:   "known classes",
+			config: &PriorityConfig{Classes: classes, Default: "normal", Tenants: map[string]string{"ops": "normal"}},
+		},
+		{
+			name:   "unknown default",
+			config: &PriorityConfig{Classes: classes, Default: "high"},
+			err:    true,
+		},
+		{
+			name:   "unknown tenant class",
+			config: &PriorityConfig{Classes: classes, Tenants: map[string]string{"ops": "high"}},
+			err:    true,
+		},
+	}
+	for _, test := range tests {
+		err := test.config.validate()
+		if test.err && err == nil {
+			t.Fatalf("%s: expected error", test.name)
+		}
+		if !test.err && err != nil {
+			t.Fatalf("%s: unexpected error: %s", test.name, err)
+		}
+	}
+}
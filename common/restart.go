@@ -0,0 +1,88 @@
+package common
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	RestartPolicyNo        = "no"
+	RestartPolicyOnFailure = "on-failure"
+	RestartPolicyAlways    = "always"
+
+	restartBackoff    = time.Second
+	restartBackoffMax = time.Minute * 5
+)
+
+type (
+	// RestartPolicy is enforced by the controller across nodes, unlike
+	// the Docker restart policy which only restarts on the same daemon.
+	RestartPolicy struct {
+		Name string `json:"name"`
+		// MaxRetries limits on-failure restarts (zero for unlimited)
+		MaxRetries int `json:"max_retries,omitempty"`
+	}
+)
+
+// ParseRestartPolicy parses no, on-failure[:max-retries] or always.
+func ParseRestartPolicy(s string) (*RestartPolicy, error) {
+	parts := strings.SplitN(s, ":", 2)
+	policy := &RestartPolicy{
+		Name: parts[0],
+	}
+	switch policy.Name {
+	case RestartPolicyNo, RestartPolicyAlways:
+		if len(parts) == 2 {
+			return nil, fmt.Errorf("max retries are only supported with %s: %s", RestartPolicyOnFailure, s)
+		}
+	case RestartPolicyOnFailure:
+		if len(parts) == 2 {
+			n, err := strconv.Atoi(parts[1])
+			if err != nil || n < 0 {
+				return nil, fmt.Errorf("invalid max retries: %s", s)
+			}
+			policy.MaxRetries = n
+		}
+	default:
+		return nil, fmt.Errorf("invalid restart policy: %s", s)
+	}
+	return policy, nil
+}
+
+func (p *RestartPolicy) String() string {
+	if p.Name == RestartPolicyOnFailure && p.MaxRetries > 0 {
+		return fmt.Sprintf("%s:%d", p.Name, p.MaxRetries)
+	}
+	return p.Name
+}
+
+// ShouldRestart reports whether a container that exited with the code
+// after the number of restarts is restarted.  A container lost with its
+// node is a failure.
+func (p *RestartPolicy) ShouldRestart(exitCode int, restarts int) bool {
+	if p == nil {
+		return false
+	}
+	switch p.Name {
+	case RestartPolicyAlways:
+		return true
+	case RestartPolicyOnFailure:
+		return exitCode != 0 && (p.MaxRetries == 0 || restarts < p.MaxRetries)
+	}
+	return false
+}
+
+// RestartBackoff returns the delay before a restart.  It doubles with each
+// restart up to five minutes.
+func RestartBackoff(restarts int) time.Duration {
+	d := restartBackoff
+	for i := 0; i < restarts && d < restartBackoffMax; i++ {
+		d *= 2
+	}
+	if d > restartBackoffMax {
+		d = restartBackoffMax
+	}
+	return d
+}
@@ -0,0 +1,78 @@
+package common
+
+import (
+	"time"
+
+	"github.com/samalba/dockerclient"
+)
+
+const (
+	UpdateStateUpdating    = "updating"
+	UpdateStatePaused      = "paused"
+	UpdateStateCompleted   = "completed"
+	UpdateStateRollingBack = "rolling_back"
+	UpdateStateRolledBack  = "rolled_back"
+
+	UpdateFailureActionPause    = "pause"
+	UpdateFailureActionRollback = "rollback"
+)
+
+type (
+	// Service keeps a number of replicas of a container running on the
+	// grid.
+	Service struct {
+		Name            string                        `json:"name"`
+		ContainerConfig *dockerclient.ContainerConfig `json:"container_config,omitempty"`
+		Replicas        int                           `json:"replicas"`
+		Placement       *Placement                    `json:"placement,omitempty"`
+		UpdateConfig    *UpdateConfig                 `json:"update_config,omitempty"`
+		// Version is incremented when the container config changes
+		Version int `json:"version"`
+		// PreviousContainerConfig is restored on rollback
+		PreviousContainerConfig *dockerclient.ContainerConfig `json:"previous_container_config,omitempty"`
+		Update                  *UpdateStatus                 `json:"update,omitempty"`
+		Status                  *ServiceStatus                `json:"status,omitempty"`
+	}
+
+	// UpdateConfig controls how the containers of a service are replaced
+	// when its config changes.
+	UpdateConfig struct {
+		// Parallelism is the number of containers replaced at a time
+		Parallelism int `json:"parallelism,omitempty"`
+		// Delay is the number of seconds to wait between batches
+		Delay int `json:"delay,omitempty"`
+		// Monitor is the number of seconds a new container must be
+		// running before it is healthy.  A container with a passing
+		// healthcheck is healthy immediately.
+		Monitor int `json:"monitor,omitempty"`
+		// FailureAction is pause or rollback
+		FailureAction string `json:"failure_action,omitempty"`
+	}
+
+	UpdateStatus struct {
+		State       string    `json:"state"`
+		Updated     int       `json:"updated"`
+		Total       int       `json:"total"`
+		Message     string    `json:"message,omitempty"`
+		StartedAt   time.Time `json:"started_at"`
+		CompletedAt time.Time `json:"completed_at,omitempty"`
+		// NextBatch is when the next batch is replaced once the current
+		// batch is healthy
+		NextBatch time.Time `json:"next_batch,omitempty"`
+	}
+
+	// Placement restricts where containers are scheduled.
+	Placement struct {
+		// Nodes are the node ids the containers can run on (empty for
+		// any node)
+		Nodes []string `json:"nodes,omitempty"`
+		// MaxPerNode is the maximum containers of the service on a node
+		MaxPerNode int `json:"max_per_node,omitempty"`
+	}
+
+	ServiceStatus struct {
+		Running    int      `json:"running"`
+		Pending    int      `json:"pending"`
+		Containers []string `json:"containers,omitempty"`
+	}
+)
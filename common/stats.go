@@ -0,0 +1,69 @@
+package common
+
+import (
+	"time"
+)
+
+type (
+	// ContainerStats is the part of the Docker stats response used for
+	// the node usage.
+	ContainerStats struct {
+		CpuStats    CpuStats    `json:"cpu_stats"`
+		MemoryStats MemoryStats `json:"memory_stats"`
+	}
+
+	CpuStats struct {
+		CpuUsage struct {
+			TotalUsage  uint64   `json:"total_usage"`
+			PercpuUsage []uint64 `json:"percpu_usage"`
+		} `json:"cpu_usage"`
+		SystemUsage uint64 `json:"system_cpu_usage"`
+	}
+
+	MemoryStats struct {
+		Usage uint64 `json:"usage"`
+		Limit uint64 `json:"limit"`
+	}
+
+	// NodeUsage is the cpu and memory used by the grid containers of a
+	// node.  Cpus is the number of cpus in use and Memory is in bytes.
+	NodeUsage struct {
+		Cpus       float64           `json:"cpus"`
+		Memory     int64             `json:"memory"`
+		Containers []*ContainerUsage `json:"containers,omitempty"`
+		Collected  time.Time         `json:"collected"`
+	}
+
+	ContainerUsage struct {
+		ContainerId string  `json:"container_id"`
+		Cpus        float64 `json:"cpus"`
+		Memory      int64   `json:"memory"`
+	}
+
+	// NodeStats compares the capacity of a node with the resources
+	// reserved by its grid containers and the resources they use.
+	// Memory is in bytes.
+	NodeStats struct {
+		NodeId         string    `json:"node_id"`
+		State          string    `json:"state"`
+		Containers     int       `json:"containers"`
+		Cpus           float64   `json:"cpus"`
+		CpusReserved   float64   `json:"cpus_reserved"`
+		CpusUsed       float64   `json:"cpus_used"`
+		Memory         int64     `json:"memory"`
+		MemoryReserved int64     `json:"memory_reserved"`
+		MemoryUsed     int64     `json:"memory_used"`
+		Collected      time.Time `json:"collected,omitempty"`
+	}
+
+	// GridStats is the total of the connected nodes.
+	GridStats struct {
+		Cpus           float64      `json:"cpus"`
+		CpusReserved   float64      `json:"cpus_reserved"`
+		CpusUsed       float64      `json:"cpus_used"`
+		Memory         int64        `json:"memory"`
+		MemoryReserved int64        `json:"memory_reserved"`
+		MemoryUsed     int64        `json:"memory_used"`
+		Nodes          []*NodeStats `json:"nodes"`
+	}
+)
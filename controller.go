@@ -1,8 +1,11 @@
 package main
 
 import (
+	"time"
+
 	log "github.com/Sirupsen/logrus"
 	"github.com/codegangsta/cli"
+	"github.com/ehazlett/docker-grid/common"
 	"github.com/ehazlett/docker-grid/controller"
 )
 
@@ -21,6 +24,56 @@ var controllerCommand = cli.Command{
 			Value: 500,
 			Usage: "node ttl (in ms)",
 		},
+		cli.IntFlag{
+			Name:  "healthy-after",
+			Value: 2,
+			Usage: "heartbeats before a new or recovered node is healthy",
+		},
+		cli.IntFlag{
+			Name:  "unhealthy-after",
+			Value: 3,
+			Usage: "missed heartbeats before a node is unhealthy",
+		},
+		cli.IntFlag{
+			Name:  "down-after",
+			Value: 10,
+			Usage: "missed heartbeats before a node is down (0 uses ttl)",
+		},
+		cli.IntFlag{
+			Name:  "down-retention",
+			Value: 24,
+			Usage: "hours a down node is kept before it is forgotten (0 keeps down nodes)",
+		},
+		cli.StringFlag{
+			Name:  "policy, p",
+			Value: "",
+			Usage: "path to container policy file",
+		},
+		cli.StringFlag{
+			Name:  "priority-classes",
+			Value: "",
+			Usage: "path to job priority classes file",
+		},
+		cli.StringFlag{
+			Name:  "data-dir",
+			Value: "",
+			Usage: "directory to persist controller state (in-memory if empty)",
+		},
+		cli.StringFlag{
+			Name:  "cluster-addr",
+			Value: "",
+			Usage: "raft address (ip:port) to enable clustering with other controllers",
+		},
+		cli.StringSliceFlag{
+			Name:  "cluster-peer",
+			Value: &cli.StringSlice{},
+			Usage: "raft address of another controller (can be repeated)",
+		},
+		cli.StringFlag{
+			Name:  "advertise-url",
+			Value: "",
+			Usage: "URL other controllers use to reach this controller",
+		},
 		cli.BoolFlag{
 			Name:  "debug, d",
 			Usage: "enable debug logging",
@@ -29,11 +82,57 @@ var controllerCommand = cli.Command{
 }
 
 func controllerAction(c *cli.Context) {
-	controller, err := controller.NewController(c.String("listen"), c.Int("ttl"), c.Bool("debug"))
+	var policy *common.Policy
+	if p := c.String("policy"); p != "" {
+		pol, err := common.LoadPolicy(p)
+		if err != nil {
+			log.Fatalf("error loading policy: %s", err)
+		}
+		policy = pol
+	}
+
+	var priorities *common.PriorityConfig
+	if p := c.String("priority-classes"); p != "" {
+		pc, err := common.LoadPriorityConfig(p)
+		if err != nil {
+			log.Fatalf("error loading priority classes: %s", err)
+		}
+		priorities = pc
+	}
+
+	var clusterConfig *controller.ClusterConfig
+	if addr := c.String("cluster-addr"); addr != "" {
+		advertiseUrl := c.String("advertise-url")
+		if advertiseUrl == "" {
+			log.Fatalf("--advertise-url is required for clustering")
+		}
+		clusterConfig = &controller.ClusterConfig{
+			Addr:         addr,
+			Peers:        c.StringSlice("cluster-peer"),
+			AdvertiseUrl: advertiseUrl,
+		}
+	}
+
+	health := controller.NodeHealth{
+		HealthyAfter:   c.Int("healthy-after"),
+		UnhealthyAfter: c.Int("unhealthy-after"),
+		DownAfter:      c.Int("down-after"),
+		DownRetention:  time.Hour * time.Duration(c.Int("down-retention")),
+	}
+
+	controller, err := controller.NewController(c.String("listen"), c.Int("ttl"), health, policy, priorities, c.String("data-dir"), clusterConfig, c.Bool("debug"))
 	if err != nil {
 		log.Fatalf("error creating controller: %s", err)
 	}
+	shutdown := func() {
+		if err := controller.Close(); err != nil {
+			log.Warnf("error closing controller: %s", err)
+		}
+	}
+	go waitForInterrupt(shutdown)
+
 	if err := controller.Run(); err != nil {
+		shutdown()
 		log.Fatalf("error starting controller: %s", err)
 	}
 }
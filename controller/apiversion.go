@@ -0,0 +1,158 @@
+package controller
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/gorilla/mux"
+	"github.com/samalba/dockerclient"
+)
+
+const (
+	// MinAPIVersion is the oldest Docker remote API version the controller
+	// accepts.  Older clients send the host config on start, which the
+	// grid does not support.
+	MinAPIVersion = "1.15"
+	// versionPrefix matches the version prefix of Docker API paths.  The
+	// Docker client sends "/v1.18" but "/1.18" is accepted too; prefixes
+	// that are not a valid version are refused by dockerRoute.
+	versionPrefix = "/{apiVersion:[v0-9][^/]*}"
+)
+
+type (
+	dockerVersion struct {
+		major int
+		minor int
+	}
+
+	// createResources are the container resources that API 1.19 moved
+	// from the container config to the host config
+	createResources struct {
+		HostConfig struct {
+			Memory     int64
+			MemorySwap int64
+			CpuShares  int64
+			CpusetCpus string
+		}
+	}
+)
+
+var (
+	minVersion     = mustParseAPIVersion(MinAPIVersion)
+	currentVersion = mustParseAPIVersion(DockerAPIVersion)
+	// hostResourcesVersion moved the resources to the host config
+	hostResourcesVersion = dockerVersion{1, 19}
+	// containerCountsVersion added the running and stopped counts to info
+	containerCountsVersion = dockerVersion{1, 24}
+)
+
+// parseAPIVersion parses a version such as "v1.18" or "1.18".
+func parseAPIVersion(s string) (dockerVersion, error) {
+	parts := strings.Split(strings.TrimPrefix(s, "v"), ".")
+	if len(parts) != 2 {
+		return dockerVersion{}, fmt.Errorf("invalid API version: %s", s)
+	}
+	major, err := strconv.Atoi(parts[0])
+	if err != nil {
+		return dockerVersion{}, fmt.Errorf("invalid API version: %s", s)
+	}
+	minor, err := strconv.Atoi(parts[1])
+	if err != nil {
+		return dockerVersion{}, fmt.Errorf("invalid API version: %s", s)
+	}
+	return dockerVersion{major, minor}, nil
+}
+
+func mustParseAPIVersion(s string) dockerVersion {
+	v, err := parseAPIVersion(s)
+	if err != nil {
+		panic(err)
+	}
+	return v
+}
+
+func (v dockerVersion) LessThan(o dockerVersion) bool {
+	if v.major != o.major {
+		return v.major < o.major
+	}
+	return v.minor < o.minor
+}
+
+func (v dockerVersion) String() string {
+	return fmt.Sprintf("%d.%d", v.major, v.minor)
+}
+
+// requestVersion returns the API version of a validated request.
+// Requests without a version get the current version.
+func requestVersion(r *http.Request) dockerVersion {
+	if s, ok := mux.Vars(r)["apiVersion"]; ok {
+		if v, err := parseAPIVersion(s); err == nil {
+			return v
+		}
+	}
+	return currentVersion
+}
+
+// dockerRoute registers a Docker API route with and without the version
+// prefix.  Requests for unsupported versions are refused.  A prefix without
+// the "v" is rewritten so requests passed on to nodes have the prefix
+// Docker expects.
+func (c *Controller) dockerRoute(r *mux.Router, path string, handler http.HandlerFunc, method string) {
+	h := func(w http.ResponseWriter, req *http.Request) {
+		if s, ok := mux.Vars(req)["apiVersion"]; ok {
+			v, err := parseAPIVersion(s)
+			if err != nil {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+			if !strings.HasPrefix(s, "v") {
+				req.URL.Path = "/v" + strings.TrimPrefix(req.URL.Path, "/")
+			}
+			if currentVersion.LessThan(v) {
+				http.Error(w, fmt.Sprintf("client is newer than server (client API version: %s, server API version: %s)", v, currentVersion), http.StatusBadRequest)
+				return
+			}
+			if v.LessThan(minVersion) {
+				http.Error(w, fmt.Sprintf("client version %s is too old. Minimum supported API version is %s, please upgrade your client to a newer version", v, minVersion), http.StatusBadRequest)
+				return
+			}
+		}
+		w.Header().Set("Api-Version", DockerAPIVersion)
+		handler(w, req)
+	}
+	r.HandleFunc(path, h).Methods(method)
+	r.HandleFunc(versionPrefix+path, h).Methods(method)
+}
+
+// adaptCreateConfig moves the resources of clients using API 1.19 or later
+// from the host config to the container config where the grid reads them.
+func adaptCreateConfig(v dockerVersion, body []byte, config *dockerclient.ContainerConfig) error {
+	if v.LessThan(hostResourcesVersion) {
+		return nil
+	}
+	res := &createResources{}
+	if err := json.Unmarshal(body, res); err != nil {
+		return err
+	}
+	if config.Memory == 0 {
+		config.Memory = res.HostConfig.Memory
+	}
+	if config.MemorySwap == 0 {
+		config.MemorySwap = res.HostConfig.MemorySwap
+	}
+	if config.CpuShares == 0 {
+		config.CpuShares = res.HostConfig.CpuShares
+	}
+	if config.Cpuset == "" {
+		config.Cpuset = res.HostConfig.CpusetCpus
+	}
+	return nil
+}
+
+func (c *Controller) apiPing(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("content-type", "text/plain")
+	w.Write([]byte("OK"))
+}
@@ -0,0 +1,208 @@
+package controller
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/gorilla/mux"
+	"github.com/samalba/dockerclient"
+)
+
+func TestParseAPIVersion(t *testing.T) {
+	tests := []struct {
+		version  string
+		expected dockerVersion
+		err      bool
+	}{
+		{version: "v1.18", expected: dockerVersion{1, 18}},
+		{version: "1.18", expected: dockerVersion{1, 18}},
+		{version: "v1.9", expected: dockerVersion{1, 9}},
+		{version: "v2.0", expected: dockerVersion{2, 0}},
+		{version: "", err: true},
+		{version: "v", err: true},
+		{version: "v1", err: true},
+		{version: "v1.18.0", err: true},
+		{version: "v1.x", err: true},
+		{version: "vx.18", err: true},
+		{version: "vv1.18", err: true},
+	}
+	for _, test := range tests {
+		v, err := parseAPIVersion(test.version)
+		if test.err {
+			if err == nil {
+				t.Fatalf("%q: expected error; received %s", test.version, v)
+			}
+			continue
+		}
+		if err != nil {
+			t.Fatalf("%q: unexpected error: %s", test.version, err)
+		}
+		if v != test.expected {
+			t.Fatalf("%q: expected %s; received %s", test.version, test.expected, v)
+		}
+	}
+}
+
+func TestDockerVersionLessThan(t *testing.T) {
+	tests := []struct {
+		a, b     dockerVersion
+		expected bool
+	}{
+		{dockerVersion{1, 18}, dockerVersion{1, 19}, true},
+		{dockerVersion{1, 19}, dockerVersion{1, 18}, false},
+		{dockerVersion{1, 18}, dockerVersion{1, 18}, false},
+		{dockerVersion{1, 24}, dockerVersion{2, 0}, true},
+		{dockerVersion{2, 0}, dockerVersion{1, 24}, false},
+	}
+	for _, test := range tests {
+		if test.a.LessThan(test.b) != test.expected {
+			t.Fatalf("expected %s < %s to be %v", test.a, test.b, test.expected)
+		}
+	}
+}
+
+func TestDockerRoute(t *testing.T) {
+	var (
+		version string
+		path    string
+	)
+	c := &Controller{}
+	r := mux.NewRouter()
+	c.dockerRoute(r, "/info", func(w http.ResponseWriter, req *http.Request) {
+		version = requestVersion(req).String()
+		path = req.URL.Path
+	}, "GET")
+
+	tests := []struct {
+		path    string
+		status  int
+		version string
+		handled string
+	}{
+		{path: "/info", status: http.StatusOK, version: DockerAPIVersion, handled: "/info"},
+		{path: "/v1.18/info", status: http.StatusOK, version: "1.18", handled: "/v1.18/info"},
+		{path: "/1.18/info", status: http.StatusOK, version: "1.18", handled: "/v1.18/info"},
+		{path: "/v" + MinAPIVersion + "/info", status: http.StatusOK, version: MinAPIVersion, handled: "/v" + MinAPIVersion + "/info"},
+		{path: "/v" + DockerAPIVersion + "/info", status: http.StatusOK, version: DockerAPIVersion, handled: "/v" + DockerAPIVersion + "/info"},
+		{path: "/v1.14/info", status: http.StatusBadRequest},
+		{path: "/1.14/info", status: http.StatusBadRequest},
+		{path: "/v1.99/info", status: http.StatusBadRequest},
+		{path: "/v2.0/info", status: http.StatusBadRequest},
+		{path: "/v1.x/info", status: http.StatusBadRequest},
+		{path: "/1/info", status: http.StatusBadRequest},
+		{path: "/vfoo/info", status: http.StatusBadRequest},
+		{path: "/grid/info", status: http.StatusNotFound},
+	}
+	for _, test := range tests {
+		version, path = "", ""
+		req, err := http.NewRequest("GET", test.path, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		w := httptest.NewRecorder()
+		r.ServeHTTP(w, req)
+		if w.Code != test.status {
+			t.Fatalf("%s: expected status %d; received %d", test.path, test.status, w.Code)
+		}
+		if test.status != http.StatusOK {
+			if path != "" {
+				t.Fatalf("%s: expected the handler not to run", test.path)
+			}
+			continue
+		}
+		if w.Header().Get("Api-Version") != DockerAPIVersion {
+			t.Fatalf("%s: expected Api-Version %s; received %q", test.path, DockerAPIVersion, w.Header().Get("Api-Version"))
+		}
+		if version != test.version {
+			t.Fatalf("%s: expected version %s; received %s", test.path, test.version, version)
+		}
+		if path != test.handled {
+			t.Fatalf("%s: expected path %s; received %s", test.path, test.handled, path)
+		}
+	}
+}
+
+func TestAdaptCreateConfig(t *testing.T) {
+	body := `{
+		"Image": "redis",
+		"HostConfig": {"Memory": 1024, "MemorySwap": 2048, "CpuShares": 512, "CpusetCpus": "0,1"}
+	}`
+	tests := []struct {
+		name     string
+		version  dockerVersion
+		config   dockerclient.ContainerConfig
+		expected dockerclient.ContainerConfig
+	}{
+		{
+			name:     "old clients set the resources in the config",
+			version:  dockerVersion{1, 18},
+			config:   dockerclient.ContainerConfig{Image: "redis"},
+			expected: dockerclient.ContainerConfig{Image: "redis"},
+		},
+		{
+			name:    "resources from the host config",
+			version: hostResourcesVersion,
+			config:  dockerclient.ContainerConfig{Image: "redis"},
+			expected: dockerclient.ContainerConfig{
+				Image:      "redis",
+				Memory:     1024,
+				MemorySwap: 2048,
+				CpuShares:  512,
+				Cpuset:     "0,1",
+			},
+		},
+		{
+			name:    "resources in the config are kept",
+			version: currentVersion,
+			config: dockerclient.ContainerConfig{
+				Image:  "redis",
+				Memory: 4096,
+				Cpuset: "2",
+			},
+			expected: dockerclient.ContainerConfig{
+				Image:      "redis",
+				Memory:     4096,
+				MemorySwap: 2048,
+				CpuShares:  512,
+				Cpuset:     "2",
+			},
+		},
+	}
+	for _, test := range tests {
+		config := test.config
+		if err := adaptCreateConfig(test.version, []byte(body), &config); err != nil {
+			t.Fatalf("%s: unexpected error: %s", test.name, err)
+		}
+		if config.Image != test.expected.Image || config.Memory != test.expected.Memory || config.MemorySwap != test.expected.MemorySwap || config.CpuShares != test.expected.CpuShares || config.Cpuset != test.expected.Cpuset {
+			t.Fatalf("%s: expected %+v; received %+v", test.name, test.expected, config)
+		}
+	}
+
+	config := &dockerclient.ContainerConfig{}
+	if err := adaptCreateConfig(currentVersion, []byte("{"), config); err == nil {
+		t.Fatalf("expected error for an invalid body")
+	}
+}
+
+func TestHijackPath(t *testing.T) {
+	tests := []struct {
+		path     string
+		expected bool
+	}{
+		{"/events", true},
+		{"/v1.24/events", true},
+		{"/1.24/events", true},
+		{"/v1.24/exec/abc/start", true},
+		{"/containers/abc/stats", true},
+		{"/1.18/containers/abc/stats", true},
+		{"/v1.24/exec/abc/json", false},
+		{"/containers/abc/json", false},
+		{"/grid/events", false},
+	}
+	for _, test := range tests {
+		if hijackPath.MatchString(test.path) != test.expected {
+			t.Fatalf("%s: expected hijack %v", test.path, test.expected)
+		}
+	}
+}
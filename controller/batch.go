@@ -0,0 +1,280 @@
+package controller
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"time"
+
+	"code.google.com/p/go-uuid/uuid"
+	log "github.com/Sirupsen/logrus"
+	"github.com/ehazlett/docker-grid/common"
+	"github.com/gorilla/mux"
+)
+
+const (
+	batchesBucket   = "batches"
+	batchLogsBucket = "batchlogs"
+)
+
+func (c *Controller) getBatch(id string) (*common.Batch, error) {
+	batch := &common.Batch{}
+	if err := c.store.Get(batchesBucket, id, batch); err != nil {
+		return nil, err
+	}
+	return batch, nil
+}
+
+func (c *Controller) getBatches() []*common.Batch {
+	batches := []*common.Batch{}
+	if err := c.store.ForEach(batchesBucket, func(key string, data []byte) error {
+		batch := &common.Batch{}
+		if err := json.Unmarshal(data, batch); err != nil {
+			return err
+		}
+		batches = append(batches, batch)
+		return nil
+	}); err != nil {
+		log.Warnf("error loading batches: %s", err)
+	}
+	return batches
+}
+
+func logsKey(batchId string, index int) string {
+	return fmt.Sprintf("%s/%d", batchId, index)
+}
+
+func (c *Controller) batchJob(batch *common.Batch, task *common.BatchTask) *common.Job {
+	config := *batch.ContainerConfig
+	config.Env = append([]string{}, batch.ContainerConfig.Env...)
+	config.Env = append(config.Env,
+		fmt.Sprintf("%s=%s", common.BatchEnv, batch.Id),
+		fmt.Sprintf("%s=%d", common.TaskIndexEnv, task.Index),
+		fmt.Sprintf("%s=%d", common.TaskCountEnv, batch.Tasks),
+	)
+	return &common.Job{
+		Id:              uuid.New(),
+		Date:            time.Now(),
+		ContainerConfig: &config,
+		Batch:           batch.Id,
+		Task:            task.Index,
+	}
+}
+
+// updateBatch queues pending tasks up to the batch parallelism, updates
+// the batch state and saves it.  The batch lock must be held.
+func (c *Controller) updateBatch(batch *common.Batch) {
+	if batch.State == common.BatchStateRunning {
+		limit := batch.Parallelism
+		if limit <= 0 {
+			limit = batch.Tasks
+		}
+		active := 0
+		for _, task := range batch.TaskStatus {
+			if task.State == common.TaskStateScheduled || task.State == common.TaskStateRunning {
+				active++
+			}
+		}
+		for _, task := range batch.TaskStatus {
+			if active >= limit {
+				break
+			}
+			if task.State != common.TaskStatePending {
+				continue
+			}
+			job := c.batchJob(batch, task)
+			task.State = common.TaskStateScheduled
+			task.Attempts++
+			task.JobId = job.Id
+			task.NodeId = ""
+			task.ContainerId = ""
+			task.ExitCode = nil
+			log.Infof("queue batch task: batch=%s task=%d attempt=%d job=%s", batch.Id, task.Index, task.Attempts, job.Id)
+			c.enqueue(job)
+			active++
+		}
+	}
+
+	batch.Succeeded, batch.Failed = 0, 0
+	for _, task := range batch.TaskStatus {
+		switch task.State {
+		case common.TaskStateSucceeded:
+			batch.Succeeded++
+		case common.TaskStateFailed:
+			batch.Failed++
+		}
+	}
+	if batch.State == common.BatchStateRunning && batch.Succeeded+batch.Failed == batch.Tasks {
+		batch.State = common.BatchStateSucceeded
+		if batch.Failed > 0 {
+			batch.State = common.BatchStateFailed
+		}
+		batch.CompletedAt = time.Now()
+		log.Infof("batch %s: id=%s succeeded=%d failed=%d", batch.State, batch.Id, batch.Succeeded, batch.Failed)
+	}
+
+	if err := c.store.Put(batchesBucket, batch.Id, batch); err != nil {
+		log.Warnf("error saving batch %s: %s", batch.Id, err)
+	}
+}
+
+// batchTask returns the batch and task the job was queued for.  Results
+// of earlier attempts are ignored.
+func (c *Controller) batchTask(job *common.Job) (*common.Batch, *common.BatchTask) {
+	batch, err := c.getBatch(job.Batch)
+	if err != nil {
+		log.Warnf("unknown batch %s for job %s", job.Batch, job.Id)
+		return nil, nil
+	}
+	if job.Task < 0 || job.Task >= len(batch.TaskStatus) {
+		return nil, nil
+	}
+	task := batch.TaskStatus[job.Task]
+	if task.JobId != job.Id {
+		return nil, nil
+	}
+	return batch, task
+}
+
+// taskFailed retries the task until it has run the batch max retries.
+func taskFailed(batch *common.Batch, task *common.BatchTask, reason string) {
+	log.Warnf("batch task failed: batch=%s task=%d attempt=%d: %s", batch.Id, task.Index, task.Attempts, reason)
+	task.Error = reason
+	task.State = common.TaskStateFailed
+	if task.Attempts <= batch.MaxRetries {
+		task.State = common.TaskStatePending
+	}
+}
+
+// batchTaskStarted records the container of a batch task or its failure
+// to start.
+func (c *Controller) batchTaskStarted(job *common.Job, result *common.JobResult) {
+	c.batchLock.Lock()
+	defer c.batchLock.Unlock()
+	batch, task := c.batchTask(job)
+	if task == nil {
+		return
+	}
+	if result.Error != "" {
+		taskFailed(batch, task, result.Error)
+	} else {
+		task.State = common.TaskStateRunning
+		task.NodeId = result.NodeId
+		task.ContainerId = result.ContainerId
+	}
+	c.updateBatch(batch)
+}
+
+// batchTaskExited completes the task of an exited container.  The logs
+// are kept and the container is removed unless its node was lost.
+func (c *Controller) batchTaskExited(owner *containerOwner, exitCode int, logs string, nodeLost bool) {
+	c.batchLock.Lock()
+	defer c.batchLock.Unlock()
+	batch, task := c.batchTask(owner.Job)
+	if task == nil {
+		return
+	}
+
+	task.ExitCode = &exitCode
+	if err := c.store.Put(batchLogsBucket, logsKey(batch.Id, task.Index), logs); err != nil {
+		log.Warnf("error saving logs for batch %s task %d: %s", batch.Id, task.Index, err)
+	}
+	switch {
+	case nodeLost:
+		taskFailed(batch, task, fmt.Sprintf("node %s down", owner.NodeId))
+	case exitCode != 0:
+		taskFailed(batch, task, fmt.Sprintf("exited with code %d", exitCode))
+	default:
+		task.State = common.TaskStateSucceeded
+		task.Error = ""
+	}
+	if !nodeLost {
+		c.enqueue(&common.Job{
+			Id:          uuid.New(),
+			Date:        time.Now(),
+			Action:      common.JobActionRemove,
+			NodeId:      owner.NodeId,
+			ContainerId: owner.ContainerId,
+		})
+	}
+	c.updateBatch(batch)
+}
+
+func (c *Controller) writeBatch(w http.ResponseWriter, v interface{}) {
+	w.Header().Set("content-type", "application/json")
+	if err := json.NewEncoder(w).Encode(v); err != nil {
+		log.Warnf("error encoding batch: %s", err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+	}
+}
+
+func (c *Controller) apiBatchCreate(w http.ResponseWriter, r *http.Request) {
+	batch := &common.Batch{}
+	if err := json.NewDecoder(r.Body).Decode(batch); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if batch.ContainerConfig == nil || batch.ContainerConfig.Image == "" {
+		http.Error(w, "batch image is required", http.StatusBadRequest)
+		return
+	}
+	if batch.Tasks <= 0 || batch.Parallelism < 0 || batch.MaxRetries < 0 {
+		http.Error(w, "tasks must be positive and parallelism and max retries must not be negative", http.StatusBadRequest)
+		return
+	}
+
+	if c.policy != nil {
+		if _, err := c.policy.Apply(batch.ContainerConfig); err != nil {
+			http.Error(w, err.Error(), http.StatusForbidden)
+			return
+		}
+	}
+
+	batch.Id = uuid.New()
+	batch.Date = time.Now()
+	batch.State = common.BatchStateRunning
+	batch.CompletedAt = time.Time{}
+	batch.TaskStatus = []*common.BatchTask{}
+	for i := 0; i < batch.Tasks; i++ {
+		batch.TaskStatus = append(batch.TaskStatus, &common.BatchTask{
+			Index: i,
+			State: common.TaskStatePending,
+		})
+	}
+
+	log.Infof("batch created: id=%s image=%s tasks=%d parallelism=%d", batch.Id, batch.ContainerConfig.Image, batch.Tasks, batch.Parallelism)
+	c.batchLock.Lock()
+	c.updateBatch(batch)
+	c.batchLock.Unlock()
+	c.writeBatch(w, batch)
+}
+
+func (c *Controller) apiBatchList(w http.ResponseWriter, r *http.Request) {
+	c.writeBatch(w, c.getBatches())
+}
+
+func (c *Controller) apiBatchDetails(w http.ResponseWriter, r *http.Request) {
+	batch, err := c.getBatch(mux.Vars(r)["id"])
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	}
+	c.writeBatch(w, batch)
+}
+
+func (c *Controller) apiBatchTaskLogs(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	index, err := strconv.Atoi(vars["index"])
+	if err != nil {
+		http.Error(w, fmt.Sprintf("invalid task: %s", vars["index"]), http.StatusBadRequest)
+		return
+	}
+	var logs string
+	if err := c.store.Get(batchLogsBucket, logsKey(vars["id"], index), &logs); err != nil {
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	}
+	w.Header().Set("content-type", "text/plain")
+	w.Write([]byte(logs))
+}
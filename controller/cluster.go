@@ -0,0 +1,164 @@
+package controller
+
+import (
+	"encoding/json"
+	"net"
+	"net/http"
+	"net/http/httputil"
+	"net/url"
+	"regexp"
+
+	log "github.com/Sirupsen/logrus"
+	"github.com/ehazlett/docker-grid/common"
+	"github.com/ehazlett/docker-grid/utils/cluster"
+	"github.com/ehazlett/docker-grid/utils/proxy"
+)
+
+const (
+	clusterBucket = "cluster"
+	leaderKey     = "leader"
+)
+
+var (
+	// hijackPath matches the requests whose response is a raw stream
+	hijackPath = regexp.MustCompile(`^(/[v0-9][^/]*)?/(exec/[^/]+/start|containers/[^/]+/stats|events)$`)
+)
+
+type (
+	// ClusterConfig enables high availability.  Controllers replicate
+	// their state with raft and the leader schedules jobs.
+	ClusterConfig struct {
+		// Addr is the raft bind and advertise address (ip:port)
+		Addr string
+		// Peers are the raft addresses of the other controllers
+		Peers []string
+		// AdvertiseUrl is the API URL other controllers use to reach
+		// this controller
+		AdvertiseUrl string
+	}
+
+	leaderInfo struct {
+		Addr string `json:"addr,omitempty"`
+		Url  string `json:"url,omitempty"`
+	}
+)
+
+func (c *Controller) isLeader() bool {
+	return c.cluster == nil || c.cluster.IsLeader()
+}
+
+func (c *Controller) watchLeadership() {
+	for leader := range c.cluster.LeaderCh() {
+		c.resetState()
+		if !leader {
+			log.Infof("lost cluster leadership")
+			continue
+		}
+
+		log.Infof("elected cluster leader: url=%s", c.clusterConfig.AdvertiseUrl)
+		info := &leaderInfo{
+			Addr: c.clusterConfig.Addr,
+			Url:  c.clusterConfig.AdvertiseUrl,
+		}
+		if err := c.store.Put(clusterBucket, leaderKey, info); err != nil {
+			log.Warnf("error saving leader: %s", err)
+		}
+		if err := c.restore(); err != nil {
+			log.Warnf("error restoring state: %s", err)
+		}
+	}
+}
+
+// resetState clears the scheduling state so it can be restored from the
+// replicated store when this controller is the leader.
+func (c *Controller) resetState() {
+	c.queueLock.Lock()
+	c.queue = newJobQueue()
+	c.pendingJobs = map[string]*common.Job{}
+	c.serviceQueue = map[string]map[string]*common.Job{}
+	c.queueLock.Unlock()
+
+	c.mutex.Lock()
+	c.owners = map[string]*containerOwner{}
+	c.registrations = map[string]*common.NodeData{}
+	c.downNodes = map[string]*common.NodeData{}
+	c.nodeStatus = map[string]*nodeStatus{}
+	c.cordons = map[string]*nodeCordon{}
+	c.serviceFailures = map[string]string{}
+	c.preempting = map[string]*containerOwner{}
+	c.execs = map[string]*execRecord{}
+	c.registryAuth = map[string]string{}
+	c.mutex.Unlock()
+
+	c.prepullLock.Lock()
+	c.prepullJobs = map[string]string{}
+	c.prepullLock.Unlock()
+
+	c.progressLock.Lock()
+	c.jobProgress = map[string]*jobProgress{}
+	c.progressLock.Unlock()
+}
+
+// leaderUrl returns the API URL of the current leader.
+func (c *Controller) leaderUrl() (*url.URL, error) {
+	info := &leaderInfo{}
+	if err := c.store.Get(clusterBucket, leaderKey, info); err != nil {
+		return nil, err
+	}
+	// the leader record is written after election; ignore it until
+	// it matches the raft leader
+	if info.Addr != c.cluster.Leader() || info.Addr == c.clusterConfig.Addr {
+		return nil, cluster.ErrNotLeader
+	}
+	return url.Parse(info.Url)
+}
+
+// proxyToLeader forwards requests to the leader when this controller is a
+// follower.
+func (c *Controller) proxyToLeader(handler http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if c.isLeader() || r.URL.Path == "/grid/cluster" {
+			handler.ServeHTTP(w, r)
+			return
+		}
+
+		u, err := c.leaderUrl()
+		if err != nil {
+			log.Warnf("unable to find cluster leader: %s", err)
+			http.Error(w, "no cluster leader available", http.StatusServiceUnavailable)
+			return
+		}
+		log.Debugf("proxying to leader %s: %s %s", u, r.Method, r.URL)
+		if hijackPath.MatchString(r.URL.Path) {
+			conn, err := net.Dial("tcp", u.Host)
+			if err != nil {
+				http.Error(w, err.Error(), http.StatusBadGateway)
+				return
+			}
+			if err := proxy.Hijack(w, r, conn); err != nil {
+				log.Warnf("error proxying to leader %s: %s", u, err)
+			}
+			return
+		}
+		httputil.NewSingleHostReverseProxy(u).ServeHTTP(w, r)
+	})
+}
+
+func (c *Controller) apiClusterStatus(w http.ResponseWriter, r *http.Request) {
+	status := &cluster.Status{
+		State: "Leader",
+	}
+	if c.cluster != nil {
+		s, err := c.cluster.Status()
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		status = s
+	}
+	w.Header().Set("content-type", "application/json")
+	if err := json.NewEncoder(w).Encode(status); err != nil {
+		log.Warnf("error encoding cluster status: %s", err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+	}
+}
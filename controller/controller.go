@@ -3,15 +3,16 @@ package controller
 import (
 	"encoding/json"
 	"fmt"
+	"io/ioutil"
 	"net/http"
-	"strings"
+	"sync"
 	"time"
 
 	"code.google.com/p/go-uuid/uuid"
 	log "github.com/Sirupsen/logrus"
 	"github.com/ehazlett/docker-grid/common"
+	"github.com/ehazlett/docker-grid/utils/cluster"
 	"github.com/ehazlett/docker-grid/utils/datastore"
-	fifo "github.com/foize/go.fifo"
 	"github.com/gorilla/mux"
 	"github.com/samalba/dockerclient"
 )
@@ -31,11 +32,41 @@ type (
 		TTL                int
 		datastore          *datastore.Datastore
 		jobResultDatastore *datastore.Datastore
-		queue              *fifo.Queue
+		queue              *jobQueue
+		queueLock          sync.Mutex
+		pendingJobs        map[string]*common.Job
+		serviceQueue       map[string]map[string]*common.Job
+		policy             *common.Policy
+		store              datastore.Store
+		mutex              sync.RWMutex
+		owners             map[string]*containerOwner
+		registrations      map[string]*common.NodeData
+		downNodes          map[string]*common.NodeData
+		restored           time.Time
+		nodeStatus         map[string]*nodeStatus
+		cordons            map[string]*nodeCordon
+		serviceLock        sync.Mutex
+		serviceFailures    map[string]string
+		batchLock          sync.Mutex
+		cronLock           sync.Mutex
+		priorities         *common.PriorityConfig
+		preempting         map[string]*containerOwner
+		prepullLock        sync.Mutex
+		prepullJobs        map[string]string
+		progressLock       sync.Mutex
+		jobProgress        map[string]*jobProgress
+		execs              map[string]*execRecord
+		registryAuth       map[string]string
+		eventLock          sync.Mutex
+		events             []*common.Event
+		eventListeners     map[chan *common.Event]bool
+		health             NodeHealth
+		cluster            *cluster.Cluster
+		clusterConfig      *ClusterConfig
 	}
 )
 
-func NewController(addr string, ttl int, enableDebug bool) (*Controller, error) {
+func NewController(addr string, ttl int, health NodeHealth, policy *common.Policy, priorities *common.PriorityConfig, dataDir string, clusterConfig *ClusterConfig, enableDebug bool) (*Controller, error) {
 	ds, err := datastore.New(time.Millisecond * time.Duration(ttl))
 	if err != nil {
 		return nil, err
@@ -44,25 +75,89 @@ func NewController(addr string, ttl int, enableDebug bool) (*Controller, error)
 	if err != nil {
 		return nil, err
 	}
-	queue := fifo.NewQueue()
+	var (
+		store datastore.Store
+		cl    *cluster.Cluster
+	)
+	if clusterConfig != nil {
+		if dataDir == "" {
+			return nil, fmt.Errorf("a data directory is required for clustering")
+		}
+		c, err := cluster.New(dataDir, clusterConfig.Addr, clusterConfig.Peers, enableDebug)
+		if err != nil {
+			return nil, err
+		}
+		cl = c
+		store = c
+	} else if dataDir != "" {
+		s, err := datastore.NewBoltStore(dataDir)
+		if err != nil {
+			return nil, err
+		}
+		store = s
+	} else {
+		store = datastore.NewMemoryStore()
+	}
 	controller := &Controller{
 		Addr:               addr,
 		TTL:                ttl,
 		datastore:          ds,
 		jobResultDatastore: jobResultDs,
-		queue:              queue,
+		queue:              newJobQueue(),
+		pendingJobs:        map[string]*common.Job{},
+		serviceQueue:       map[string]map[string]*common.Job{},
+		policy:             policy,
+		store:              store,
+		owners:             map[string]*containerOwner{},
+		registrations:      map[string]*common.NodeData{},
+		downNodes:          map[string]*common.NodeData{},
+		nodeStatus:         map[string]*nodeStatus{},
+		cordons:            map[string]*nodeCordon{},
+		serviceFailures:    map[string]string{},
+		priorities:         priorities,
+		preempting:         map[string]*containerOwner{},
+		prepullJobs:        map[string]string{},
+		jobProgress:        map[string]*jobProgress{},
+		execs:              map[string]*execRecord{},
+		registryAuth:       map[string]string{},
+		eventListeners:     map[chan *common.Event]bool{},
+		health:             health,
+		cluster:            cl,
+		clusterConfig:      clusterConfig,
 	}
 	if enableDebug {
 		log.SetLevel(log.DebugLevel)
 	}
+	controller.watchNodes()
+	go controller.reconcileServices()
+	go controller.pruneNodes()
+	go controller.expirePrepulls()
+	go controller.runCronJobs()
+	if priorities != nil && priorities.Preemption {
+		go controller.preemptJobs()
+	}
+
+	// when clustered the state is restored on election
+	if cl != nil {
+		go controller.watchLeadership()
+	} else if err := controller.restore(); err != nil {
+		return nil, err
+	}
 	return controller, nil
 }
 
+// Close stops the cluster and closes the state store.
+func (c *Controller) Close() error {
+	c.datastore.Close()
+	c.jobResultDatastore.Close()
+	return c.store.Close()
+}
+
 func (c *Controller) ListContainers() []*dockerclient.Container {
 	var containers []*dockerclient.Container
-	for _, v := range c.datastore.Items() {
-		nodeData := v.Data.(*common.NodeData)
-		for _, cnt := range nodeData.Containers {
+	for _, nodeData := range c.nodes() {
+		for _, container := range nodeData.Containers {
+			cnt := *container
 			ports := []dockerclient.Port{}
 
 			// adjust ports to show node ip
@@ -76,7 +171,7 @@ func (c *Controller) ListContainers() []*dockerclient.Container {
 
 			cnt.Ports = ports
 
-			containers = append(containers, cnt)
+			containers = append(containers, &cnt)
 		}
 	}
 	return containers
@@ -85,24 +180,66 @@ func (c *Controller) ListContainers() []*dockerclient.Container {
 func (c *Controller) Run() error {
 	r := mux.NewRouter()
 	r.HandleFunc("/", c.apiIndex).Methods("GET")
+	r.HandleFunc("/grid/cluster", c.apiClusterStatus).Methods("GET")
 	r.HandleFunc("/grid/nodes", c.apiNodeList).Methods("GET")
 	r.HandleFunc("/grid/nodes/{nodeId}", c.apiNodeDetails).Methods("GET")
+	r.HandleFunc("/grid/stats", c.apiGridStats).Methods("GET")
 	r.HandleFunc("/grid/queue/next", c.apiQueueNext).Methods("GET")
 	r.HandleFunc("/grid/queue/result", c.apiQueueResult).Methods("POST")
+	r.HandleFunc("/grid/queue/nack", c.apiQueueNack).Methods("POST")
+	r.HandleFunc("/grid/queue/progress", c.apiQueueProgress).Methods("POST")
+	r.HandleFunc("/grid/jobs/{id}/progress", c.apiJobProgress).Methods("GET")
 	r.HandleFunc("/grid/nodes/{nodeId}/update", c.apiNodeUpdate).Methods("POST")
-	r.HandleFunc("/{apiVersion}/containers/json", c.apiListContainers).Methods("GET")
-	r.HandleFunc("/containers/json", c.apiListContainers).Methods("GET")
-	r.HandleFunc("/{apiVersion}/containers/create", c.apiCreateContainer).Methods("POST")
-	r.HandleFunc("/{apiVersion}/containers/{containerId}/attach", c.apiAttachContainer).Methods("POST")
-	r.HandleFunc("/{apiVersion}/containers/{containerId}/start", c.apiStartContainer).Methods("POST")
-	r.HandleFunc("/{apiVersion}/containers/{containerId}/wait", c.apiWaitContainer).Methods("POST")
-	r.HandleFunc("/{apiVersion}/containers/{containerId}/json", c.apiContainerJson).Methods("GET")
-	r.HandleFunc("/{apiVersion}/containers/{containerId}", c.apiDeleteContainer).Methods("DELETE")
+	r.HandleFunc("/grid/nodes/{nodeId}/cordon", c.apiNodeCordon).Methods("POST")
+	r.HandleFunc("/grid/nodes/{nodeId}/uncordon", c.apiNodeUncordon).Methods("POST")
+	r.HandleFunc("/grid/nodes/{nodeId}/drain", c.apiNodeDrain).Methods("POST")
+	r.HandleFunc("/grid/services", c.apiServiceList).Methods("GET")
+	r.HandleFunc("/grid/services", c.apiServiceCreate).Methods("POST")
+	r.HandleFunc("/grid/services/{name}", c.apiServiceDetails).Methods("GET")
+	r.HandleFunc("/grid/services/{name}", c.apiServiceDelete).Methods("DELETE")
+	r.HandleFunc("/grid/services/{name}/scale", c.apiServiceScale).Methods("POST")
+	r.HandleFunc("/grid/services/{name}/resume", c.apiServiceResume).Methods("POST")
+	r.HandleFunc("/grid/services/{name}/rollback", c.apiServiceRollback).Methods("POST")
+	r.HandleFunc("/grid/batches", c.apiBatchList).Methods("GET")
+	r.HandleFunc("/grid/batches", c.apiBatchCreate).Methods("POST")
+	r.HandleFunc("/grid/batches/{id}", c.apiBatchDetails).Methods("GET")
+	r.HandleFunc("/grid/batches/{id}/tasks/{index}/logs", c.apiBatchTaskLogs).Methods("GET")
+	r.HandleFunc("/grid/images/prepull", c.apiPrepullList).Methods("GET")
+	r.HandleFunc("/grid/images/prepull", c.apiPrepull).Methods("POST")
+	r.HandleFunc("/grid/images/prepull/{id}", c.apiPrepullDetails).Methods("GET")
+	r.HandleFunc("/grid/groups", c.apiCreateGroup).Methods("POST")
+	r.HandleFunc("/grid/groups/{id}", c.apiDeleteGroup).Methods("DELETE")
+	r.HandleFunc("/grid/cron", c.apiCronList).Methods("GET")
+	r.HandleFunc("/grid/cron", c.apiCronCreate).Methods("POST")
+	r.HandleFunc("/grid/cron/{name}", c.apiCronDetails).Methods("GET")
+	r.HandleFunc("/grid/cron/{name}", c.apiCronDelete).Methods("DELETE")
+	r.HandleFunc("/grid/cron/{name}/suspend", c.apiCronSuspend).Methods("POST")
+	r.HandleFunc("/grid/cron/{name}/resume", c.apiCronResume).Methods("POST")
+	// Docker API compatibility
+	c.dockerRoute(r, "/_ping", c.apiPing, "GET")
+	c.dockerRoute(r, "/info", c.apiInfo, "GET")
+	c.dockerRoute(r, "/version", c.apiVersion, "GET")
+	c.dockerRoute(r, "/events", c.apiEvents, "GET")
+	c.dockerRoute(r, "/images/json", c.apiListImages, "GET")
+	c.dockerRoute(r, "/images/create", c.apiCreateImage, "POST")
+	c.dockerRoute(r, "/containers/json", c.apiListContainers, "GET")
+	c.dockerRoute(r, "/containers/create", c.apiCreateContainer, "POST")
+	c.dockerRoute(r, "/containers/{containerId}/attach", c.apiAttachContainer, "POST")
+	c.dockerRoute(r, "/containers/{containerId}/start", c.apiStartContainer, "POST")
+	c.dockerRoute(r, "/containers/{containerId}/wait", c.apiWaitContainer, "POST")
+	c.dockerRoute(r, "/containers/{containerId}/json", c.apiContainerJson, "GET")
+	c.dockerRoute(r, "/containers/{containerId}", c.apiDeleteContainer, "DELETE")
+	c.dockerRoute(r, "/containers/{containerId}/exec", c.apiContainerExec, "POST")
+	c.dockerRoute(r, "/containers/{containerId}/stats", c.proxyContainer, "GET")
+	c.dockerRoute(r, "/containers/{containerId}/top", c.proxyContainer, "GET")
+	c.dockerRoute(r, "/exec/{execId}/start", c.proxyExec, "POST")
+	c.dockerRoute(r, "/exec/{execId}/resize", c.proxyExec, "POST")
+	c.dockerRoute(r, "/exec/{execId}/json", c.proxyExec, "GET")
 	http.Handle("/", r)
 
 	log.Infof("grid controller started: version=%s port=%s", VERSION, c.Addr)
 
-	return http.ListenAndServe(c.Addr, c.logRequest(http.DefaultServeMux))
+	return http.ListenAndServe(c.Addr, c.logRequest(c.proxyToLeader(http.DefaultServeMux)))
 }
 
 func (c *Controller) logRequest(handler http.Handler) http.Handler {
@@ -125,26 +262,29 @@ func (c *Controller) apiNodeUpdate(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	exits := data.Exits
+	data.Exits = nil
+	events := data.Events
+	data.Events = nil
+	images := c.keepNodeImages(data)
+	proxy := c.keepNodeProxy(data)
+	reply := &common.NodeUpdateReply{
+		Resend: !images || !proxy,
+	}
+
 	// update datastore
-	c.datastore.Set(data.NodeId, data)
-	w.WriteHeader(http.StatusOK)
+	c.heartbeat(data)
+	c.registerNode(data)
+	c.containerExits(data.NodeId, exits)
+	c.nodeEvents(data.NodeId, events)
+	w.Header().Set("content-type", "application/json")
+	if err := json.NewEncoder(w).Encode(reply); err != nil {
+		log.Warnf("error encoding heartbeat reply: %s", err)
+	}
 }
 
 func (c *Controller) apiNodeList(w http.ResponseWriter, r *http.Request) {
-	data := c.datastore.Items()
-	var nodes []*common.NodeData
-	for _, v := range data {
-		nd := v.Data.(*common.NodeData)
-		n := &common.NodeData{
-			NodeId:     nd.NodeId,
-			Cpus:       nd.Cpus,
-			Memory:     nd.Memory,
-			Version:    nd.Version,
-			IP:         nd.IP,
-			Containers: nd.Containers,
-		}
-		nodes = append(nodes, n)
-	}
+	nodes := c.nodes()
 	w.Header().Set("content-type", "application/json")
 	if err := json.NewEncoder(w).Encode(nodes); err != nil {
 		log.Warnf("error encoding node list: %s", err)
@@ -155,10 +295,22 @@ func (c *Controller) apiNodeList(w http.ResponseWriter, r *http.Request) {
 func (c *Controller) apiNodeDetails(w http.ResponseWriter, r *http.Request) {
 	vars := mux.Vars(r)
 	nodeId := vars["nodeId"]
-	d, err := c.datastore.Get(nodeId)
-	if err != nil {
-		http.Error(w, err.Error(), http.StatusNotFound)
-		return
+	var d interface{}
+	item, err := c.datastore.Get(nodeId)
+	if err == nil {
+		n := *item.Data.(*common.NodeData)
+		n.ProxyToken, n.ProxyCert = "", ""
+		d = &n
+	} else {
+		// show the last known registration for nodes that are not connected
+		c.mutex.RLock()
+		reg, ok := c.registrations[nodeId]
+		c.mutex.RUnlock()
+		if !ok {
+			http.Error(w, err.Error(), http.StatusNotFound)
+			return
+		}
+		d = reg
 	}
 	w.Header().Set("content-type", "application/json")
 	if err := json.NewEncoder(w).Encode(d); err != nil {
@@ -168,15 +320,21 @@ func (c *Controller) apiNodeDetails(w http.ResponseWriter, r *http.Request) {
 }
 
 func (c *Controller) apiQueueNext(w http.ResponseWriter, r *http.Request) {
-	job := c.queue.Next()
+	nodeId := r.URL.Query().Get("node")
+	job := c.nextJob(nodeId)
 	if job == nil {
 		job = &common.Job{}
 	}
 
-	if job.(*common.Job).Id != "" {
-		log.Infof("sending job: id=%s image=%s node=%s", job.(*common.Job).Id, job.(*common.Job).ContainerConfig.Image, r.RemoteAddr)
+	if job.Id != "" {
+		log.Infof("sending job: id=%s action=%s image=%s node=%s", job.Id, job.Action, job.Image(), r.RemoteAddr)
+		c.jobEvent(common.EventJobSchedule, job, map[string]string{"node": nodeId})
 	}
 
+	// registry credentials only go to the node that runs the job
+	if job.RegistryAuth != "" {
+		w.Header().Set(common.RegistryAuthHeader, job.RegistryAuth)
+	}
 	w.Header().Set("content-type", "application/json")
 	if err := json.NewEncoder(w).Encode(job); err != nil {
 		log.Warnf("error encoding job: %s", err)
@@ -191,6 +349,22 @@ func (c *Controller) apiQueueResult(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	job := c.completeJob(result.JobId)
+	c.saveResult(result, job)
+	// dispatched jobs are not known after the controller restarts
+	if job == nil || job.Action == common.JobActionPull {
+		c.imagePulled(result)
+	}
+	if job != nil {
+		switch job.Action {
+		case common.JobActionStop:
+			c.containerStopped(job, result)
+		case common.JobActionRemove:
+			// requeue first so the credentials of the container are kept
+			c.containerPreempted(job, result)
+			c.containerRemoved(job, result)
+		}
+	}
 	c.jobResultDatastore.Set(result.JobId, result)
 	log.Infof("received job result: %s", result.JobId)
 	w.WriteHeader(http.StatusOK)
@@ -209,10 +383,49 @@ func (c *Controller) apiListContainers(w http.ResponseWriter, r *http.Request) {
 func (c *Controller) apiCreateContainer(w http.ResponseWriter, r *http.Request) {
 	var containerConfig dockerclient.ContainerConfig
 
-	if err := json.NewDecoder(r.Body).Decode(&containerConfig); err != nil {
+	b, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if err := json.Unmarshal(b, &containerConfig); err != nil {
 		http.Error(w, err.Error(), http.StatusInternalServerError)
 		return
 	}
+	if err := adaptCreateConfig(requestVersion(r), b, &containerConfig); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	var warnings []string
+	if c.policy != nil {
+		policyWarnings, err := c.policy.Apply(&containerConfig)
+		if err != nil {
+			log.Warnf("rejected container: image=%s remote=%s: %s", containerConfig.Image, r.RemoteAddr, err)
+			http.Error(w, err.Error(), http.StatusForbidden)
+			return
+		}
+		warnings = policyWarnings
+	}
+
+	var restartPolicy *common.RestartPolicy
+	if v := common.EnvValue(&containerConfig, common.RestartEnv); v != "" {
+		p, err := common.ParseRestartPolicy(v)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		restartPolicy = p
+	}
+	if _, _, err := c.priorities.Priority(&containerConfig); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	pullPolicy, err := common.ParsePullPolicy(common.EnvValue(&containerConfig, common.PullPolicyEnv))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
 
 	q := r.URL.Query()
 	containerName := ""
@@ -226,12 +439,18 @@ func (c *Controller) apiCreateContainer(w http.ResponseWriter, r *http.Request)
 		Date:            time.Now(),
 		ContainerName:   containerName,
 		ContainerConfig: &containerConfig,
+		RestartPolicy:   restartPolicy,
+		RegistryAuth:    r.Header.Get(common.RegistryAuthHeader),
+		PullPolicy:      pullPolicy,
 	}
-	c.queue.Add(job)
 
-	log.Infof("queue job: id=%s image=%s", job.Id, job.ContainerConfig.Image)
+	// watch before queueing so the result is not missed
+	results, cancel := c.jobResultDatastore.Watch(job.Id)
+	defer cancel()
+
+	c.enqueue(job)
 
-	log.Debugf("pending jobs: %d", c.queue.Len())
+	log.Infof("queue job: id=%s image=%s priority=%d", job.Id, job.ContainerConfig.Image, job.Priority)
 
 	// wait for response
 
@@ -240,17 +459,20 @@ func (c *Controller) apiCreateContainer(w http.ResponseWriter, r *http.Request)
 		Warnings: []string{},
 	}
 
-	for {
-		rs, err := c.jobResultDatastore.Get(job.Id)
-		if err != nil {
-			time.Sleep(500)
-			continue
-		}
-		result := rs.(*datastore.Item).Data.(*common.JobResult)
-		resp.Id = result.ContainerId
-		resp.Warnings = result.Warnings
-		break
+	// the image is pulled by the node the job is scheduled on
+	w.Header().Set(common.JobHeader, job.Id)
+	result, err := c.waitResult(w, job, results)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusGatewayTimeout)
+		return
+	}
+	if result.Error != "" {
+		http.Error(w, result.Error, http.StatusInternalServerError)
+		return
 	}
+	resp.Id = result.ContainerId
+	resp.Warnings = append(warnings, result.Warnings...)
+	resp.Warnings = append(resp.Warnings, c.pullStatus(job.Id)...)
 
 	w.Header().Set("content-type", "application/json")
 	if err := json.NewEncoder(w).Encode(resp); err != nil {
@@ -285,9 +507,9 @@ func (c *Controller) apiContainerJson(w http.ResponseWriter, r *http.Request) {
 	vars := mux.Vars(r)
 	containerId := vars["containerId"]
 	containerInfo := &dockerclient.ContainerInfo{}
-	for _, v := range c.jobResultDatastore.Items() {
-		result := v.Data.(*common.JobResult)
-		if strings.Index(result.ContainerId, containerId) == 0 {
+	if owner := c.findOwner(containerId); owner != nil {
+		result := &common.JobResult{}
+		if err := c.store.Get(resultsBucket, owner.JobId, result); err == nil && result.ContainerInfo != nil {
 			containerInfo = result.ContainerInfo
 		}
 	}
@@ -0,0 +1,350 @@
+package controller
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"time"
+
+	"code.google.com/p/go-uuid/uuid"
+	log "github.com/Sirupsen/logrus"
+	"github.com/ehazlett/docker-grid/common"
+	"github.com/gorilla/mux"
+	"github.com/robfig/cron"
+)
+
+const (
+	cronBucket          = "cron"
+	cronInterval        = time.Second * 10
+	defaultHistoryLimit = 10
+)
+
+func (c *Controller) getCronJob(name string) (*common.CronJob, error) {
+	cj := &common.CronJob{}
+	if err := c.store.Get(cronBucket, name, cj); err != nil {
+		return nil, err
+	}
+	return cj, nil
+}
+
+func (c *Controller) getCronJobs() []*common.CronJob {
+	cronJobs := []*common.CronJob{}
+	if err := c.store.ForEach(cronBucket, func(key string, data []byte) error {
+		cj := &common.CronJob{}
+		if err := json.Unmarshal(data, cj); err != nil {
+			return err
+		}
+		cronJobs = append(cronJobs, cj)
+		return nil
+	}); err != nil {
+		log.Warnf("error loading cron jobs: %s", err)
+	}
+	return cronJobs
+}
+
+// saveCronJob trims the finished runs to the history limit and saves the
+// cron job.
+func (c *Controller) saveCronJob(cj *common.CronJob) {
+	limit := cj.HistoryLimit
+	if limit <= 0 {
+		limit = defaultHistoryLimit
+	}
+	finished := 0
+	for _, run := range cj.History {
+		if !run.Active() {
+			finished++
+		}
+	}
+	history := []*common.CronRun{}
+	for _, run := range cj.History {
+		if !run.Active() && finished > limit {
+			finished--
+			continue
+		}
+		history = append(history, run)
+	}
+	cj.History = history
+
+	if err := c.store.Put(cronBucket, cj.Name, cj); err != nil {
+		log.Warnf("error saving cron job %s: %s", cj.Name, err)
+	}
+}
+
+// runCronJobs runs on the leader and queues the cron jobs that are due.
+// Runs missed while no controller was leader are run once.
+func (c *Controller) runCronJobs() {
+	ticker := time.NewTicker(cronInterval)
+	for now := range ticker.C {
+		if !c.isLeader() {
+			continue
+		}
+		c.cronLock.Lock()
+		for _, cj := range c.getCronJobs() {
+			if cj.Suspended {
+				continue
+			}
+			next := cj.NextSchedule
+			due, err := scheduleCronJob(cj, now)
+			if err != nil {
+				log.Warnf("invalid schedule for cron job %s: %s", cj.Name, err)
+				continue
+			}
+			if due {
+				c.runCronJob(cj, now)
+			}
+			if !cj.NextSchedule.Equal(next) {
+				c.saveCronJob(cj)
+			}
+		}
+		c.cronLock.Unlock()
+	}
+}
+
+// scheduleCronJob moves the next run of the cron job past now and reports
+// whether a run is due.  A job without a next run is only scheduled.
+func scheduleCronJob(cj *common.CronJob, now time.Time) (bool, error) {
+	schedule, err := cron.ParseStandard(cj.Schedule)
+	if err != nil {
+		return false, err
+	}
+	if !cj.NextSchedule.IsZero() && now.Before(cj.NextSchedule) {
+		return false, nil
+	}
+	due := !cj.NextSchedule.IsZero()
+	cj.NextSchedule = schedule.Next(now)
+	return due, nil
+}
+
+// runCronJob queues a run of the cron job following its concurrency
+// policy.  The cron lock must be held.
+func (c *Controller) runCronJob(cj *common.CronJob, now time.Time) {
+	cj.LastSchedule = now
+	active := []*common.CronRun{}
+	for _, run := range cj.History {
+		if run.Active() {
+			active = append(active, run)
+		}
+	}
+
+	if len(active) > 0 {
+		switch cj.ConcurrencyPolicy {
+		case common.ConcurrencyForbid:
+			log.Infof("skipping cron job: name=%s active=%d", cj.Name, len(active))
+			cj.History = append(cj.History, &common.CronRun{
+				Date:  now,
+				State: common.RunStateSkipped,
+				Error: "previous run has not finished",
+			})
+			return
+		case common.ConcurrencyReplace:
+			for _, run := range active {
+				log.Infof("replacing cron job run: name=%s job=%s", cj.Name, run.JobId)
+				run.State = common.RunStateReplaced
+				if run.ContainerId != "" {
+					c.removeRunContainer(run.NodeId, run.ContainerId)
+				}
+			}
+		}
+	}
+
+	config := *cj.ContainerConfig
+	config.Env = append([]string{}, cj.ContainerConfig.Env...)
+	config.Env = append(config.Env, fmt.Sprintf("%s=%s", common.CronEnv, cj.Name))
+	job := &common.Job{
+		Id:              uuid.New(),
+		Date:            now,
+		ContainerConfig: &config,
+		Cron:            cj.Name,
+	}
+	cj.History = append(cj.History, &common.CronRun{
+		JobId: job.Id,
+		Date:  now,
+		State: common.RunStatePending,
+	})
+	log.Infof("queue cron job: name=%s job=%s image=%s", cj.Name, job.Id, config.Image)
+	c.enqueue(job)
+}
+
+func (c *Controller) removeRunContainer(nodeId string, containerId string) {
+	c.enqueue(&common.Job{
+		Id:          uuid.New(),
+		Date:        time.Now(),
+		Action:      common.JobActionRemove,
+		NodeId:      nodeId,
+		ContainerId: containerId,
+	})
+}
+
+// cronRun returns the cron job and run the job was queued for.
+func (c *Controller) cronRun(job *common.Job) (*common.CronJob, *common.CronRun) {
+	cj, err := c.getCronJob(job.Cron)
+	if err != nil {
+		return nil, nil
+	}
+	for _, run := range cj.History {
+		if run.JobId == job.Id {
+			return cj, run
+		}
+	}
+	return nil, nil
+}
+
+// cronRunStarted records the container of a cron job run.  A run replaced
+// before it started is removed.
+func (c *Controller) cronRunStarted(job *common.Job, result *common.JobResult) {
+	c.cronLock.Lock()
+	defer c.cronLock.Unlock()
+	cj, run := c.cronRun(job)
+	if run == nil {
+		return
+	}
+	run.NodeId = result.NodeId
+	run.ContainerId = result.ContainerId
+	switch {
+	case result.Error != "":
+		run.State = common.RunStateFailed
+		run.Error = result.Error
+	case run.State == common.RunStateReplaced:
+		c.removeRunContainer(run.NodeId, run.ContainerId)
+	default:
+		run.State = common.RunStateRunning
+	}
+	c.saveCronJob(cj)
+}
+
+// cronRunExited records the exit code of a cron job run and removes its
+// container unless its node was lost.
+func (c *Controller) cronRunExited(owner *containerOwner, exitCode int, nodeLost bool) {
+	c.cronLock.Lock()
+	defer c.cronLock.Unlock()
+	if !nodeLost {
+		c.removeRunContainer(owner.NodeId, owner.ContainerId)
+	}
+	cj, run := c.cronRun(owner.Job)
+	if run == nil {
+		return
+	}
+	if run.State != common.RunStateReplaced {
+		run.ExitCode = &exitCode
+		run.State = common.RunStateSucceeded
+		switch {
+		case nodeLost:
+			run.State = common.RunStateFailed
+			run.Error = fmt.Sprintf("node %s down", owner.NodeId)
+		case exitCode != 0:
+			run.State = common.RunStateFailed
+		}
+		log.Infof("cron job run %s: name=%s job=%s code=%d", run.State, cj.Name, run.JobId, exitCode)
+	}
+	c.saveCronJob(cj)
+}
+
+func (c *Controller) writeCronJob(w http.ResponseWriter, v interface{}) {
+	w.Header().Set("content-type", "application/json")
+	if err := json.NewEncoder(w).Encode(v); err != nil {
+		log.Warnf("error encoding cron job: %s", err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+	}
+}
+
+func (c *Controller) apiCronList(w http.ResponseWriter, r *http.Request) {
+	c.writeCronJob(w, c.getCronJobs())
+}
+
+func (c *Controller) apiCronDetails(w http.ResponseWriter, r *http.Request) {
+	cj, err := c.getCronJob(mux.Vars(r)["name"])
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	}
+	c.writeCronJob(w, cj)
+}
+
+// apiCronCreate creates or updates a cron job.  The run history is kept
+// on update.
+func (c *Controller) apiCronCreate(w http.ResponseWriter, r *http.Request) {
+	cj := &common.CronJob{}
+	if err := json.NewDecoder(r.Body).Decode(cj); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if cj.Name == "" || cj.ContainerConfig == nil || cj.ContainerConfig.Image == "" {
+		http.Error(w, "cron job name and image are required", http.StatusBadRequest)
+		return
+	}
+	schedule, err := cron.ParseStandard(cj.Schedule)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("invalid schedule: %s", err), http.StatusBadRequest)
+		return
+	}
+	switch cj.ConcurrencyPolicy {
+	case "":
+		cj.ConcurrencyPolicy = common.ConcurrencyAllow
+	case common.ConcurrencyAllow, common.ConcurrencyForbid, common.ConcurrencyReplace:
+	default:
+		http.Error(w, fmt.Sprintf("invalid concurrency policy: %s", cj.ConcurrencyPolicy), http.StatusBadRequest)
+		return
+	}
+
+	if c.policy != nil {
+		if _, err := c.policy.Apply(cj.ContainerConfig); err != nil {
+			http.Error(w, err.Error(), http.StatusForbidden)
+			return
+		}
+	}
+
+	c.cronLock.Lock()
+	defer c.cronLock.Unlock()
+	cj.LastSchedule, cj.History = time.Time{}, nil
+	if current, err := c.getCronJob(cj.Name); err == nil {
+		cj.LastSchedule = current.LastSchedule
+		cj.History = current.History
+	}
+	cj.NextSchedule = schedule.Next(time.Now())
+	c.saveCronJob(cj)
+	log.Infof("cron job saved: name=%s schedule=%q image=%s next=%s", cj.Name, cj.Schedule, cj.ContainerConfig.Image, cj.NextSchedule)
+	c.writeCronJob(w, cj)
+}
+
+func (c *Controller) suspendCronJob(w http.ResponseWriter, r *http.Request, suspend bool) {
+	c.cronLock.Lock()
+	defer c.cronLock.Unlock()
+	cj, err := c.getCronJob(mux.Vars(r)["name"])
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	}
+	cj.Suspended = suspend
+	// runs missed while suspended are not run on resume
+	cj.NextSchedule = time.Time{}
+	if schedule, err := cron.ParseStandard(cj.Schedule); err == nil {
+		cj.NextSchedule = schedule.Next(time.Now())
+	}
+	c.saveCronJob(cj)
+	log.Infof("cron job suspended=%v: name=%s", suspend, cj.Name)
+	c.writeCronJob(w, cj)
+}
+
+func (c *Controller) apiCronSuspend(w http.ResponseWriter, r *http.Request) {
+	c.suspendCronJob(w, r, true)
+}
+
+func (c *Controller) apiCronResume(w http.ResponseWriter, r *http.Request) {
+	c.suspendCronJob(w, r, false)
+}
+
+func (c *Controller) apiCronDelete(w http.ResponseWriter, r *http.Request) {
+	name := mux.Vars(r)["name"]
+	c.cronLock.Lock()
+	defer c.cronLock.Unlock()
+	if _, err := c.getCronJob(name); err != nil {
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	}
+	if err := c.store.Delete(cronBucket, name); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	log.Infof("cron job removed: name=%s", name)
+	w.WriteHeader(http.StatusNoContent)
+}
@@ -0,0 +1,96 @@
+package controller
+
+import (
+	"testing"
+	"time"
+
+	"github.com/ehazlett/docker-grid/common"
+)
+
+func TestScheduleCronJob(t *testing.T) {
+	at := func(month time.Month, day, hour, min int) time.Time {
+		return time.Date(2015, month, day, hour, min, 0, 0, time.UTC)
+	}
+	tests := []struct {
+		name     string
+		schedule string
+		next     time.Time
+		now      time.Time
+		due      bool
+		expected time.Time
+	}{
+		{
+			name:     "first check only schedules",
+			schedule: "*/5 * * * *",
+			now:      at(time.June, 1, 10, 2),
+			expected: at(time.June, 1, 10, 5),
+		},
+		{
+			name:     "not due before the next run",
+			schedule: "*/5 * * * *",
+			next:     at(time.June, 1, 10, 5),
+			now:      at(time.June, 1, 10, 4),
+			expected: at(time.June, 1, 10, 5),
+		},
+		{
+			name:     "due at the next run",
+			schedule: "*/5 * * * *",
+			next:     at(time.June, 1, 10, 5),
+			now:      at(time.June, 1, 10, 5),
+			due:      true,
+			expected: at(time.June, 1, 10, 10),
+		},
+		{
+			name:     "missed runs are run once",
+			schedule: "0 3 * * *",
+			next:     at(time.June, 1, 3, 0),
+			now:      at(time.June, 4, 12, 0),
+			due:      true,
+			expected: at(time.June, 5, 3, 0),
+		},
+		{
+			name:     "descriptor",
+			schedule: "@hourly",
+			now:      at(time.June, 1, 10, 30),
+			expected: at(time.June, 1, 11, 0),
+		},
+		{
+			name:     "day of week",
+			schedule: "0 0 * * 1",
+			now:      at(time.June, 3, 12, 0),
+			expected: at(time.June, 8, 0, 0),
+		},
+		{
+			name:     "end of month",
+			schedule: "30 6 31 * *",
+			now:      at(time.June, 1, 0, 0),
+			expected: at(time.July, 31, 6, 30),
+		},
+	}
+	for _, test := range tests {
+		cj := &common.CronJob{Schedule: test.schedule, NextSchedule: test.next}
+		due, err := scheduleCronJob(cj, test.now)
+		if err != nil {
+			t.Fatalf("%s: unexpected error: %s", test.name, err)
+		}
+		if due != test.due {
+			t.Fatalf("%s: expected due %v; received %v", test.name, test.due, due)
+		}
+		if !cj.NextSchedule.Equal(test.expected) {
+			t.Fatalf("%s: expected next run %s; received %s", test.name, test.expected, cj.NextSchedule)
+		}
+	}
+}
+
+func TestScheduleCronJobInvalid(t *testing.T) {
+	next := time.Date(2015, time.June, 1, 10, 5, 0, 0, time.UTC)
+	for _, schedule := range []string{"", "* * *", "61 * * * *", "@sometimes"} {
+		cj := &common.CronJob{Schedule: schedule, NextSchedule: next}
+		if _, err := scheduleCronJob(cj, next); err == nil {
+			t.Fatalf("expected error for schedule %q", schedule)
+		}
+		if !cj.NextSchedule.Equal(next) {
+			t.Fatalf("expected next run to be kept for schedule %q; received %s", schedule, cj.NextSchedule)
+		}
+	}
+}
@@ -0,0 +1,209 @@
+package controller
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"time"
+
+	"code.google.com/p/go-uuid/uuid"
+	log "github.com/Sirupsen/logrus"
+	"github.com/ehazlett/docker-grid/common"
+	"github.com/gorilla/mux"
+)
+
+const (
+	cordonsBucket = "cordons"
+)
+
+type (
+	// nodeCordon takes a node out of scheduling.  When draining with
+	// reschedule the node containers are stopped and queued elsewhere.
+	nodeCordon struct {
+		NodeId     string   `json:"node_id,omitempty"`
+		Drain      bool     `json:"drain,omitempty"`
+		Reschedule bool     `json:"reschedule,omitempty"`
+		Total      int      `json:"total,omitempty"`
+		Pending    []string `json:"pending,omitempty"`
+	}
+)
+
+func (n *nodeCordon) status() *common.DrainStatus {
+	if !n.Drain {
+		return nil
+	}
+	return &common.DrainStatus{
+		Reschedule: n.Reschedule,
+		Total:      n.Total,
+		Remaining:  len(n.Pending),
+	}
+}
+
+// nodeKnown reports whether the node is connected or has been seen.
+func (c *Controller) nodeKnown(nodeId string) bool {
+	if _, err := c.datastore.Get(nodeId); err == nil {
+		return true
+	}
+	c.mutex.RLock()
+	defer c.mutex.RUnlock()
+	_, ok := c.registrations[nodeId]
+	return ok
+}
+
+func (c *Controller) saveCordon(cordon *nodeCordon) {
+	if err := c.store.Put(cordonsBucket, cordon.NodeId, cordon); err != nil {
+		log.Warnf("error saving cordon for node %s: %s", cordon.NodeId, err)
+	}
+}
+
+func (c *Controller) cordonNode(nodeId string) *nodeCordon {
+	c.mutex.Lock()
+	cordon, ok := c.cordons[nodeId]
+	if !ok {
+		cordon = &nodeCordon{
+			NodeId: nodeId,
+		}
+		c.cordons[nodeId] = cordon
+	}
+	c.mutex.Unlock()
+
+	log.Infof("node cordoned: id=%s", nodeId)
+	c.saveCordon(cordon)
+	return cordon
+}
+
+func (c *Controller) uncordonNode(nodeId string) {
+	c.mutex.Lock()
+	delete(c.cordons, nodeId)
+	c.mutex.Unlock()
+
+	log.Infof("node uncordoned: id=%s", nodeId)
+	if err := c.store.Delete(cordonsBucket, nodeId); err != nil {
+		log.Warnf("error removing cordon for node %s: %s", nodeId, err)
+	}
+}
+
+// drainNode cordons the node and, with reschedule, queues a stop for each
+// grid container on the node.  The containers are rescheduled as the
+// stops complete.
+func (c *Controller) drainNode(nodeId string, reschedule bool) *common.DrainStatus {
+	var containers []string
+	if reschedule {
+		if item, err := c.datastore.Get(nodeId); err == nil {
+			for _, cnt := range item.Data.(*common.NodeData).Containers {
+				if owner := c.findOwner(cnt.Id); owner != nil && owner.Job != nil {
+					containers = append(containers, owner.ContainerId)
+				}
+			}
+		}
+	}
+
+	c.mutex.Lock()
+	cordon, ok := c.cordons[nodeId]
+	if !ok {
+		cordon = &nodeCordon{
+			NodeId: nodeId,
+		}
+		c.cordons[nodeId] = cordon
+	}
+	cordon.Drain = true
+	cordon.Reschedule = reschedule
+	cordon.Total = len(containers)
+	cordon.Pending = containers
+	status := cordon.status()
+	c.mutex.Unlock()
+
+	c.saveCordon(cordon)
+	log.Infof("draining node: id=%s containers=%d reschedule=%v", nodeId, len(containers), reschedule)
+
+	for _, id := range containers {
+		c.enqueue(&common.Job{
+			Id:          uuid.New(),
+			Date:        time.Now(),
+			Action:      common.JobActionStop,
+			NodeId:      nodeId,
+			ContainerId: id,
+		})
+	}
+	return status
+}
+
+// containerStopped updates the drain progress and reschedules the
+// stopped container.
+func (c *Controller) containerStopped(job *common.Job, result *common.JobResult) {
+	c.mutex.Lock()
+	cordon, ok := c.cordons[job.NodeId]
+	if !ok || !cordon.Drain {
+		c.mutex.Unlock()
+		return
+	}
+	pending := []string{}
+	for _, id := range cordon.Pending {
+		if id != job.ContainerId {
+			pending = append(pending, id)
+		}
+	}
+	cordon.Pending = pending
+	reschedule := cordon.Reschedule
+	c.mutex.Unlock()
+
+	c.saveCordon(cordon)
+
+	if result.Error != "" {
+		log.Warnf("error stopping container %s on node %s: %s", job.ContainerId, job.NodeId, result.Error)
+		return
+	}
+	if owner := c.findOwner(job.ContainerId); reschedule && owner != nil && owner.Job != nil {
+		c.reschedule(owner, fmt.Sprintf("node %s drained", job.NodeId))
+	}
+}
+
+func (c *Controller) writeDrainStatus(w http.ResponseWriter, nodeId string) {
+	c.mutex.RLock()
+	var status *common.DrainStatus
+	if cordon, ok := c.cordons[nodeId]; ok {
+		status = cordon.status()
+	}
+	c.mutex.RUnlock()
+
+	data := &common.NodeData{
+		NodeId: nodeId,
+		State:  c.nodeState(nodeId),
+		Drain:  status,
+	}
+	w.Header().Set("content-type", "application/json")
+	if err := json.NewEncoder(w).Encode(data); err != nil {
+		log.Warnf("error encoding node state: %s", err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+	}
+}
+
+func (c *Controller) apiNodeCordon(w http.ResponseWriter, r *http.Request) {
+	nodeId := mux.Vars(r)["nodeId"]
+	if !c.nodeKnown(nodeId) {
+		http.Error(w, "unknown node", http.StatusNotFound)
+		return
+	}
+	c.cordonNode(nodeId)
+	c.writeDrainStatus(w, nodeId)
+}
+
+func (c *Controller) apiNodeUncordon(w http.ResponseWriter, r *http.Request) {
+	nodeId := mux.Vars(r)["nodeId"]
+	if !c.nodeKnown(nodeId) {
+		http.Error(w, "unknown node", http.StatusNotFound)
+		return
+	}
+	c.uncordonNode(nodeId)
+	c.writeDrainStatus(w, nodeId)
+}
+
+func (c *Controller) apiNodeDrain(w http.ResponseWriter, r *http.Request) {
+	nodeId := mux.Vars(r)["nodeId"]
+	if !c.nodeKnown(nodeId) {
+		http.Error(w, "unknown node", http.StatusNotFound)
+		return
+	}
+	c.drainNode(nodeId, r.URL.Query().Get("reschedule") == "true")
+	c.writeDrainStatus(w, nodeId)
+}
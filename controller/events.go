@@ -0,0 +1,304 @@
+package controller
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+	"github.com/ehazlett/docker-grid/common"
+)
+
+const (
+	// maxEvents is the number of events kept for since
+	maxEvents = 1000
+	// eventBuffer is the number of events a slow listener can fall
+	// behind before events are dropped for it
+	eventBuffer = 100
+)
+
+type (
+	// eventFilters are the filters of an events request by key
+	eventFilters map[string][]string
+)
+
+// emit records the event and sends it to the listeners.
+func (c *Controller) emit(evt *common.Event) {
+	if evt.Time == 0 {
+		now := time.Now()
+		evt.Time = now.Unix()
+		evt.TimeNano = now.UnixNano()
+	}
+	c.eventLock.Lock()
+	defer c.eventLock.Unlock()
+	c.events = append(c.events, evt)
+	if len(c.events) > maxEvents {
+		c.events = c.events[len(c.events)-maxEvents:]
+	}
+	for ch := range c.eventListeners {
+		select {
+		case ch <- evt:
+		default:
+			log.Debugf("event listener is behind; dropping event %s %s", evt.EventType(), evt.EventAction())
+		}
+	}
+}
+
+// gridEvent emits a grid event (node or job) for the id.  Empty
+// attributes are left out.
+func (c *Controller) gridEvent(eventType string, action string, id string, attributes map[string]string) {
+	if attributes == nil {
+		attributes = map[string]string{}
+	}
+	for k, v := range attributes {
+		if v == "" {
+			delete(attributes, k)
+		}
+	}
+	evt := &common.Event{
+		Status: action,
+		ID:     id,
+		Type:   eventType,
+		Action: action,
+		Actor: &common.EventActor{
+			ID:         id,
+			Attributes: attributes,
+		},
+	}
+	evt.NodeId = attributes["node"]
+	c.emit(evt)
+}
+
+// jobEvent emits a job event with the job details.
+func (c *Controller) jobEvent(action string, job *common.Job, attributes map[string]string) {
+	if attributes == nil {
+		attributes = map[string]string{}
+	}
+	attributes["action"] = job.Action
+	if job.IsCreate() {
+		attributes["action"] = common.JobActionCreate
+	}
+	attributes["image"] = job.Image()
+	attributes["name"] = job.ContainerName
+	c.gridEvent(common.EventTypeJob, action, job.Id, attributes)
+}
+
+// nodeEvents emits the Docker events sent by a node.
+func (c *Controller) nodeEvents(nodeId string, events []*common.Event) {
+	for _, evt := range events {
+		evt.SetNode(nodeId)
+		c.emit(evt)
+	}
+}
+
+// subscribe returns the recorded events and a channel for the new ones.
+func (c *Controller) subscribe() (chan *common.Event, []*common.Event) {
+	ch := make(chan *common.Event, eventBuffer)
+	c.eventLock.Lock()
+	defer c.eventLock.Unlock()
+	events := make([]*common.Event, len(c.events))
+	copy(events, c.events)
+	c.eventListeners[ch] = true
+	return ch, events
+}
+
+func (c *Controller) unsubscribe(ch chan *common.Event) {
+	c.eventLock.Lock()
+	defer c.eventLock.Unlock()
+	delete(c.eventListeners, ch)
+}
+
+func (c *Controller) eventListenerCount() int {
+	c.eventLock.Lock()
+	defer c.eventLock.Unlock()
+	return len(c.eventListeners)
+}
+
+// parseEventTime parses a since or until value in unix seconds with an
+// optional fraction (e.g. 1458923500.000000000).
+func parseEventTime(value string) (time.Time, error) {
+	if value == "" {
+		return time.Time{}, nil
+	}
+	parts := strings.SplitN(value, ".", 2)
+	sec, err := strconv.ParseInt(parts[0], 10, 64)
+	if err != nil {
+		return time.Time{}, fmt.Errorf("invalid time: %s", value)
+	}
+	var nsec int64
+	if len(parts) == 2 {
+		frac := (parts[1] + "000000000")[:9]
+		if nsec, err = strconv.ParseInt(frac, 10, 64); err != nil {
+			return time.Time{}, fmt.Errorf("invalid time: %s", value)
+		}
+	}
+	return time.Unix(sec, nsec), nil
+}
+
+// parseEventFilters parses the filters of an events request.  Docker
+// clients send {"type":["container"]} or, since API 1.22,
+// {"type":{"container":true}}.
+func parseEventFilters(value string) (eventFilters, error) {
+	filters := eventFilters{}
+	if value == "" {
+		return filters, nil
+	}
+	if err := json.Unmarshal([]byte(value), &filters); err == nil {
+		return filters, filters.validate()
+	}
+	m := map[string]map[string]bool{}
+	if err := json.Unmarshal([]byte(value), &m); err != nil {
+		return nil, fmt.Errorf("invalid filters: %s", value)
+	}
+	for key, values := range m {
+		for v, ok := range values {
+			if ok {
+				filters[key] = append(filters[key], v)
+			}
+		}
+	}
+	return filters, filters.validate()
+}
+
+func (f eventFilters) validate() error {
+	for key := range f {
+		switch key {
+		case "container", "event", "image", "label", "type", "node":
+		default:
+			return fmt.Errorf("Invalid filter '%s'", key)
+		}
+	}
+	return nil
+}
+
+// match reports whether the event matches one of the values of each
+// filter.
+func (f eventFilters) match(evt *common.Event) bool {
+	for key, values := range f {
+		ok := false
+		for _, v := range values {
+			if matchEvent(evt, key, v) {
+				ok = true
+				break
+			}
+		}
+		if !ok {
+			return false
+		}
+	}
+	return true
+}
+
+func matchEvent(evt *common.Event, key string, value string) bool {
+	switch key {
+	case "container":
+		if evt.EventType() != "container" {
+			return false
+		}
+		id := evt.ID
+		if evt.Actor != nil && evt.Actor.ID != "" {
+			id = evt.Actor.ID
+		}
+		return strings.HasPrefix(id, value) || evt.Attribute("name") == strings.TrimPrefix(value, "/")
+	case "event":
+		return evt.EventAction() == value
+	case "image":
+		return evt.From == value || evt.Attribute("image") == value
+	case "label":
+		kv := strings.SplitN(value, "=", 2)
+		if evt.Actor == nil {
+			return false
+		}
+		v, ok := evt.Actor.Attributes[kv[0]]
+		return ok && (len(kv) == 1 || v == kv[1])
+	case "type":
+		return evt.EventType() == value
+	case "node":
+		return evt.NodeId == value
+	}
+	return false
+}
+
+// apiEvents streams the events of the grid.  The recorded events since
+// the given time are sent first; the stream ends at until.
+func (c *Controller) apiEvents(w http.ResponseWriter, r *http.Request) {
+	q := r.URL.Query()
+	since, err := parseEventTime(q.Get("since"))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	until, err := parseEventTime(q.Get("until"))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	filters, err := parseEventFilters(q.Get("filters"))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	ch, events := c.subscribe()
+	defer c.unsubscribe(ch)
+
+	w.Header().Set("content-type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	flusher, _ := w.(http.Flusher)
+	enc := json.NewEncoder(w)
+	send := func(evt *common.Event) error {
+		if !filters.match(evt) {
+			return nil
+		}
+		if err := enc.Encode(evt); err != nil {
+			return err
+		}
+		if flusher != nil {
+			flusher.Flush()
+		}
+		return nil
+	}
+	if flusher != nil {
+		flusher.Flush()
+	}
+
+	if !since.IsZero() {
+		for _, evt := range events {
+			d := evt.Date()
+			if d.Before(since) || (!until.IsZero() && d.After(until)) {
+				continue
+			}
+			if err := send(evt); err != nil {
+				return
+			}
+		}
+	}
+
+	var timeout <-chan time.Time
+	if !until.IsZero() {
+		wait := until.Sub(time.Now())
+		if wait <= 0 {
+			return
+		}
+		timeout = time.After(wait)
+	}
+	var closed <-chan bool
+	if cn, ok := w.(http.CloseNotifier); ok {
+		closed = cn.CloseNotify()
+	}
+	for {
+		select {
+		case evt := <-ch:
+			if err := send(evt); err != nil {
+				return
+			}
+		case <-timeout:
+			return
+		case <-closed:
+			return
+		}
+	}
+}
@@ -0,0 +1,175 @@
+package controller
+
+import (
+	"reflect"
+	"sort"
+	"testing"
+	"time"
+
+	"github.com/ehazlett/docker-grid/common"
+)
+
+func TestParseEventTime(t *testing.T) {
+	tests := []struct {
+		value    string
+		expected time.Time
+		err      bool
+	}{
+		{value: ""},
+		{value: "1434000000", expected: time.Unix(1434000000, 0)},
+		{value: "1434000000.5", expected: time.Unix(1434000000, 500000000)},
+		{value: "1434000000.000000001", expected: time.Unix(1434000000, 1)},
+		{value: "1434000000.1234567891", expected: time.Unix(1434000000, 123456789)},
+		{value: "abc", err: true},
+		{value: "1434000000.x", err: true},
+		{value: "2015-06-11T05:20:00Z", err: true},
+	}
+	for _, test := range tests {
+		v, err := parseEventTime(test.value)
+		if test.err {
+			if err == nil {
+				t.Fatalf("%q: expected error; received %s", test.value, v)
+			}
+			continue
+		}
+		if err != nil {
+			t.Fatalf("%q: unexpected error: %s", test.value, err)
+		}
+		if !v.Equal(test.expected) {
+			t.Fatalf("%q: expected %s; received %s", test.value, test.expected, v)
+		}
+	}
+}
+
+func TestParseEventFilters(t *testing.T) {
+	tests := []struct {
+		value    string
+		expected eventFilters
+		err      bool
+	}{
+		{value: "", expected: eventFilters{}},
+		{
+			value:    `{"type":["container"],"event":["start","die"]}`,
+			expected: eventFilters{"type": {"container"}, "event": {"die", "start"}},
+		},
+		{
+			value:    `{"type":{"container":true},"event":{"die":true,"start":true,"stop":false}}`,
+			expected: eventFilters{"type": {"container"}, "event": {"die", "start"}},
+		},
+		{
+			value:    `{"node":["node-1"],"label":["env=prod"],"image":["redis"],"container":["web"]}`,
+			expected: eventFilters{"node": {"node-1"}, "label": {"env=prod"}, "image": {"redis"}, "container": {"web"}},
+		},
+		{value: `{"volume":["data"]}`, err: true},
+		{value: `{"volume":{"data":true}}`, err: true},
+		{value: `{"type":"container"}`, err: true},
+		{value: `[`, err: true},
+	}
+	for _, test := range tests {
+		filters, err := parseEventFilters(test.value)
+		if test.err {
+			if err == nil {
+				t.Fatalf("%q: expected error", test.value)
+			}
+			continue
+		}
+		if err != nil {
+			t.Fatalf("%q: unexpected error: %s", test.value, err)
+		}
+		// the values of the map format have no order
+		for _, values := range filters {
+			sort.Strings(values)
+		}
+		if !reflect.DeepEqual(filters, test.expected) {
+			t.Fatalf("%q: expected %v; received %v", test.value, test.expected, filters)
+		}
+	}
+}
+
+func TestMatchEvent(t *testing.T) {
+	// an event of a daemon older than API 1.22
+	old := &common.Event{
+		Status: "start",
+		ID:     "4f5a0e4bc4a1",
+		From:   "redis:3.0",
+		Time:   1434000000,
+	}
+	old.SetNode("node-1")
+	current := &common.Event{
+		Type:   "container",
+		Action: "die",
+		Actor: &common.EventActor{
+			ID: "9c2b1e0a7f3d",
+			Attributes: map[string]string{
+				"name":  "web",
+				"image": "nginx",
+				"env":   "prod",
+			},
+		},
+	}
+	current.SetNode("node-2")
+	image := &common.Event{
+		Type:   "image",
+		Action: "pull",
+		Actor:  &common.EventActor{ID: "redis:3.0"},
+	}
+	job := &common.Event{
+		Type:   common.EventTypeJob,
+		Action: common.EventJobQueue,
+		Actor:  &common.EventActor{ID: "job-1", Attributes: map[string]string{"image": "redis"}},
+	}
+
+	tests := []struct {
+		name     string
+		evt      *common.Event
+		key      string
+		value    string
+		expected bool
+	}{
+		{name: "old container id", evt: old, key: "container", value: "4f5a0e4bc4a1", expected: true},
+		{name: "old container id prefix", evt: old, key: "container", value: "4f5a", expected: true},
+		{name: "container id prefix", evt: current, key: "container", value: "9c2b", expected: true},
+		{name: "container name", evt: current, key: "container", value: "web", expected: true},
+		{name: "container name with slash", evt: current, key: "container", value: "/web", expected: true},
+		{name: "other container", evt: current, key: "container", value: "db"},
+		{name: "container filter on image event", evt: image, key: "container", value: "redis"},
+		{name: "old event status", evt: old, key: "event", value: "start", expected: true},
+		{name: "event action", evt: current, key: "event", value: "die", expected: true},
+		{name: "other action", evt: current, key: "event", value: "start"},
+		{name: "old event image", evt: old, key: "image", value: "redis:3.0", expected: true},
+		{name: "image attribute", evt: current, key: "image", value: "nginx", expected: true},
+		{name: "other image", evt: current, key: "image", value: "redis"},
+		{name: "label key", evt: current, key: "label", value: "env", expected: true},
+		{name: "label value", evt: current, key: "label", value: "env=prod", expected: true},
+		{name: "other label value", evt: current, key: "label", value: "env=dev"},
+		{name: "missing label", evt: current, key: "label", value: "tier"},
+		{name: "old events are container events", evt: old, key: "type", value: "container", expected: true},
+		{name: "image type", evt: image, key: "type", value: "image", expected: true},
+		{name: "job type", evt: job, key: "type", value: common.EventTypeJob, expected: true},
+		{name: "other type", evt: job, key: "type", value: "container"},
+		{name: "node", evt: old, key: "node", value: "node-1", expected: true},
+		{name: "other node", evt: current, key: "node", value: "node-1"},
+		{name: "grid event without node", evt: job, key: "node", value: "node-1"},
+		{name: "unknown filter", evt: current, key: "volume", value: "data"},
+	}
+	for _, test := range tests {
+		if matchEvent(test.evt, test.key, test.value) != test.expected {
+			t.Fatalf("%s: expected %s=%s to match %v", test.name, test.key, test.value, test.expected)
+		}
+	}
+
+	filters := eventFilters{
+		"type":  {"container"},
+		"event": {"start", "die"},
+		"node":  {"node-2"},
+	}
+	if !filters.match(current) {
+		t.Fatalf("expected filters to match")
+	}
+	if filters.match(old) {
+		t.Fatalf("expected filters not to match an event of another node")
+	}
+	if !(eventFilters{}).match(job) {
+		t.Fatalf("expected empty filters to match")
+	}
+}
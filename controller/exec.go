@@ -0,0 +1,211 @@
+package controller
+
+import (
+	"bytes"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strings"
+
+	log "github.com/Sirupsen/logrus"
+	"github.com/ehazlett/docker-grid/common"
+	"github.com/ehazlett/docker-grid/utils/proxy"
+	"github.com/gorilla/mux"
+)
+
+type (
+	// execRecord is the node and container of an exec instance
+	execRecord struct {
+		nodeId      string
+		containerId string
+	}
+)
+
+// findContainer returns the connected node and full id of the container
+// by full or partial id or by name.
+func (c *Controller) findContainer(idOrName string) (*common.NodeData, string, error) {
+	for _, v := range c.datastore.Items() {
+		nd := v.Data.(*common.NodeData)
+		for _, cnt := range nd.Containers {
+			if strings.Index(cnt.Id, idOrName) == 0 {
+				return nd, cnt.Id, nil
+			}
+			for _, name := range cnt.Names {
+				if name == "/"+idOrName {
+					return nd, cnt.Id, nil
+				}
+			}
+		}
+	}
+	return nil, "", fmt.Errorf("No such container: %s", idOrName)
+}
+
+// nodeProxy returns the proxy of the connected node.
+func (c *Controller) nodeProxy(nodeId string) (*common.NodeData, *url.URL, error) {
+	item, err := c.datastore.Get(nodeId)
+	if err != nil {
+		return nil, nil, fmt.Errorf("node %s is not connected", nodeId)
+	}
+	nd := item.Data.(*common.NodeData)
+	if nd.ProxyURL == "" {
+		return nil, nil, fmt.Errorf("node %s has no proxy (--proxy-port)", nodeId)
+	}
+	u, err := url.Parse(nd.ProxyURL)
+	if err != nil {
+		return nil, nil, err
+	}
+	return nd, u, nil
+}
+
+// keepNodeProxy keeps the proxy token and certificate the node sent when
+// it registered.  It reports false when they are not known and the node
+// must send them again.
+func (c *Controller) keepNodeProxy(data *common.NodeData) bool {
+	if data.ProxyURL == "" || data.ProxyToken != "" {
+		return true
+	}
+	item, err := c.datastore.Get(data.NodeId)
+	if err != nil {
+		return false
+	}
+	last := item.Data.(*common.NodeData)
+	if last.ProxyToken == "" {
+		return false
+	}
+	data.ProxyToken, data.ProxyCert = last.ProxyToken, last.ProxyCert
+	return true
+}
+
+// proxyTLS trusts only the certificate the node sent when it registered.
+func proxyTLS(nd *common.NodeData) (*tls.Config, error) {
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM([]byte(nd.ProxyCert)) {
+		return nil, fmt.Errorf("node %s sent no proxy certificate", nd.NodeId)
+	}
+	return &tls.Config{RootCAs: pool, MinVersion: tls.VersionTLS12}, nil
+}
+
+// hijackNode forwards the request to the proxy of the node on a hijacked
+// connection so streams are passed through as they are.
+func (c *Controller) hijackNode(w http.ResponseWriter, r *http.Request, nodeId string) {
+	nd, u, err := c.nodeProxy(nodeId)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusServiceUnavailable)
+		return
+	}
+	config, err := proxyTLS(nd)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusServiceUnavailable)
+		return
+	}
+	conn, err := tls.Dial("tcp", u.Host, config)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadGateway)
+		return
+	}
+	r.Header.Set(common.ProxyTokenHeader, nd.ProxyToken)
+	log.Debugf("proxying to node %s: %s %s", nodeId, r.Method, r.URL)
+	if err := proxy.Hijack(w, r, conn); err != nil {
+		log.Warnf("error proxying to node %s: %s", nodeId, err)
+	}
+}
+
+// proxyExec forwards the request for the exec instance to its node.
+func (c *Controller) proxyExec(w http.ResponseWriter, r *http.Request) {
+	execId := mux.Vars(r)["execId"]
+	c.mutex.RLock()
+	rec, ok := c.execs[execId]
+	c.mutex.RUnlock()
+	if !ok {
+		http.Error(w, fmt.Sprintf("No such exec instance: %s", execId), http.StatusNotFound)
+		return
+	}
+	c.hijackNode(w, r, rec.nodeId)
+}
+
+func (c *Controller) apiContainerExec(w http.ResponseWriter, r *http.Request) {
+	containerId := mux.Vars(r)["containerId"]
+	nd, id, err := c.findContainer(containerId)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	}
+	nd, u, err := c.nodeProxy(nd.NodeId)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusServiceUnavailable)
+		return
+	}
+	config, err := proxyTLS(nd)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusServiceUnavailable)
+		return
+	}
+
+	body, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	path := strings.Replace(r.URL.Path, "/containers/"+containerId+"/", "/containers/"+id+"/", 1)
+	req, err := http.NewRequest("POST", u.String()+path, bytes.NewReader(body))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set(common.ProxyTokenHeader, nd.ProxyToken)
+	client := &http.Client{Transport: &http.Transport{TLSClientConfig: config}}
+	resp, err := client.Do(req)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadGateway)
+		return
+	}
+	defer resp.Body.Close()
+
+	b, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadGateway)
+		return
+	}
+	if resp.StatusCode == http.StatusCreated {
+		created := struct{ Id string }{}
+		if err := json.Unmarshal(b, &created); err != nil {
+			http.Error(w, err.Error(), http.StatusBadGateway)
+			return
+		}
+		c.mutex.Lock()
+		c.execs[created.Id] = &execRecord{nodeId: nd.NodeId, containerId: id}
+		c.mutex.Unlock()
+		log.Infof("exec created: id=%s container=%s node=%s", created.Id, id, nd.NodeId)
+	}
+	w.Header().Set("content-type", resp.Header.Get("Content-Type"))
+	w.WriteHeader(resp.StatusCode)
+	w.Write(b)
+}
+
+// execsRemoved forgets the exec instances of a container that exited or
+// was removed.
+func (c *Controller) execsRemoved(containerId string) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	for id, rec := range c.execs {
+		if rec.containerId == containerId {
+			delete(c.execs, id)
+		}
+	}
+}
+
+// nodeExecsLost forgets the exec instances on a node that went down.
+func (c *Controller) nodeExecsLost(nodeId string) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	for id, rec := range c.execs {
+		if rec.nodeId == nodeId {
+			delete(c.execs, id)
+		}
+	}
+}
@@ -0,0 +1,148 @@
+package controller
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"time"
+
+	"code.google.com/p/go-uuid/uuid"
+	log "github.com/Sirupsen/logrus"
+	"github.com/ehazlett/docker-grid/common"
+	"github.com/gorilla/mux"
+)
+
+// groupMembers returns the members of the group started by the container.
+func (c *Controller) groupMembers(owner *containerOwner) []*containerOwner {
+	members := []*containerOwner{}
+	if owner.Job == nil || owner.Job.Group == nil {
+		return members
+	}
+	c.mutex.RLock()
+	defer c.mutex.RUnlock()
+	for _, m := range c.owners {
+		if m.Primary == owner.ContainerId {
+			members = append(members, m)
+		}
+	}
+	return members
+}
+
+// removeContainers queues the removal of the container.  The members of a
+// group are removed before the container whose network namespace they
+// share.
+func (c *Controller) removeContainers(owner *containerOwner) {
+	for _, m := range c.groupMembers(owner) {
+		c.removeRunContainer(m.NodeId, m.ContainerId)
+	}
+	c.removeRunContainer(owner.NodeId, owner.ContainerId)
+}
+
+// apiCreateGroup queues a group and waits until all of its members are
+// created on one node.
+func (c *Controller) apiCreateGroup(w http.ResponseWriter, r *http.Request) {
+	group := &common.Group{}
+	if err := json.NewDecoder(r.Body).Decode(group); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if len(group.Members) == 0 {
+		http.Error(w, "group has no members", http.StatusBadRequest)
+		return
+	}
+	names := map[string]bool{}
+	for _, m := range group.Members {
+		if m.Name == "" || m.ContainerConfig == nil || m.ContainerConfig.Image == "" {
+			http.Error(w, "group member name and image are required", http.StatusBadRequest)
+			return
+		}
+		if names[m.Name] {
+			http.Error(w, fmt.Sprintf("duplicate group member: %s", m.Name), http.StatusBadRequest)
+			return
+		}
+		names[m.Name] = true
+	}
+
+	var warnings []string
+	if c.policy != nil {
+		for _, m := range group.Members {
+			policyWarnings, err := c.policy.Apply(m.ContainerConfig)
+			if err != nil {
+				log.Warnf("rejected group member: name=%s image=%s remote=%s: %s", m.Name, m.ContainerConfig.Image, r.RemoteAddr, err)
+				http.Error(w, fmt.Sprintf("%s: %s", m.Name, err), http.StatusForbidden)
+				return
+			}
+			warnings = append(warnings, policyWarnings...)
+		}
+	}
+
+	primary := group.Members[0].ContainerConfig
+	var restartPolicy *common.RestartPolicy
+	if v := common.EnvValue(primary, common.RestartEnv); v != "" {
+		p, err := common.ParseRestartPolicy(v)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		restartPolicy = p
+	}
+	if _, _, err := c.priorities.Priority(primary); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if _, err := common.ParsePullPolicy(common.EnvValue(primary, common.PullPolicyEnv)); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	job := &common.Job{
+		Id:              uuid.New(),
+		Date:            time.Now(),
+		ContainerName:   group.MemberName(group.Members[0]),
+		ContainerConfig: primary,
+		RestartPolicy:   restartPolicy,
+		RegistryAuth:    r.Header.Get(common.RegistryAuthHeader),
+		Group:           group,
+	}
+
+	// watch before queueing so the result is not missed
+	results, cancel := c.jobResultDatastore.Watch(job.Id)
+	defer cancel()
+
+	c.enqueue(job)
+
+	log.Infof("queue group: id=%s name=%s members=%d priority=%d", job.Id, group.Name, len(group.Members), job.Priority)
+
+	result, err := c.waitResult(w, job, results)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusGatewayTimeout)
+		return
+	}
+	if result.Error != "" {
+		http.Error(w, result.Error, http.StatusInternalServerError)
+		return
+	}
+
+	resp := &common.GroupResponse{
+		Id:         result.ContainerId,
+		Containers: result.Containers,
+		Warnings:   append(warnings, result.Warnings...),
+	}
+	w.Header().Set("content-type", "application/json")
+	if err := json.NewEncoder(w).Encode(resp); err != nil {
+		log.Warnf("error encoding group response: %s", err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+	}
+}
+
+// apiDeleteGroup removes the group started by the container.
+func (c *Controller) apiDeleteGroup(w http.ResponseWriter, r *http.Request) {
+	owner := c.findOwner(mux.Vars(r)["id"])
+	if owner == nil || owner.Job == nil || owner.Job.Group == nil || owner.Primary != "" {
+		http.Error(w, "group not found", http.StatusNotFound)
+		return
+	}
+	log.Infof("removing group: id=%s name=%s", owner.ContainerId, owner.Job.Group.Name)
+	c.removeContainers(owner)
+	w.WriteHeader(http.StatusNoContent)
+}
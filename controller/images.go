@@ -0,0 +1,621 @@
+package controller
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+
+	"code.google.com/p/go-uuid/uuid"
+	log "github.com/Sirupsen/logrus"
+	"github.com/ehazlett/docker-grid/common"
+	"github.com/gorilla/mux"
+	"github.com/samalba/dockerclient"
+)
+
+const (
+	prepullsBucket = "prepulls"
+	// localityWait is how long a new container waits for a node that
+	// already has its image before it is placed on a node that must pull
+	localityWait = time.Second * 10
+	// pullProgressInterval is how often a Docker pull reports the nodes
+	// that finished
+	pullProgressInterval = time.Second
+	// progressTTL is how long the pull progress of a job is kept
+	progressTTL = time.Minute * 10
+	// prepullRetention is how long finished prepulls are kept
+	prepullRetention = time.Hour * 24
+)
+
+type (
+	// localNode is a node that has an image when the queue is polled
+	localNode struct {
+		nodeId      string
+		schedulable bool
+		free        int64
+	}
+
+	// jobProgress is the latest pull progress of each layer of a job
+	jobProgress struct {
+		updated  time.Time
+		progress []*common.PullProgress
+	}
+)
+
+// keepNodeImages keeps the images of the last heartbeat when the node only
+// sent their hash.  It reports false when the images are not known and
+// the node must send them again.
+func (c *Controller) keepNodeImages(data *common.NodeData) bool {
+	if data.Images != nil || data.ImagesHash == "" {
+		return true
+	}
+	item, err := c.datastore.Get(data.NodeId)
+	if err != nil {
+		return false
+	}
+	last := item.Data.(*common.NodeData)
+	if last.ImagesHash != data.ImagesHash {
+		return false
+	}
+	data.Images = last.Images
+	return true
+}
+
+// nodeImages returns the images reported by each connected node.
+func (c *Controller) nodeImages() map[string]map[string]bool {
+	images := map[string]map[string]bool{}
+	for nodeId, item := range c.datastore.Items() {
+		nodeData := item.Data.(*common.NodeData)
+		local := map[string]bool{}
+		for _, img := range nodeData.Images {
+			for _, tag := range img.RepoTags {
+				local[common.ParseImage(tag).String()] = true
+			}
+		}
+		images[nodeId] = local
+	}
+	return images
+}
+
+// imageLocality returns the connected nodes that have each image with
+// their state.  It is built once for each queue poll.
+func (c *Controller) imageLocality() map[string][]*localNode {
+	locality := map[string][]*localNode{}
+	for nodeId, local := range c.nodeImages() {
+		n := &localNode{
+			nodeId:      nodeId,
+			schedulable: c.schedulable(nodeId),
+			free:        c.nodeFree(nodeId),
+		}
+		for image := range local {
+			locality[image] = append(locality[image], n)
+		}
+	}
+	return locality
+}
+
+// preferElsewhere reports whether the job should be left for another node
+// that has its image and room for it.  Jobs that have waited longer than
+// localityWait go to any node.
+func preferElsewhere(job *common.Job, nodeId string, locality map[string][]*localNode, counts map[string]map[string]int, now time.Time) bool {
+	if job.Image() == "" || now.Sub(job.Date) >= localityWait {
+		return false
+	}
+	nodes := locality[common.ParseImage(job.Image()).String()]
+	for _, n := range nodes {
+		if n.nodeId == nodeId {
+			return false
+		}
+	}
+	for _, n := range nodes {
+		if eligible(job, n.nodeId, n.schedulable, now) && placementAllows(job, n.nodeId, counts) && fits(job, n.free) {
+			return true
+		}
+	}
+	return false
+}
+
+// addProgress records the pull progress sent by a node.  Progress not
+// updated for progressTTL is dropped.
+func (c *Controller) addProgress(p *common.JobProgress) {
+	c.progressLock.Lock()
+	defer c.progressLock.Unlock()
+	now := time.Now()
+	for id, jp := range c.jobProgress {
+		if now.Sub(jp.updated) > progressTTL {
+			delete(c.jobProgress, id)
+		}
+	}
+	jp, ok := c.jobProgress[p.JobId]
+	if !ok {
+		jp = &jobProgress{}
+		c.jobProgress[p.JobId] = jp
+	}
+	jp.updated = now
+	jp.progress = common.MergeProgress(jp.progress, p.Progress...)
+}
+
+// getProgress returns the pull progress of the job.
+func (c *Controller) getProgress(jobId string) []*common.PullProgress {
+	c.progressLock.Lock()
+	defer c.progressLock.Unlock()
+	jp, ok := c.jobProgress[jobId]
+	if !ok {
+		return []*common.PullProgress{}
+	}
+	return append([]*common.PullProgress{}, jp.progress...)
+}
+
+// pullStatus returns the messages for the whole image of the pull of the
+// job, e.g. "Status: Downloaded newer image for redis:3.0".
+func (c *Controller) pullStatus(jobId string) []string {
+	status := []string{}
+	for _, msg := range c.getProgress(jobId) {
+		if msg.Id == "" && msg.Status != "" && msg.Error == "" {
+			status = append(status, msg.Status)
+		}
+	}
+	return status
+}
+
+func (c *Controller) apiQueueProgress(w http.ResponseWriter, r *http.Request) {
+	p := &common.JobProgress{}
+	if err := json.NewDecoder(r.Body).Decode(p); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	c.addProgress(p)
+	w.WriteHeader(http.StatusOK)
+}
+
+// apiJobProgress returns the pull progress of a job.
+func (c *Controller) apiJobProgress(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("content-type", "application/json")
+	if err := json.NewEncoder(w).Encode(c.getProgress(mux.Vars(r)["id"])); err != nil {
+		log.Warnf("error encoding job progress: %s", err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+	}
+}
+
+func (c *Controller) getPrepull(id string) (*common.Prepull, error) {
+	p := &common.Prepull{}
+	if err := c.store.Get(prepullsBucket, id, p); err != nil {
+		return nil, err
+	}
+	return p, nil
+}
+
+func (c *Controller) getPrepulls() []*common.Prepull {
+	prepulls := []*common.Prepull{}
+	if err := c.store.ForEach(prepullsBucket, func(key string, data []byte) error {
+		p := &common.Prepull{}
+		if err := json.Unmarshal(data, p); err != nil {
+			return err
+		}
+		prepulls = append(prepulls, p)
+		return nil
+	}); err != nil {
+		log.Warnf("error loading prepulls: %s", err)
+	}
+	return prepulls
+}
+
+// updatePrepull counts the finished pulls and saves the prepull.
+func (c *Controller) updatePrepull(p *common.Prepull) {
+	p.Completed, p.Failed = 0, 0
+	for _, n := range p.NodeStatus {
+		switch n.State {
+		case common.PullStateComplete:
+			p.Completed++
+		case common.PullStateFailed:
+			p.Failed++
+		}
+	}
+	if p.Completed+p.Failed == p.Total && p.CompletedAt.IsZero() {
+		p.State = common.PullStateComplete
+		if p.Failed > 0 {
+			p.State = common.PullStateFailed
+		}
+		p.CompletedAt = time.Now()
+		log.Infof("prepull %s: id=%s image=%s completed=%d failed=%d", p.State, p.Id, p.Image, p.Completed, p.Failed)
+	}
+	if err := c.store.Put(prepullsBucket, p.Id, p); err != nil {
+		log.Warnf("error saving prepull %s: %s", p.Id, err)
+	}
+}
+
+// indexPrepull records the pending pull jobs of the prepull.  The
+// prepull lock must be held.
+func (c *Controller) indexPrepull(p *common.Prepull) {
+	for _, n := range p.NodeStatus {
+		if n.State == common.PullStatePending {
+			c.prepullJobs[n.JobId] = p.Id
+		}
+	}
+}
+
+// restorePrepulls indexes the pending pull jobs of the saved prepulls.
+func (c *Controller) restorePrepulls() {
+	c.prepullLock.Lock()
+	defer c.prepullLock.Unlock()
+	for _, p := range c.getPrepulls() {
+		if p.CompletedAt.IsZero() {
+			c.indexPrepull(p)
+		}
+	}
+}
+
+// imagePulled records the result of a pull on a node.
+func (c *Controller) imagePulled(result *common.JobResult) {
+	c.prepullLock.Lock()
+	defer c.prepullLock.Unlock()
+	id, ok := c.prepullJobs[result.JobId]
+	if !ok {
+		return
+	}
+	delete(c.prepullJobs, result.JobId)
+	p, err := c.getPrepull(id)
+	if err != nil {
+		log.Warnf("error loading prepull %s: %s", id, err)
+		return
+	}
+	for _, n := range p.NodeStatus {
+		if n.JobId != result.JobId {
+			continue
+		}
+		n.State = common.PullStateComplete
+		n.Error = result.Error
+		if result.Error != "" {
+			n.State = common.PullStateFailed
+		}
+		n.CompletedAt = time.Now()
+		c.updatePrepull(p)
+		return
+	}
+}
+
+// nodePullsLost fails the pulls on a node that went down.  Nodes get a new
+// id when they restart so the pulls would never run.
+func (c *Controller) nodePullsLost(nodeId string) {
+	reason := fmt.Sprintf("node %s down", nodeId)
+
+	c.queueLock.Lock()
+	jobs := []*common.Job{}
+	queued := c.queue.Jobs()
+	for i := len(queued) - 1; i >= 0; i-- {
+		if job := queued[i]; job.Action == common.JobActionPull && job.NodeId == nodeId {
+			c.queue.Remove(i)
+			jobs = append(jobs, job)
+		}
+	}
+	for id, job := range c.pendingJobs {
+		if job.Action == common.JobActionPull && job.NodeId == nodeId {
+			delete(c.pendingJobs, id)
+			jobs = append(jobs, job)
+		}
+	}
+	c.queueLock.Unlock()
+	for _, job := range jobs {
+		job.RegistryAuth = ""
+		c.saveResult(&common.JobResult{JobId: job.Id, NodeId: nodeId, Error: reason}, job)
+	}
+
+	c.prepullLock.Lock()
+	defer c.prepullLock.Unlock()
+	now := time.Now()
+	for _, p := range c.getPrepulls() {
+		if !p.CompletedAt.IsZero() {
+			continue
+		}
+		lost := false
+		for _, n := range p.NodeStatus {
+			if n.NodeId != nodeId || n.State != common.PullStatePending {
+				continue
+			}
+			n.State = common.PullStateFailed
+			n.Error = reason
+			n.CompletedAt = now
+			delete(c.prepullJobs, n.JobId)
+			lost = true
+		}
+		if lost {
+			c.updatePrepull(p)
+		}
+	}
+}
+
+// expirePrepulls runs on the leader.  It removes the prepulls finished
+// longer than prepullRetention ago and fails the pulls on nodes that have
+// not been connected since this controller became the leader.
+func (c *Controller) expirePrepulls() {
+	ticker := time.NewTicker(pruneInterval)
+	for now := range ticker.C {
+		if !c.isLeader() {
+			continue
+		}
+		c.mutex.RLock()
+		restored := c.restored
+		c.mutex.RUnlock()
+		connected := c.datastore.Items()
+
+		lost := map[string]bool{}
+		c.prepullLock.Lock()
+		for _, p := range c.getPrepulls() {
+			if p.CompletedAt.IsZero() {
+				for _, n := range p.NodeStatus {
+					if _, ok := connected[n.NodeId]; !ok && n.State == common.PullStatePending && now.Sub(restored) > pruneInterval {
+						lost[n.NodeId] = true
+					}
+				}
+				continue
+			}
+			if now.Sub(p.CompletedAt) > prepullRetention {
+				if err := c.store.Delete(prepullsBucket, p.Id); err != nil {
+					log.Warnf("error removing prepull %s: %s", p.Id, err)
+				}
+			}
+		}
+		c.prepullLock.Unlock()
+
+		for nodeId := range lost {
+			log.Infof("failing pulls on lost node: id=%s", nodeId)
+			c.nodePullsLost(nodeId)
+		}
+	}
+}
+
+func (c *Controller) writePrepull(w http.ResponseWriter, v interface{}) {
+	w.Header().Set("content-type", "application/json")
+	if err := json.NewEncoder(w).Encode(v); err != nil {
+		log.Warnf("error encoding prepull: %s", err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+	}
+}
+
+// startPrepull queues a pull of the image on the nodes or on every
+// connected node.  The registry credentials are only sent to the nodes.
+func (c *Controller) startPrepull(image string, nodes []string, auth string) (*common.Prepull, error) {
+	if len(nodes) == 0 {
+		for nodeId := range c.datastore.Items() {
+			nodes = append(nodes, nodeId)
+		}
+	}
+	for _, nodeId := range nodes {
+		if _, err := c.datastore.Get(nodeId); err != nil {
+			return nil, fmt.Errorf("unknown node: %s", nodeId)
+		}
+	}
+	if len(nodes) == 0 {
+		return nil, fmt.Errorf("no nodes connected")
+	}
+
+	p := &common.Prepull{
+		Id:    uuid.New(),
+		Image: image,
+		Nodes: nodes,
+		Date:  time.Now(),
+		State: common.PullStatePending,
+		Total: len(nodes),
+	}
+	jobs := []*common.Job{}
+	for _, nodeId := range nodes {
+		job := &common.Job{
+			Id:              uuid.New(),
+			Date:            p.Date,
+			Action:          common.JobActionPull,
+			NodeId:          nodeId,
+			ContainerConfig: &dockerclient.ContainerConfig{Image: image},
+			RegistryAuth:    auth,
+		}
+		jobs = append(jobs, job)
+		p.NodeStatus = append(p.NodeStatus, &common.NodePull{
+			NodeId: nodeId,
+			JobId:  job.Id,
+			State:  common.PullStatePending,
+		})
+	}
+
+	c.prepullLock.Lock()
+	c.updatePrepull(p)
+	c.indexPrepull(p)
+	c.prepullLock.Unlock()
+	for _, job := range jobs {
+		c.enqueue(job)
+	}
+	log.Infof("prepull queued: id=%s image=%s nodes=%d", p.Id, p.Image, p.Total)
+	return p, nil
+}
+
+// applyImagePolicy returns the image after the policy registry rewrites.
+func (c *Controller) applyImagePolicy(image string) (string, error) {
+	if c.policy == nil {
+		return image, nil
+	}
+	cfg := &dockerclient.ContainerConfig{Image: image}
+	if _, err := c.policy.Apply(cfg); err != nil {
+		return "", err
+	}
+	return cfg.Image, nil
+}
+
+// apiPrepull queues a pull of the image on the requested nodes or on every
+// connected node.  Progress is returned by the prepull details.
+func (c *Controller) apiPrepull(w http.ResponseWriter, r *http.Request) {
+	req := &common.Prepull{}
+	if err := json.NewDecoder(r.Body).Decode(req); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if req.Image == "" {
+		http.Error(w, "image is required", http.StatusBadRequest)
+		return
+	}
+	image, err := c.applyImagePolicy(req.Image)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusForbidden)
+		return
+	}
+	p, err := c.startPrepull(image, req.Nodes, r.Header.Get(common.RegistryAuthHeader))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	w.Header().Set("content-type", "application/json")
+	w.WriteHeader(http.StatusAccepted)
+	if err := json.NewEncoder(w).Encode(p); err != nil {
+		log.Warnf("error encoding prepull: %s", err)
+	}
+}
+
+func (c *Controller) apiPrepullList(w http.ResponseWriter, r *http.Request) {
+	c.writePrepull(w, c.getPrepulls())
+}
+
+func (c *Controller) apiPrepullDetails(w http.ResponseWriter, r *http.Request) {
+	p, err := c.getPrepull(mux.Vars(r)["id"])
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	}
+	c.writePrepull(w, p)
+}
+
+// Docker API compatibility
+
+// apiCreateImage pulls the image on every connected node or on the nodes
+// given with node= and streams the progress of each node.
+func (c *Controller) apiCreateImage(w http.ResponseWriter, r *http.Request) {
+	q := r.URL.Query()
+	image := q.Get("fromImage")
+	if image == "" {
+		http.Error(w, "fromImage is required", http.StatusBadRequest)
+		return
+	}
+	if tag := q.Get("tag"); tag != "" {
+		if strings.HasPrefix(tag, "sha256:") {
+			image = fmt.Sprintf("%s@%s", image, tag)
+		} else {
+			image = fmt.Sprintf("%s:%s", image, tag)
+		}
+	}
+	nodes := []string{}
+	for _, n := range q["node"] {
+		nodes = append(nodes, strings.Split(n, ",")...)
+	}
+
+	image, err := c.applyImagePolicy(image)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusForbidden)
+		return
+	}
+	p, err := c.startPrepull(image, nodes, r.Header.Get(common.RegistryAuthHeader))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	w.Header().Set("content-type", "application/json")
+	enc := json.NewEncoder(w)
+	flusher, _ := w.(http.Flusher)
+	send := func(msg *common.PullProgress) {
+		if err := enc.Encode(msg); err != nil {
+			log.Warnf("error encoding pull progress: %s", err)
+		}
+		if flusher != nil {
+			flusher.Flush()
+		}
+	}
+
+	send(&common.PullProgress{Status: fmt.Sprintf("Pulling %s on %d nodes", p.Image, p.Total)})
+	for _, n := range p.NodeStatus {
+		send(&common.PullProgress{Id: n.NodeId, Status: "Pulling"})
+	}
+
+	var closed <-chan bool
+	if cn, ok := w.(http.CloseNotifier); ok {
+		closed = cn.CloseNotify()
+	}
+	ticker := time.NewTicker(pullProgressInterval)
+	defer ticker.Stop()
+	reported := map[string]bool{}
+	// the last message sent for each layer of each node
+	sent := map[string]string{}
+	for {
+		select {
+		case <-closed:
+			return
+		case <-ticker.C:
+		}
+		current, err := c.getPrepull(p.Id)
+		if err != nil {
+			send(&common.PullProgress{Error: err.Error(), ErrorDetail: &common.ErrorDetail{Message: err.Error()}})
+			return
+		}
+		for _, n := range current.NodeStatus {
+			for _, msg := range c.getProgress(n.JobId) {
+				// errors are reported once per node below
+				if msg.Error != "" {
+					continue
+				}
+				m := *msg
+				m.Id = n.NodeId
+				if msg.Id != "" {
+					m.Id = fmt.Sprintf("%s %s", n.NodeId, msg.Id)
+				}
+				key := m.Id
+				if msg.Id == "" {
+					key = fmt.Sprintf("%s %s", n.NodeId, msg.Status)
+				}
+				line := m.Status + m.Progress
+				if sent[key] == line {
+					continue
+				}
+				sent[key] = line
+				send(&m)
+			}
+			if n.State == common.PullStatePending || reported[n.NodeId] {
+				continue
+			}
+			reported[n.NodeId] = true
+			status := "Pull complete"
+			if n.State == common.PullStateFailed {
+				status = fmt.Sprintf("Pull failed: %s", n.Error)
+			}
+			send(&common.PullProgress{Id: n.NodeId, Status: status})
+		}
+		if current.CompletedAt.IsZero() {
+			continue
+		}
+		if current.Failed > 0 {
+			msg := fmt.Sprintf("pull of %s failed on %d of %d nodes", current.Image, current.Failed, current.Total)
+			send(&common.PullProgress{Error: msg, ErrorDetail: &common.ErrorDetail{Message: msg}})
+			return
+		}
+		send(&common.PullProgress{Status: fmt.Sprintf("Pulled %s on %d nodes", current.Image, current.Total)})
+		return
+	}
+}
+
+// apiListImages lists the images of the connected nodes.  An image on
+// several nodes is listed once for each node.
+func (c *Controller) apiListImages(w http.ResponseWriter, r *http.Request) {
+	images := []*common.NodeImage{}
+	for _, nodeData := range c.nodes() {
+		if nodeData.State == common.NodeStateDown {
+			continue
+		}
+		for _, img := range nodeData.Images {
+			images = append(images, &common.NodeImage{
+				Image: *img,
+				Node:  nodeData.NodeId,
+			})
+		}
+	}
+	w.Header().Set("content-type", "application/json")
+	if err := json.NewEncoder(w).Encode(images); err != nil {
+		log.Warnf("error encoding image response: %s", err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+	}
+}
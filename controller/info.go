@@ -0,0 +1,155 @@
+package controller
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"runtime"
+	"sort"
+
+	log "github.com/Sirupsen/logrus"
+	"github.com/ehazlett/docker-grid/common"
+)
+
+const (
+	// DockerAPIVersion is the Docker remote API version the controller
+	// implements
+	DockerAPIVersion = "1.24"
+	// cpuShares is the CpuShares of one cpu
+	cpuShares = 1024
+)
+
+func jobCpus(job *common.Job) float64 {
+	configs := []*common.GroupMember{{ContainerConfig: job.ContainerConfig}}
+	if job.Group != nil {
+		configs = job.Group.Members
+	}
+	cpus := 0.0
+	for _, m := range configs {
+		if m.ContainerConfig != nil {
+			cpus += float64(m.ContainerConfig.CpuShares) / cpuShares
+		}
+	}
+	return cpus
+}
+
+// bytesSize formats a size in bytes like the Docker client.
+func bytesSize(size int64) string {
+	units := []string{"B", "KiB", "MiB", "GiB", "TiB"}
+	s := float64(size)
+	i := 0
+	for s >= 1024 && i < len(units)-1 {
+		s /= 1024
+		i++
+	}
+	return fmt.Sprintf("%.4g %s", s, units[i])
+}
+
+// nodeReserved returns the cpus and memory requested by the grid
+// containers on the node.
+func (c *Controller) nodeReserved(nd *common.NodeData) (float64, int64) {
+	cpus, memory := 0.0, int64(0)
+	for _, owner := range c.nodeContainers(nd) {
+		if owner.Primary == "" {
+			cpus += jobCpus(owner.Job)
+			memory += jobMemory(owner.Job)
+		}
+	}
+	return cpus, memory
+}
+
+// info aggregates the connected nodes.  The resources used are those
+// requested by the grid containers on each node.
+func (c *Controller) info() *common.Info {
+	info := &common.Info{
+		ID:              "grid",
+		Driver:          "grid",
+		OperatingSystem: "docker grid",
+		ServerVersion:   fmt.Sprintf("grid/%s", VERSION),
+		Debug:           log.GetLevel() == log.DebugLevel,
+		Labels:          []string{},
+	}
+	if name, err := os.Hostname(); err == nil {
+		info.Name = name
+	}
+
+	nodes := []*common.NodeData{}
+	for _, nd := range c.nodes() {
+		if nd.State != common.NodeStateDown {
+			nodes = append(nodes, nd)
+		}
+	}
+	sort.Sort(common.NodesById{Nodes: nodes})
+
+	images := map[string]bool{}
+	cpus := 0.0
+	status := [][2]string{{"Nodes", fmt.Sprintf("%d", len(nodes))}}
+	for _, nd := range nodes {
+		usedCpus, usedMemory := c.nodeReserved(nd)
+		memory := int64(nd.Memory * 1024 * 1024)
+		cpus += nd.Cpus
+		info.MemTotal += memory
+		info.ContainersRunning += len(nd.Containers)
+		for _, img := range nd.Images {
+			images[img.Id] = true
+		}
+
+		status = append(status,
+			[2]string{" " + nd.NodeId, nd.IP},
+			[2]string{"  └ State", nd.State},
+			[2]string{"  └ Containers", fmt.Sprintf("%d", len(nd.Containers))},
+			[2]string{"  └ Reserved CPUs", fmt.Sprintf("%.2f / %.2f", usedCpus, nd.Cpus)},
+			[2]string{"  └ Reserved Memory", fmt.Sprintf("%s / %s", bytesSize(usedMemory), bytesSize(memory))},
+			[2]string{"  └ Version", nd.Version},
+		)
+	}
+
+	// exited grid containers are kept until they are removed
+	live := map[string]bool{}
+	for _, nd := range nodes {
+		live[nd.NodeId] = true
+	}
+	c.mutex.RLock()
+	for _, owner := range c.owners {
+		if owner.Exit != nil && live[owner.NodeId] {
+			info.ContainersStopped++
+		}
+	}
+	c.mutex.RUnlock()
+
+	info.Containers = info.ContainersRunning + info.ContainersStopped
+	info.Images = len(images)
+	info.NCPU = int(cpus)
+	info.NEventsListener = c.eventListenerCount()
+	info.DriverStatus = status
+	return info
+}
+
+func (c *Controller) apiInfo(w http.ResponseWriter, r *http.Request) {
+	info := c.info()
+	if requestVersion(r).LessThan(containerCountsVersion) {
+		info.ContainersRunning, info.ContainersStopped = 0, 0
+	}
+	w.Header().Set("content-type", "application/json")
+	if err := json.NewEncoder(w).Encode(info); err != nil {
+		log.Warnf("error encoding info: %s", err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+	}
+}
+
+func (c *Controller) apiVersion(w http.ResponseWriter, r *http.Request) {
+	v := &common.Version{
+		Version:     fmt.Sprintf("grid/%s", VERSION),
+		ApiVersion:  DockerAPIVersion,
+		GoVersion:   runtime.Version(),
+		Os:          runtime.GOOS,
+		Arch:        runtime.GOARCH,
+		GridVersion: VERSION,
+	}
+	w.Header().Set("content-type", "application/json")
+	if err := json.NewEncoder(w).Encode(v); err != nil {
+		log.Warnf("error encoding version: %s", err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+	}
+}
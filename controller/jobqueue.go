@@ -0,0 +1,65 @@
+package controller
+
+import (
+	"math"
+	"sort"
+
+	"github.com/ehazlett/docker-grid/common"
+)
+
+type (
+	// jobQueue orders jobs by priority and then by the order they were
+	// added.  Jobs for existing containers (stop, remove) come first.
+	jobQueue struct {
+		jobs []*queuedJob
+	}
+
+	queuedJob struct {
+		job      *common.Job
+		priority int
+	}
+)
+
+func newJobQueue() *jobQueue {
+	return &jobQueue{}
+}
+
+func queuePriority(job *common.Job) int {
+	if !job.IsCreate() {
+		return math.MaxInt32
+	}
+	return job.Priority
+}
+
+func (q *jobQueue) Len() int {
+	return len(q.jobs)
+}
+
+// Add inserts the job after the queued jobs of the same or higher
+// priority.
+func (q *jobQueue) Add(job *common.Job) {
+	qj := &queuedJob{
+		job:      job,
+		priority: queuePriority(job),
+	}
+	i := sort.Search(len(q.jobs), func(i int) bool {
+		return q.jobs[i].priority < qj.priority
+	})
+	q.jobs = append(q.jobs, nil)
+	copy(q.jobs[i+1:], q.jobs[i:])
+	q.jobs[i] = qj
+}
+
+// Jobs returns the queued jobs in order.
+func (q *jobQueue) Jobs() []*common.Job {
+	jobs := make([]*common.Job, len(q.jobs))
+	for i, qj := range q.jobs {
+		jobs[i] = qj.job
+	}
+	return jobs
+}
+
+// Remove removes the job at the position returned by Jobs.
+func (q *jobQueue) Remove(i int) {
+	q.jobs = append(q.jobs[:i], q.jobs[i+1:]...)
+}
@@ -0,0 +1,100 @@
+package controller
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/ehazlett/docker-grid/common"
+)
+
+func TestJobQueueOrder(t *testing.T) {
+	tests := []struct {
+		name     string
+		jobs     []*common.Job
+		expected []string
+	}{
+		{
+			name: "same priority keeps the order added",
+			jobs: []*common.Job{
+				{Id: "a"},
+				{Id: "b"},
+				{Id: "c"},
+			},
+			expected: []string{"a", "b", "c"},
+		},
+		{
+			name: "higher priority first",
+			jobs: []*common.Job{
+				{Id: "low", Priority: 1},
+				{Id: "high", Priority: 10},
+				{Id: "none"},
+				{Id: "mid", Priority: 5},
+			},
+			expected: []string{"high", "mid", "low", "none"},
+		},
+		{
+			name: "negative priority last",
+			jobs: []*common.Job{
+				{Id: "negative", Priority: -1},
+				{Id: "none"},
+			},
+			expected: []string{"none", "negative"},
+		},
+		{
+			name: "jobs for existing containers first",
+			jobs: []*common.Job{
+				{Id: "create", Priority: 100},
+				{Id: "stop", Action: common.JobActionStop},
+				{Id: "explicit", Action: common.JobActionCreate, Priority: 50},
+				{Id: "remove", Action: common.JobActionRemove, Priority: -5},
+			},
+			expected: []string{"stop", "remove", "create", "explicit"},
+		},
+		{
+			name: "equal priorities after higher ones",
+			jobs: []*common.Job{
+				{Id: "a", Priority: 5},
+				{Id: "b", Priority: 1},
+				{Id: "c", Priority: 5},
+				{Id: "d", Priority: 1},
+			},
+			expected: []string{"a", "c", "b", "d"},
+		},
+	}
+	for _, test := range tests {
+		q := newJobQueue()
+		for _, job := range test.jobs {
+			q.Add(job)
+		}
+		if q.Len() != len(test.jobs) {
+			t.Fatalf("%s: expected %d jobs; received %d", test.name, len(test.jobs), q.Len())
+		}
+		ids := []string{}
+		for _, job := range q.Jobs() {
+			ids = append(ids, job.Id)
+		}
+		if !reflect.DeepEqual(ids, test.expected) {
+			t.Fatalf("%s: expected %v; received %v", test.name, test.expected, ids)
+		}
+	}
+}
+
+func TestJobQueueRemove(t *testing.T) {
+	q := newJobQueue()
+	q.Add(&common.Job{Id: "a", Priority: 1})
+	q.Add(&common.Job{Id: "b", Priority: 2})
+	q.Add(&common.Job{Id: "c", Priority: 3})
+
+	// removes the position returned by Jobs
+	q.Remove(1)
+	jobs := q.Jobs()
+	if len(jobs) != 2 || jobs[0].Id != "c" || jobs[1].Id != "a" {
+		t.Fatalf("expected [c a]; received %v", jobs)
+	}
+
+	q.Add(&common.Job{Id: "d", Priority: 2})
+	jobs = q.Jobs()
+	if len(jobs) != 3 || jobs[1].Id != "d" {
+		t.Fatalf("expected d after c; received %v", jobs)
+	}
+}
@@ -0,0 +1,305 @@
+package controller
+
+import (
+	"fmt"
+	"time"
+
+	"code.google.com/p/go-uuid/uuid"
+	log "github.com/Sirupsen/logrus"
+	"github.com/ehazlett/docker-grid/common"
+	"github.com/ehazlett/docker-grid/utils/datastore"
+	"github.com/samalba/dockerclient"
+)
+
+const (
+	containerStatusUnknown = "Unknown (node down)"
+	pruneInterval          = time.Minute
+)
+
+type (
+	// NodeHealth sets the heartbeat thresholds for node states.
+	NodeHealth struct {
+		// HealthyAfter is the number of heartbeats before a new or
+		// recovered node is healthy
+		HealthyAfter int
+		// UnhealthyAfter is the number of missed heartbeats before a
+		// node is unhealthy
+		UnhealthyAfter int
+		// DownAfter is the number of missed heartbeats before a node is
+		// down.  When zero the controller ttl is used.
+		DownAfter int
+		// DownRetention is how long a down node is kept before it is
+		// forgotten.  Zero keeps down nodes.
+		DownRetention time.Duration
+	}
+
+	nodeStatus struct {
+		interval      time.Duration
+		lastHeartbeat time.Time
+		heartbeats    int
+	}
+)
+
+func (s *nodeStatus) missed(now time.Time) int {
+	if s.interval <= 0 {
+		return 0
+	}
+	return int(now.Sub(s.lastHeartbeat) / s.interval)
+}
+
+func (s *nodeStatus) state(now time.Time, health NodeHealth) string {
+	switch {
+	case health.UnhealthyAfter > 0 && s.missed(now) >= health.UnhealthyAfter:
+		return common.NodeStateUnhealthy
+	case s.heartbeats < health.HealthyAfter:
+		return common.NodeStatePending
+	}
+	return common.NodeStateHealthy
+}
+
+// heartbeat updates the node data and state.  The node expires (is down)
+// after missing the configured number of heartbeats.
+func (c *Controller) heartbeat(data *common.NodeData) {
+	now := time.Now()
+	ttl := time.Millisecond * time.Duration(c.TTL)
+	interval := time.Millisecond * time.Duration(data.HeartbeatInterval)
+	if interval <= 0 {
+		interval = ttl
+	}
+	if c.health.DownAfter > 0 {
+		ttl = interval * time.Duration(c.health.DownAfter)
+	}
+
+	data.LastHeartbeat = now
+	c.datastore.SetWithTTL(data.NodeId, data, ttl)
+
+	c.mutex.Lock()
+	status, ok := c.nodeStatus[data.NodeId]
+	if !ok {
+		status = &nodeStatus{}
+		c.nodeStatus[data.NodeId] = status
+	}
+	joined := !ok
+	// a recovering node must be healthy again for a while
+	if status.state(now, c.health) == common.NodeStateUnhealthy {
+		log.Infof("node recovering: id=%s missed=%d", data.NodeId, status.missed(now))
+		status.heartbeats = 0
+	}
+	status.interval = interval
+	status.lastHeartbeat = now
+	status.heartbeats++
+	c.mutex.Unlock()
+
+	if joined {
+		c.gridEvent(common.EventTypeNode, common.EventNodeJoin, data.NodeId, map[string]string{"node": data.NodeId, "ip": data.IP})
+	}
+	c.nodeUp(data.NodeId)
+}
+
+// nodeState returns the current state of a connected node.  Cordoned and
+// draining nodes report that state regardless of their health.
+func (c *Controller) nodeState(nodeId string) string {
+	c.mutex.RLock()
+	defer c.mutex.RUnlock()
+	status, ok := c.nodeStatus[nodeId]
+	if !ok {
+		return common.NodeStateDown
+	}
+	if cordon, ok := c.cordons[nodeId]; ok {
+		if cordon.Drain {
+			return common.NodeStateDraining
+		}
+		return common.NodeStateCordoned
+	}
+	return status.state(time.Now(), c.health)
+}
+
+// schedulable reports whether the node can receive new jobs.
+func (c *Controller) schedulable(nodeId string) bool {
+	return c.nodeState(nodeId) == common.NodeStateHealthy
+}
+
+// nodes returns the connected nodes and the nodes that have gone down.
+func (c *Controller) nodes() []*common.NodeData {
+	var nodes []*common.NodeData
+	for _, v := range c.datastore.Items() {
+		nd := v.Data.(*common.NodeData)
+		n := *nd
+		n.State = c.nodeState(nd.NodeId)
+		n.ProxyToken, n.ProxyCert = "", ""
+		nodes = append(nodes, &n)
+	}
+
+	c.mutex.RLock()
+	for _, n := range nodes {
+		if cordon, ok := c.cordons[n.NodeId]; ok {
+			n.Drain = cordon.status()
+		}
+	}
+	for _, nd := range c.downNodes {
+		n := *nd
+		n.ProxyToken, n.ProxyCert = "", ""
+		nodes = append(nodes, &n)
+	}
+	c.mutex.RUnlock()
+
+	return nodes
+}
+
+// watchNodes handles nodes that stop sending heartbeats.
+func (c *Controller) watchNodes() {
+	c.datastore.OnExpire(func(evt *datastore.Event) {
+		c.nodeDown(evt.Item.Data.(*common.NodeData))
+	})
+}
+
+// nodeDown keeps the last known containers of the node visible with an
+// unknown state and reschedules or restarts the containers that request
+// it.
+func (c *Controller) nodeDown(data *common.NodeData) {
+	log.Warnf("node down: id=%s ip=%s containers=%d", data.NodeId, data.IP, len(data.Containers))
+
+	down := *data
+	down.State = common.NodeStateDown
+	down.Containers = []*dockerclient.Container{}
+	for _, cnt := range data.Containers {
+		cnt := *cnt
+		cnt.Status = containerStatusUnknown
+		down.Containers = append(down.Containers, &cnt)
+	}
+
+	c.mutex.Lock()
+	c.downNodes[data.NodeId] = &down
+	delete(c.nodeStatus, data.NodeId)
+	c.mutex.Unlock()
+	c.preemptionsLost(data.NodeId)
+	c.nodePullsLost(data.NodeId)
+	c.nodeExecsLost(data.NodeId)
+	c.gridEvent(common.EventTypeNode, common.EventNodeExpire, data.NodeId, map[string]string{"node": data.NodeId, "ip": data.IP})
+
+	for _, cnt := range data.Containers {
+		owner := c.findOwner(cnt.Id)
+		if owner == nil || owner.Job == nil || owner.Primary != "" {
+			continue
+		}
+		reason := fmt.Sprintf("node %s down", data.NodeId)
+		switch {
+		case owner.Job.Batch != "" && owner.Exit == nil:
+			c.batchTaskExited(owner, -1, "", true)
+		case owner.Job.Cron != "" && owner.Exit == nil:
+			c.cronRunExited(owner, -1, true)
+		case common.EnvValue(owner.Job.ContainerConfig, common.RescheduleEnv) == "true":
+			c.reschedule(owner, reason)
+		case owner.Exit == nil && owner.Job.Service == "" && owner.Job.RestartPolicy.ShouldRestart(-1, owner.Job.Restarts):
+			c.restart(owner, reason, true)
+		}
+	}
+}
+
+// pruneNodes forgets the nodes that have been down longer than the
+// retention.  Nodes get a new id when they restart so a down node does not
+// come back.
+func (c *Controller) pruneNodes() {
+	ticker := time.NewTicker(pruneInterval)
+	for _ = range ticker.C {
+		if !c.isLeader() || c.health.DownRetention <= 0 {
+			continue
+		}
+		c.forgetNodes(time.Now())
+	}
+}
+
+// forgetNodes removes the down nodes with their registration, cordon and
+// containers.  Nodes registered before the state was restored that have
+// not come back are forgotten once the retention has passed since.
+func (c *Controller) forgetNodes(now time.Time) {
+	retention := c.health.DownRetention
+	connected := c.datastore.Items()
+
+	c.mutex.Lock()
+	forget := []string{}
+	for nodeId, nd := range c.downNodes {
+		if now.Sub(nd.LastHeartbeat) > retention {
+			forget = append(forget, nodeId)
+		}
+	}
+	if now.Sub(c.restored) > retention {
+		for nodeId := range c.registrations {
+			_, ok := connected[nodeId]
+			_, down := c.downNodes[nodeId]
+			if !ok && !down {
+				forget = append(forget, nodeId)
+			}
+		}
+	}
+	owners := []*containerOwner{}
+	for _, nodeId := range forget {
+		delete(c.downNodes, nodeId)
+		delete(c.registrations, nodeId)
+		delete(c.nodeStatus, nodeId)
+		delete(c.cordons, nodeId)
+		for id, owner := range c.owners {
+			if owner.NodeId == nodeId {
+				delete(c.owners, id)
+				delete(c.registryAuth, id)
+				owners = append(owners, owner)
+			}
+		}
+	}
+	c.mutex.Unlock()
+
+	for _, nodeId := range forget {
+		log.Infof("forgetting node: id=%s", nodeId)
+		if err := c.store.Delete(nodesBucket, nodeId); err != nil {
+			log.Warnf("error removing node %s: %s", nodeId, err)
+		}
+		if err := c.store.Delete(cordonsBucket, nodeId); err != nil {
+			log.Warnf("error removing cordon %s: %s", nodeId, err)
+		}
+	}
+	for _, owner := range owners {
+		c.execsRemoved(owner.ContainerId)
+		if err := c.store.Delete(containersBucket, owner.ContainerId); err != nil {
+			log.Warnf("error removing container owner %s: %s", owner.ContainerId, err)
+		}
+		if owner.Primary == "" {
+			if err := c.store.Delete(resultsBucket, owner.JobId); err != nil {
+				log.Warnf("error removing job result %s: %s", owner.JobId, err)
+			}
+		}
+	}
+}
+
+// nodeUp removes the node from the down nodes once it sends a heartbeat.
+func (c *Controller) nodeUp(nodeId string) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	if _, ok := c.downNodes[nodeId]; ok {
+		log.Infof("node up: id=%s", nodeId)
+		delete(c.downNodes, nodeId)
+	}
+}
+
+// reschedule queues a copy of the job that created the container so it
+// runs on another node.  Service containers are replaced by the service
+// reconciler instead and groups are rescheduled with their first member.
+func (c *Controller) reschedule(owner *containerOwner, reason string) {
+	if owner.Job.Service != "" || owner.Primary != "" {
+		return
+	}
+	job := &common.Job{
+		Id:              uuid.New(),
+		Date:            time.Now(),
+		ContainerName:   owner.Job.ContainerName,
+		ContainerConfig: owner.Job.ContainerConfig,
+		RestartPolicy:   owner.Job.RestartPolicy,
+		Restarts:        owner.Job.Restarts,
+		Group:           owner.Job.Group,
+		RegistryAuth:    c.containerAuth(owner.ContainerId),
+		Rejections: map[string]string{
+			owner.NodeId: reason,
+		},
+	}
+	log.Infof("rescheduling container: id=%s job=%s reason=%s", owner.ContainerId, job.Id, reason)
+	c.enqueue(job)
+}
@@ -0,0 +1,230 @@
+package controller
+
+import (
+	"sort"
+	"time"
+
+	"code.google.com/p/go-uuid/uuid"
+	log "github.com/Sirupsen/logrus"
+	"github.com/ehazlett/docker-grid/common"
+)
+
+const (
+	preemptInterval = time.Second * 5
+	// preemptAfter is how long a job waits for room before it preempts
+	preemptAfter = time.Second * 10
+	// unlimited is the free memory of a node without a memory limit
+	unlimited = int64(-1)
+)
+
+type (
+	// ownersByPriority orders containers by priority and then newest
+	// first so the least important and least invested are preempted
+	// first
+	ownersByPriority []*containerOwner
+)
+
+func (o ownersByPriority) Len() int      { return len(o) }
+func (o ownersByPriority) Swap(a, b int) { o[a], o[b] = o[b], o[a] }
+func (o ownersByPriority) Less(a, b int) bool {
+	if o[a].Job.Priority != o[b].Job.Priority {
+		return o[a].Job.Priority < o[b].Job.Priority
+	}
+	return o[a].Date.After(o[b].Date)
+}
+
+// nodeContainers returns the owners of the grid containers running on the
+// node.
+func (c *Controller) nodeContainers(nodeData *common.NodeData) []*containerOwner {
+	running := map[string]bool{}
+	for _, cnt := range nodeData.Containers {
+		running[cnt.Id] = true
+	}
+	c.mutex.RLock()
+	defer c.mutex.RUnlock()
+	owners := []*containerOwner{}
+	for _, owner := range c.owners {
+		if owner.NodeId != nodeData.NodeId || owner.Job == nil || owner.Exit != nil {
+			continue
+		}
+		if running[owner.ContainerId] || owner.Date.After(nodeData.LastHeartbeat) {
+			owners = append(owners, owner)
+		}
+	}
+	return owners
+}
+
+// nodeFree returns the memory in bytes not used by grid containers on the
+// node.  Node memory is set in MB.
+func (c *Controller) nodeFree(nodeId string) int64 {
+	item, err := c.datastore.Get(nodeId)
+	if err != nil {
+		return 0
+	}
+	nodeData := item.Data.(*common.NodeData)
+	if nodeData.Memory <= 0 {
+		return unlimited
+	}
+	free := int64(nodeData.Memory * 1024 * 1024)
+	for _, owner := range c.nodeContainers(nodeData) {
+		// the memory of a group is counted with its first member
+		if owner.Primary == "" {
+			free -= jobMemory(owner.Job)
+		}
+	}
+	return free
+}
+
+func jobMemory(job *common.Job) int64 {
+	if job.Group != nil {
+		memory := int64(0)
+		for _, m := range job.Group.Members {
+			memory += m.ContainerConfig.Memory
+		}
+		return memory
+	}
+	if job.ContainerConfig == nil {
+		return 0
+	}
+	return job.ContainerConfig.Memory
+}
+
+func fits(job *common.Job, free int64) bool {
+	return free == unlimited || jobMemory(job) <= free
+}
+
+// preemptJobs runs on the leader and makes room for high priority jobs
+// that have waited for a node.
+func (c *Controller) preemptJobs() {
+	ticker := time.NewTicker(preemptInterval)
+	for now := range ticker.C {
+		if !c.isLeader() {
+			continue
+		}
+		c.mutex.RLock()
+		inFlight := len(c.preempting)
+		c.mutex.RUnlock()
+		// wait for the last preemption to free its room
+		if inFlight > 0 {
+			continue
+		}
+
+		c.queueLock.Lock()
+		jobs := c.queue.Jobs()
+		c.queueLock.Unlock()
+		for _, job := range jobs {
+			if !job.IsCreate() || jobMemory(job) == 0 || now.Sub(job.Date) < preemptAfter {
+				continue
+			}
+			if c.preempt(job, now) {
+				break
+			}
+		}
+	}
+}
+
+// preemptionVictims returns the containers to remove from a node with
+// free memory so the job fits.  It reports false when removing every lower
+// priority container is not enough.
+func preemptionVictims(job *common.Job, containers []*containerOwner, free int64) ([]*containerOwner, bool) {
+	owners := []*containerOwner{}
+	for _, owner := range containers {
+		// batch and cron containers run to completion
+		if owner.Job.Priority < job.Priority && owner.Job.Batch == "" && owner.Job.Cron == "" && owner.Primary == "" {
+			owners = append(owners, owner)
+		}
+	}
+	sort.Sort(ownersByPriority(owners))
+
+	victims := []*containerOwner{}
+	for _, owner := range owners {
+		if fits(job, free) {
+			break
+		}
+		victims = append(victims, owner)
+		free += jobMemory(owner.Job)
+	}
+	return victims, fits(job, free)
+}
+
+// preempt removes lower priority containers from a node so the job fits.
+// It reports whether containers were preempted.
+func (c *Controller) preempt(job *common.Job, now time.Time) bool {
+	type candidate struct {
+		nodeId  string
+		victims []*containerOwner
+	}
+	var best *candidate
+
+	counts := c.serviceNodeCounts()
+	for nodeId, item := range c.datastore.Items() {
+		nodeData := item.Data.(*common.NodeData)
+		if !eligible(job, nodeId, c.schedulable(nodeId), now) || !placementAllows(job, nodeId, counts) {
+			continue
+		}
+		free := c.nodeFree(nodeId)
+		if fits(job, free) {
+			// the job will be placed without preemption
+			return false
+		}
+
+		victims, ok := preemptionVictims(job, c.nodeContainers(nodeData), free)
+		if !ok {
+			continue
+		}
+		if best == nil || len(victims) < len(best.victims) {
+			best = &candidate{
+				nodeId:  nodeId,
+				victims: victims,
+			}
+		}
+	}
+	if best == nil {
+		return false
+	}
+
+	log.Infof("preempting containers: job=%s priority=%d node=%s containers=%d", job.Id, job.Priority, best.nodeId, len(best.victims))
+	for _, owner := range best.victims {
+		c.mutex.Lock()
+		c.preempting[owner.ContainerId] = owner
+		c.mutex.Unlock()
+		log.Infof("preempting container: id=%s priority=%d", owner.ContainerId, owner.Job.Priority)
+		c.removeContainers(owner)
+	}
+	return true
+}
+
+// containerPreempted queues a preempted container again.  Service
+// containers are replaced by the service reconciler.
+func (c *Controller) containerPreempted(job *common.Job, result *common.JobResult) {
+	c.mutex.Lock()
+	owner, ok := c.preempting[job.ContainerId]
+	delete(c.preempting, job.ContainerId)
+	c.mutex.Unlock()
+	if !ok || result.Error != "" || owner.Job.Service != "" {
+		return
+	}
+	requeued := &common.Job{
+		Id:              uuid.New(),
+		Date:            time.Now(),
+		ContainerName:   owner.Job.ContainerName,
+		ContainerConfig: owner.Job.ContainerConfig,
+		RestartPolicy:   owner.Job.RestartPolicy,
+		Restarts:        owner.Job.Restarts,
+		Group:           owner.Job.Group,
+		RegistryAuth:    c.containerAuth(owner.ContainerId),
+	}
+	log.Infof("requeueing preempted container: id=%s job=%s", owner.ContainerId, requeued.Id)
+	c.enqueue(requeued)
+}
+
+// preemptionsLost forgets the preemptions on a node that went down.
+func (c *Controller) preemptionsLost(nodeId string) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	for id, owner := range c.preempting {
+		if owner.NodeId == nodeId {
+			delete(c.preempting, id)
+		}
+	}
+}
@@ -0,0 +1,227 @@
+package controller
+
+import (
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/ehazlett/docker-grid/common"
+	"github.com/ehazlett/docker-grid/utils/datastore"
+	"github.com/samalba/dockerclient"
+)
+
+const mb = int64(1024 * 1024)
+
+func memoryJob(memory int64) *common.Job {
+	return &common.Job{ContainerConfig: &dockerclient.ContainerConfig{Memory: memory}}
+}
+
+func TestFits(t *testing.T) {
+	group := &common.Job{
+		Group: &common.Group{
+			Members: []*common.GroupMember{
+				{Name: "app", ContainerConfig: &dockerclient.ContainerConfig{Memory: 64 * mb}},
+				{Name: "sidecar", ContainerConfig: &dockerclient.ContainerConfig{Memory: 32 * mb}},
+			},
+		},
+	}
+	tests := []struct {
+		name     string
+		job      *common.Job
+		free     int64
+		expected bool
+	}{
+		{name: "unlimited node", job: memoryJob(1024 * mb), free: unlimited, expected: true},
+		{name: "no memory limit", job: memoryJob(0), free: 0, expected: true},
+		{name: "no container config", job: &common.Job{Action: common.JobActionStop}, free: 0, expected: true},
+		{name: "exact fit", job: memoryJob(128 * mb), free: 128 * mb, expected: true},
+		{name: "too large", job: memoryJob(128*mb + 1), free: 128 * mb},
+		{name: "overcommitted node", job: memoryJob(mb), free: -64 * mb},
+		{name: "group counts every member", job: group, free: 96 * mb, expected: true},
+		{name: "group too large", job: group, free: 64 * mb},
+	}
+	for _, test := range tests {
+		if fits(test.job, test.free) != test.expected {
+			t.Fatalf("%s: expected fits %v for free=%d", test.name, test.expected, test.free)
+		}
+	}
+}
+
+func TestNodeFree(t *testing.T) {
+	ds, err := datastore.New(time.Minute)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ds.Close()
+
+	heartbeat := time.Now().Add(-time.Second)
+	ds.Set("node-0", &common.NodeData{
+		NodeId:        "node-0",
+		Memory:        1024,
+		LastHeartbeat: heartbeat,
+		Containers: []*dockerclient.Container{
+			{Id: "running"},
+			{Id: "exited"},
+			{Id: "primary"},
+			{Id: "member"},
+		},
+	})
+	ds.Set("node-1", &common.NodeData{NodeId: "node-1", LastHeartbeat: heartbeat})
+
+	owned := func(nodeId string, memory int64, date time.Time) *containerOwner {
+		return &containerOwner{NodeId: nodeId, Job: memoryJob(memory), Date: date}
+	}
+	old := heartbeat.Add(-time.Minute)
+	c := &Controller{
+		datastore: ds,
+		owners: map[string]*containerOwner{
+			"running": owned("node-0", 256*mb, old),
+			// created since the last heartbeat
+			"new": owned("node-0", 128*mb, time.Now()),
+			// removed from the node
+			"gone": owned("node-0", 512*mb, old),
+			"exited": {
+				NodeId: "node-0",
+				Job:    memoryJob(512 * mb),
+				Date:   old,
+				Exit:   &common.ContainerExit{},
+			},
+			"primary": {
+				NodeId: "node-0",
+				Job: &common.Job{
+					Group: &common.Group{
+						Members: []*common.GroupMember{
+							{Name: "a", ContainerConfig: &dockerclient.ContainerConfig{Memory: 64 * mb}},
+							{Name: "b", ContainerConfig: &dockerclient.ContainerConfig{Memory: 32 * mb}},
+						},
+					},
+				},
+				Date: old,
+			},
+			"member":  {NodeId: "node-0", Job: memoryJob(32 * mb), Date: old, Primary: "primary"},
+			"other":   owned("node-1", 512*mb, old),
+			"unowned": {NodeId: "node-0", Date: old},
+		},
+	}
+	for key, owner := range c.owners {
+		owner.ContainerId = key
+	}
+
+	for _, cnt := range c.nodeContainers(ds.Items()["node-0"].Data.(*common.NodeData)) {
+		if cnt.ContainerId == "gone" || cnt.ContainerId == "exited" || cnt.ContainerId == "unowned" {
+			t.Fatalf("unexpected container %s", cnt.ContainerId)
+		}
+	}
+
+	tests := []struct {
+		nodeId   string
+		expected int64
+	}{
+		// 1024 - 256 (running) - 128 (new) - 96 (group)
+		{nodeId: "node-0", expected: 544 * mb},
+		{nodeId: "node-1", expected: unlimited},
+		{nodeId: "node-2", expected: 0},
+	}
+	for _, test := range tests {
+		if free := c.nodeFree(test.nodeId); free != test.expected {
+			t.Fatalf("%s: expected free %d; received %d", test.nodeId, test.expected, free)
+		}
+	}
+}
+
+func TestPreemptionVictims(t *testing.T) {
+	now := time.Now()
+	owner := func(id string, priority int, memory int64, age time.Duration) *containerOwner {
+		job := memoryJob(memory)
+		job.Priority = priority
+		return &containerOwner{ContainerId: id, Job: job, Date: now.Add(-age)}
+	}
+	batch := owner("batch", 0, 512*mb, time.Hour)
+	batch.Job.Batch = "reports"
+	cron := owner("cron", 0, 512*mb, time.Hour)
+	cron.Job.Cron = "backup"
+	member := owner("member", 0, 512*mb, time.Hour)
+	member.Primary = "primary"
+
+	job := memoryJob(256 * mb)
+	job.Priority = 10
+
+	tests := []struct {
+		name       string
+		containers []*containerOwner
+		free       int64
+		victims    []string
+		fits       bool
+	}{
+		{
+			name:       "fits without preemption",
+			containers: []*containerOwner{owner("a", 0, 256*mb, time.Hour)},
+			free:       256 * mb,
+			victims:    []string{},
+			fits:       true,
+		},
+		{
+			name: "lowest priority first",
+			containers: []*containerOwner{
+				owner("normal", 5, 256*mb, time.Hour),
+				owner("low", 0, 256*mb, time.Hour),
+			},
+			victims: []string{"low"},
+			fits:    true,
+		},
+		{
+			name: "newest first within a priority",
+			containers: []*containerOwner{
+				owner("old", 0, 256*mb, time.Hour),
+				owner("new", 0, 256*mb, time.Minute),
+			},
+			victims: []string{"new"},
+			fits:    true,
+		},
+		{
+			name: "as many as needed",
+			containers: []*containerOwner{
+				owner("a", 0, 64*mb, time.Hour),
+				owner("b", 1, 64*mb, time.Hour),
+				owner("c", 2, 64*mb, time.Hour),
+			},
+			free:    64 * mb,
+			victims: []string{"a", "b", "c"},
+			fits:    true,
+		},
+		{
+			name: "same or higher priority is kept",
+			containers: []*containerOwner{
+				owner("same", 10, 512*mb, time.Hour),
+				owner("higher", 20, 512*mb, time.Hour),
+			},
+			victims: []string{},
+		},
+		{
+			name: "not enough lower priority memory",
+			containers: []*containerOwner{
+				owner("low", 0, 64*mb, time.Hour),
+				owner("high", 20, 512*mb, time.Hour),
+			},
+			victims: []string{"low"},
+		},
+		{
+			name:       "batch, cron and group members run to completion",
+			containers: []*containerOwner{batch, cron, member},
+			victims:    []string{},
+		},
+	}
+	for _, test := range tests {
+		victims, ok := preemptionVictims(job, test.containers, test.free)
+		ids := []string{}
+		for _, v := range victims {
+			ids = append(ids, v.ContainerId)
+		}
+		if ok != test.fits {
+			t.Fatalf("%s: expected fits %v; received %v", test.name, test.fits, ok)
+		}
+		if !reflect.DeepEqual(ids, test.victims) {
+			t.Fatalf("%s: expected victims %v; received %v", test.name, test.victims, ids)
+		}
+	}
+}
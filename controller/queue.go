@@ -0,0 +1,234 @@
+package controller
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sort"
+	"strings"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+	"github.com/ehazlett/docker-grid/common"
+	"github.com/ehazlett/docker-grid/utils/datastore"
+)
+
+const (
+	// rejectionRetry is the delay before a job rejected temporarily by
+	// every node is sent to the nodes again
+	rejectionRetry = 30 * time.Second
+	// resultTimeout is how long a create request waits for the job
+	resultTimeout = 10 * time.Minute
+)
+
+// enqueue persists the job and adds it to the queue.  New containers get
+// the priority of their class and their pull policy.
+func (c *Controller) enqueue(job *common.Job) {
+	if job.IsCreate() && job.PriorityClass == "" {
+		class, priority, err := c.priorities.Priority(job.ContainerConfig)
+		if err != nil {
+			log.Warnf("job %s: %s", job.Id, err)
+		}
+		job.PriorityClass = class
+		job.Priority = priority
+	}
+	if job.IsCreate() && job.PullPolicy == "" {
+		policy, err := common.ParsePullPolicy(common.EnvValue(job.ContainerConfig, common.PullPolicyEnv))
+		if err != nil {
+			log.Warnf("job %s: %s", job.Id, err)
+			policy = common.PullIfNotPresent
+		}
+		job.PullPolicy = policy
+	}
+	c.saveJob(job)
+
+	c.queueLock.Lock()
+	c.queue.Add(job)
+	c.addServiceJob(job)
+	log.Debugf("pending jobs: %d", c.queue.Len())
+	c.queueLock.Unlock()
+	c.jobEvent(common.EventJobQueue, job, nil)
+}
+
+// waitResult waits for the result of the job until the client goes away
+// or resultTimeout.  The job stays queued either way.
+func (c *Controller) waitResult(w http.ResponseWriter, job *common.Job, results <-chan *datastore.Event) (*common.JobResult, error) {
+	var closed <-chan bool
+	if cn, ok := w.(http.CloseNotifier); ok {
+		closed = cn.CloseNotify()
+	}
+	timeout := time.NewTimer(resultTimeout)
+	defer timeout.Stop()
+	for {
+		select {
+		case evt, ok := <-results:
+			if !ok {
+				return nil, fmt.Errorf("stopped waiting for job %s", job.Id)
+			}
+			if evt.Type == datastore.EventSet {
+				return evt.Item.Data.(*common.JobResult), nil
+			}
+		case <-closed:
+			log.Debugf("client went away waiting for job %s", job.Id)
+			return nil, fmt.Errorf("client went away waiting for job %s", job.Id)
+		case <-timeout.C:
+			return nil, fmt.Errorf("timed out waiting for job %s; it is still queued", job.Id)
+		}
+	}
+}
+
+// eligible reports whether the job can be sent to the node.  Jobs for an
+// existing container only go to its node; new containers go to healthy
+// nodes that have not rejected the job.  Delayed jobs wait until their
+// time.
+func eligible(job *common.Job, nodeId string, schedulable bool, now time.Time) bool {
+	if now.Before(job.NotBefore) {
+		return false
+	}
+	if job.NodeId != "" {
+		return job.NodeId == nodeId
+	}
+	if !schedulable {
+		return false
+	}
+	_, rejected := job.Rejections[nodeId]
+	return !rejected
+}
+
+// nextJob returns the highest priority queued job for the node that fits
+// in the node memory.  New containers are left for a while for nodes that
+// already have their image.
+func (c *Controller) nextJob(nodeId string) *common.Job {
+	schedulable := c.schedulable(nodeId)
+	now := time.Now()
+
+	free := c.nodeFree(nodeId)
+	locality := c.imageLocality()
+	counts := c.serviceNodeCounts()
+
+	c.queueLock.Lock()
+	defer c.queueLock.Unlock()
+
+	var job *common.Job
+	for i, jb := range c.queue.Jobs() {
+		if !eligible(jb, nodeId, schedulable, now) || !placementAllows(jb, nodeId, counts) {
+			continue
+		}
+		if jb.IsCreate() && (!fits(jb, free) || preferElsewhere(jb, nodeId, locality, counts, now)) {
+			continue
+		}
+		job = jb
+		c.queue.Remove(i)
+		break
+	}
+
+	if job != nil {
+		c.pendingJobs[job.Id] = job
+	}
+	return job
+}
+
+// completeJob removes the job from the dispatched jobs once a node has
+// sent the result.
+func (c *Controller) completeJob(jobId string) *common.Job {
+	c.queueLock.Lock()
+	defer c.queueLock.Unlock()
+	job := c.pendingJobs[jobId]
+	delete(c.pendingJobs, jobId)
+	return job
+}
+
+// hasCandidate reports whether a schedulable node has not rejected the job.
+func (c *Controller) hasCandidate(job *common.Job) bool {
+	for nodeId := range c.datastore.Items() {
+		if !c.schedulable(nodeId) {
+			continue
+		}
+		if _, rejected := job.Rejections[nodeId]; !rejected {
+			return true
+		}
+	}
+	return false
+}
+
+// retryRejected reports whether the job can wait for the nodes that
+// rejected it temporarily.  Their rejections are dropped and the job is
+// delayed.
+func (c *Controller) retryRejected(job *common.Job, now time.Time) bool {
+	retry := false
+	for nodeId := range c.datastore.Items() {
+		if job.RetryNodes[nodeId] {
+			delete(job.Rejections, nodeId)
+			delete(job.RetryNodes, nodeId)
+			retry = true
+		}
+	}
+	if retry {
+		job.NotBefore = now.Add(rejectionRetry)
+	}
+	return retry
+}
+
+// rejectJob records the node rejection and requeues the job.  Once every
+// node has rejected the job it waits for the nodes that may accept it
+// later, or it is failed with the collected reasons.
+func (c *Controller) rejectJob(nack *common.JobNack) error {
+	c.queueLock.Lock()
+	job, ok := c.pendingJobs[nack.JobId]
+	if !ok {
+		c.queueLock.Unlock()
+		return fmt.Errorf("unknown job: %s", nack.JobId)
+	}
+	delete(c.pendingJobs, nack.JobId)
+
+	if job.Rejections == nil {
+		job.Rejections = map[string]string{}
+	}
+	job.Rejections[nack.NodeId] = nack.Reason
+	if nack.Temporary {
+		if job.RetryNodes == nil {
+			job.RetryNodes = map[string]bool{}
+		}
+		job.RetryNodes[nack.NodeId] = true
+	}
+
+	if c.hasCandidate(job) || c.retryRejected(job, time.Now()) {
+		c.saveJob(job)
+		c.queue.Add(job)
+		c.queueLock.Unlock()
+		return nil
+	}
+	c.queueLock.Unlock()
+	job.RegistryAuth = ""
+
+	reasons := []string{}
+	for nodeId, reason := range job.Rejections {
+		reasons = append(reasons, fmt.Sprintf("%s: %s", nodeId, reason))
+	}
+	sort.Strings(reasons)
+
+	log.Warnf("job rejected by all nodes: id=%s", job.Id)
+	result := &common.JobResult{
+		JobId: job.Id,
+		Error: fmt.Sprintf("no node accepted the job: %s", strings.Join(reasons, "; ")),
+	}
+	c.saveResult(result, job)
+	c.jobResultDatastore.Set(job.Id, result)
+	return nil
+}
+
+func (c *Controller) apiQueueNack(w http.ResponseWriter, r *http.Request) {
+	nack := &common.JobNack{}
+	if err := json.NewDecoder(r.Body).Decode(&nack); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	log.Infof("job rejected: id=%s node=%s reason=%s", nack.JobId, nack.NodeId, nack.Reason)
+
+	if err := c.rejectJob(nack); err != nil {
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	}
+	w.WriteHeader(http.StatusOK)
+}
@@ -0,0 +1,87 @@
+package controller
+
+import (
+	"fmt"
+	"time"
+
+	"code.google.com/p/go-uuid/uuid"
+	log "github.com/Sirupsen/logrus"
+	"github.com/ehazlett/docker-grid/common"
+)
+
+// containerExits records the containers that exited on the node and
+// restarts them according to their restart policy.
+func (c *Controller) containerExits(nodeId string, exits []*common.ContainerExit) {
+	for _, exit := range exits {
+		c.execsRemoved(exit.ContainerId)
+		owner := c.findOwner(exit.ContainerId)
+		if owner == nil || owner.Job == nil {
+			continue
+		}
+
+		// batch task logs are kept with the batch
+		logs := exit.Logs
+		exit.Logs = ""
+
+		// nodes resend exits until the heartbeat is received
+		c.mutex.Lock()
+		if owner.Exit != nil {
+			c.mutex.Unlock()
+			continue
+		}
+		owner.Exit = exit
+		c.mutex.Unlock()
+		if err := c.store.Put(containersBucket, owner.ContainerId, owner); err != nil {
+			log.Warnf("error saving container owner %s: %s", owner.ContainerId, err)
+		}
+
+		log.Infof("container exited: id=%s node=%s code=%d", owner.ContainerId, nodeId, exit.ExitCode)
+
+		// a group is restarted with its first member
+		if owner.Primary != "" {
+			continue
+		}
+		if owner.Job.Batch != "" {
+			c.batchTaskExited(owner, exit.ExitCode, logs, false)
+			continue
+		}
+		if owner.Job.Cron != "" {
+			c.cronRunExited(owner, exit.ExitCode, false)
+			continue
+		}
+		// service containers are replaced by the service reconciler
+		if owner.Job.Service != "" {
+			continue
+		}
+		if owner.Job.RestartPolicy.ShouldRestart(exit.ExitCode, owner.Job.Restarts) {
+			c.restart(owner, fmt.Sprintf("exited with code %d", exit.ExitCode), false)
+		}
+	}
+}
+
+// restart removes the exited container and queues a copy of its job after
+// the restart backoff.  When the node was lost the job goes to another
+// node; otherwise any eligible node including the same one.
+func (c *Controller) restart(owner *containerOwner, reason string, nodeLost bool) {
+	job := &common.Job{
+		Id:              uuid.New(),
+		Date:            time.Now(),
+		ContainerName:   owner.Job.ContainerName,
+		ContainerConfig: owner.Job.ContainerConfig,
+		RestartPolicy:   owner.Job.RestartPolicy,
+		Restarts:        owner.Job.Restarts + 1,
+		Group:           owner.Job.Group,
+		RegistryAuth:    c.containerAuth(owner.ContainerId),
+		NotBefore:       time.Now().Add(common.RestartBackoff(owner.Job.Restarts)),
+	}
+	if nodeLost {
+		job.Rejections = map[string]string{
+			owner.NodeId: reason,
+		}
+	} else {
+		// remove the exited container first so its name can be reused
+		c.removeContainers(owner)
+	}
+	log.Infof("restarting container: id=%s job=%s restarts=%d policy=%s reason=%s", owner.ContainerId, job.Id, job.Restarts, job.RestartPolicy, reason)
+	c.enqueue(job)
+}
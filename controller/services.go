@@ -0,0 +1,452 @@
+package controller
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"reflect"
+	"sort"
+	"strconv"
+	"time"
+
+	"code.google.com/p/go-uuid/uuid"
+	log "github.com/Sirupsen/logrus"
+	"github.com/ehazlett/docker-grid/common"
+	"github.com/gorilla/mux"
+)
+
+const (
+	servicesBucket    = "services"
+	reconcileInterval = time.Second * 5
+)
+
+type (
+	// serviceContainer is a container of a service
+	serviceContainer struct {
+		ContainerId string
+		NodeId      string
+		Version     int
+		Created     time.Time
+		Status      string
+		Running     bool
+	}
+
+	containersByVersion []*serviceContainer
+)
+
+func (s containersByVersion) Len() int           { return len(s) }
+func (s containersByVersion) Swap(a, b int)      { s[a], s[b] = s[b], s[a] }
+func (s containersByVersion) Less(a, b int) bool { return s[a].Version > s[b].Version }
+
+// serviceOwners returns the containers of each service on connected
+// nodes.  Containers created since the last node heartbeat are running so
+// they are not created twice.
+func (c *Controller) serviceOwners() map[string][]*serviceContainer {
+	nodes := map[string]*common.NodeData{}
+	for nodeId, v := range c.datastore.Items() {
+		nodes[nodeId] = v.Data.(*common.NodeData)
+	}
+
+	c.mutex.RLock()
+	owners := []*containerOwner{}
+	for _, owner := range c.owners {
+		if owner.Job != nil && owner.Job.Service != "" {
+			owners = append(owners, owner)
+		}
+	}
+	c.mutex.RUnlock()
+
+	containers := map[string][]*serviceContainer{}
+	for _, owner := range owners {
+		nodeData, ok := nodes[owner.NodeId]
+		if !ok {
+			continue
+		}
+		sc := &serviceContainer{
+			ContainerId: owner.ContainerId,
+			NodeId:      owner.NodeId,
+			Version:     owner.Job.ServiceVersion,
+			Created:     owner.Date,
+			Running:     owner.Date.After(nodeData.LastHeartbeat),
+		}
+		for _, cnt := range nodeData.Containers {
+			if cnt.Id == owner.ContainerId {
+				sc.Running = true
+				sc.Status = cnt.Status
+				break
+			}
+		}
+		containers[owner.Job.Service] = append(containers[owner.Job.Service], sc)
+	}
+	return containers
+}
+
+// serviceContainers returns the running containers of each service.
+func (c *Controller) serviceContainers() map[string][]*serviceContainer {
+	containers := map[string][]*serviceContainer{}
+	for name, owners := range c.serviceOwners() {
+		for _, sc := range owners {
+			if sc.Running {
+				containers[name] = append(containers[name], sc)
+			}
+		}
+	}
+	return containers
+}
+
+// serviceNodeCounts returns the number of running containers of each
+// service on each node.
+func (c *Controller) serviceNodeCounts() map[string]map[string]int {
+	counts := map[string]map[string]int{}
+	for name, containers := range c.serviceContainers() {
+		nodes := map[string]int{}
+		for _, sc := range containers {
+			nodes[sc.NodeId]++
+		}
+		counts[name] = nodes
+	}
+	return counts
+}
+
+// placementAllows reports whether the job placement rules allow the node.
+// counts are the running service containers from serviceNodeCounts.
+func placementAllows(job *common.Job, nodeId string, counts map[string]map[string]int) bool {
+	p := job.Placement
+	if p == nil {
+		return true
+	}
+	if len(p.Nodes) > 0 {
+		found := false
+		for _, n := range p.Nodes {
+			if n == nodeId {
+				found = true
+				break
+			}
+		}
+		if !found {
+			return false
+		}
+	}
+	if p.MaxPerNode > 0 && job.Service != "" && counts[job.Service][nodeId] >= p.MaxPerNode {
+		return false
+	}
+	return true
+}
+
+// addServiceJob adds a queued job to the jobs of its service.  The caller
+// holds queueLock.
+func (c *Controller) addServiceJob(job *common.Job) {
+	if job.Service == "" {
+		return
+	}
+	jobs, ok := c.serviceQueue[job.Service]
+	if !ok {
+		jobs = map[string]*common.Job{}
+		c.serviceQueue[job.Service] = jobs
+	}
+	jobs[job.Id] = job
+}
+
+// removeServiceJob removes a finished job from the jobs of its service.
+// The caller holds queueLock.
+func (c *Controller) removeServiceJob(jobId string) {
+	for name, jobs := range c.serviceQueue {
+		if _, ok := jobs[jobId]; !ok {
+			continue
+		}
+		delete(jobs, jobId)
+		if len(jobs) == 0 {
+			delete(c.serviceQueue, name)
+		}
+		return
+	}
+}
+
+// serviceJobs returns the number of queued or dispatched create jobs for
+// the service and the containers being removed.
+func (c *Controller) serviceJobs(name string) (int, map[string]bool) {
+	c.queueLock.Lock()
+	defer c.queueLock.Unlock()
+
+	creating := 0
+	removing := map[string]bool{}
+	for _, job := range c.serviceQueue[name] {
+		if job.IsCreate() {
+			creating++
+		} else {
+			removing[job.ContainerId] = true
+		}
+	}
+	return creating, removing
+}
+
+func (c *Controller) getServices() []*common.Service {
+	services := []*common.Service{}
+	if err := c.store.ForEach(servicesBucket, func(key string, data []byte) error {
+		svc := &common.Service{}
+		if err := json.Unmarshal(data, svc); err != nil {
+			return err
+		}
+		services = append(services, svc)
+		return nil
+	}); err != nil {
+		log.Warnf("error loading services: %s", err)
+	}
+	return services
+}
+
+func (c *Controller) getService(name string) (*common.Service, error) {
+	svc := &common.Service{}
+	if err := c.store.Get(servicesBucket, name, svc); err != nil {
+		return nil, err
+	}
+	return svc, nil
+}
+
+func (c *Controller) saveService(svc *common.Service) error {
+	svc.Status = nil
+	return c.store.Put(servicesBucket, svc.Name, svc)
+}
+
+// serviceStatus adds the current status to the service.
+func (c *Controller) serviceStatus(svc *common.Service, containers []*serviceContainer) {
+	creating, removing := c.serviceJobs(svc.Name)
+	status := &common.ServiceStatus{
+		Pending:    creating,
+		Containers: []string{},
+	}
+	for _, sc := range containers {
+		if removing[sc.ContainerId] {
+			continue
+		}
+		status.Running++
+		status.Containers = append(status.Containers, sc.ContainerId)
+	}
+	svc.Status = status
+}
+
+// reconcileServices runs on the leader and converges each service to its
+// desired replicas.
+func (c *Controller) reconcileServices() {
+	ticker := time.NewTicker(reconcileInterval)
+	for _ = range ticker.C {
+		if !c.isLeader() {
+			continue
+		}
+		c.serviceLock.Lock()
+		containers := c.serviceOwners()
+		for _, svc := range c.getServices() {
+			c.reconcile(svc, containers[svc.Name])
+		}
+		c.serviceLock.Unlock()
+	}
+}
+
+func (c *Controller) reconcile(svc *common.Service, containers []*serviceContainer) {
+	creating, removing := c.serviceJobs(svc.Name)
+	var running, current []*serviceContainer
+	for _, sc := range containers {
+		if removing[sc.ContainerId] {
+			continue
+		}
+		current = append(current, sc)
+		if sc.Running {
+			running = append(running, sc)
+		}
+	}
+	// containers of older versions are removed first
+	sort.Stable(containersByVersion(running))
+
+	if missing := svc.Replicas - len(running) - creating; missing > 0 {
+		log.Infof("scaling up service: name=%s running=%d pending=%d desired=%d", svc.Name, len(running), creating, svc.Replicas)
+		for i := 0; i < missing; i++ {
+			c.enqueue(c.serviceJob(svc))
+		}
+	}
+
+	if extra := len(running) - svc.Replicas; extra > 0 && creating == 0 {
+		log.Infof("scaling down service: name=%s running=%d desired=%d", svc.Name, len(running), svc.Replicas)
+		for _, sc := range running[len(running)-extra:] {
+			c.enqueue(c.removeJob(svc.Name, sc))
+		}
+	}
+
+	if svc.Update != nil && c.rollingUpdate(svc, current, running, creating) {
+		if err := c.saveService(svc); err != nil {
+			log.Warnf("error saving service %s: %s", svc.Name, err)
+		}
+	}
+
+	// exited containers are removed from their node
+	for _, sc := range current {
+		if !sc.Running {
+			c.enqueue(c.removeJob(svc.Name, sc))
+		}
+	}
+}
+
+func (c *Controller) serviceJob(svc *common.Service) *common.Job {
+	config := *svc.ContainerConfig
+	config.Env = append([]string{}, svc.ContainerConfig.Env...)
+	return &common.Job{
+		Id:              uuid.New(),
+		Date:            time.Now(),
+		ContainerConfig: &config,
+		Service:         svc.Name,
+		ServiceVersion:  svc.Version,
+		Placement:       svc.Placement,
+	}
+}
+
+func (c *Controller) removeJob(service string, sc *serviceContainer) *common.Job {
+	return &common.Job{
+		Id:          uuid.New(),
+		Date:        time.Now(),
+		Action:      common.JobActionRemove,
+		NodeId:      sc.NodeId,
+		ContainerId: sc.ContainerId,
+		Service:     service,
+	}
+}
+
+// containerRemoved forgets the owner of a removed container.
+func (c *Controller) containerRemoved(job *common.Job, result *common.JobResult) {
+	if result.Error != "" {
+		log.Warnf("error removing container %s on node %s: %s", job.ContainerId, job.NodeId, result.Error)
+		return
+	}
+	c.mutex.Lock()
+	owner := c.owners[job.ContainerId]
+	delete(c.owners, job.ContainerId)
+	delete(c.registryAuth, job.ContainerId)
+	c.mutex.Unlock()
+	c.execsRemoved(job.ContainerId)
+	if err := c.store.Delete(containersBucket, job.ContainerId); err != nil {
+		log.Warnf("error removing container owner %s: %s", job.ContainerId, err)
+	}
+	// group members share the result of the first member
+	if owner != nil && owner.Primary == "" {
+		if err := c.store.Delete(resultsBucket, owner.JobId); err != nil {
+			log.Warnf("error removing job result %s: %s", owner.JobId, err)
+		}
+	}
+}
+
+func (c *Controller) writeService(w http.ResponseWriter, v interface{}) {
+	w.Header().Set("content-type", "application/json")
+	if err := json.NewEncoder(w).Encode(v); err != nil {
+		log.Warnf("error encoding service: %s", err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+	}
+}
+
+func (c *Controller) apiServiceList(w http.ResponseWriter, r *http.Request) {
+	containers := c.serviceContainers()
+	services := c.getServices()
+	for _, svc := range services {
+		c.serviceStatus(svc, containers[svc.Name])
+	}
+	c.writeService(w, services)
+}
+
+func (c *Controller) apiServiceDetails(w http.ResponseWriter, r *http.Request) {
+	name := mux.Vars(r)["name"]
+	svc, err := c.getService(name)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	}
+	c.serviceStatus(svc, c.serviceContainers()[name])
+	c.writeService(w, svc)
+}
+
+// apiServiceCreate creates or updates a service.
+func (c *Controller) apiServiceCreate(w http.ResponseWriter, r *http.Request) {
+	svc := &common.Service{}
+	if err := json.NewDecoder(r.Body).Decode(svc); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if svc.Name == "" || svc.ContainerConfig == nil || svc.ContainerConfig.Image == "" {
+		http.Error(w, "service name and image are required", http.StatusBadRequest)
+		return
+	}
+	if svc.Replicas < 0 {
+		http.Error(w, "replicas must not be negative", http.StatusBadRequest)
+		return
+	}
+
+	if c.policy != nil {
+		if _, err := c.policy.Apply(svc.ContainerConfig); err != nil {
+			http.Error(w, err.Error(), http.StatusForbidden)
+			return
+		}
+	}
+
+	c.serviceLock.Lock()
+	defer c.serviceLock.Unlock()
+
+	// a changed config is rolled out to the running containers
+	svc.Version, svc.PreviousContainerConfig, svc.Update = 0, nil, nil
+	if current, err := c.getService(svc.Name); err == nil {
+		svc.Version = current.Version
+		svc.PreviousContainerConfig = current.PreviousContainerConfig
+		svc.Update = current.Update
+		if !reflect.DeepEqual(current.ContainerConfig, svc.ContainerConfig) {
+			c.startUpdate(svc, current.ContainerConfig, common.UpdateStateUpdating)
+		}
+	}
+
+	if err := c.saveService(svc); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	log.Infof("service saved: name=%s image=%s replicas=%d version=%d", svc.Name, svc.ContainerConfig.Image, svc.Replicas, svc.Version)
+	c.writeService(w, svc)
+}
+
+func (c *Controller) apiServiceScale(w http.ResponseWriter, r *http.Request) {
+	name := mux.Vars(r)["name"]
+	c.serviceLock.Lock()
+	defer c.serviceLock.Unlock()
+	svc, err := c.getService(name)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	}
+	replicas, err := strconv.Atoi(r.URL.Query().Get("replicas"))
+	if err != nil || replicas < 0 {
+		http.Error(w, fmt.Sprintf("invalid replicas: %s", r.URL.Query().Get("replicas")), http.StatusBadRequest)
+		return
+	}
+	svc.Replicas = replicas
+	if err := c.saveService(svc); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	log.Infof("service scaled: name=%s replicas=%d", svc.Name, svc.Replicas)
+	c.writeService(w, svc)
+}
+
+// apiServiceDelete removes the service and its containers.
+func (c *Controller) apiServiceDelete(w http.ResponseWriter, r *http.Request) {
+	name := mux.Vars(r)["name"]
+	c.serviceLock.Lock()
+	defer c.serviceLock.Unlock()
+	if _, err := c.getService(name); err != nil {
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	}
+	if err := c.store.Delete(servicesBucket, name); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	_, removing := c.serviceJobs(name)
+	for _, sc := range c.serviceContainers()[name] {
+		if !removing[sc.ContainerId] {
+			c.enqueue(c.removeJob(name, sc))
+		}
+	}
+	log.Infof("service removed: name=%s", name)
+	w.WriteHeader(http.StatusNoContent)
+}
@@ -0,0 +1,139 @@
+package controller
+
+import (
+	"fmt"
+	"reflect"
+	"sort"
+	"testing"
+	"time"
+
+	"github.com/ehazlett/docker-grid/common"
+	"github.com/samalba/dockerclient"
+)
+
+func TestReconcile(t *testing.T) {
+	now := time.Now()
+	container := func(id string, version int) *serviceContainer {
+		return serviceContainerAt(id, version, now.Add(-time.Hour), "Up 1 hour")
+	}
+	exited := container("exited", 1)
+	exited.Running = false
+
+	tests := []struct {
+		name       string
+		replicas   int
+		containers []*serviceContainer
+		creating   int
+		removing   []string
+		created    int
+		removed    []string
+	}{
+		{
+			name:       "converged",
+			replicas:   2,
+			containers: []*serviceContainer{container("a", 1), container("b", 1)},
+			removed:    []string{},
+		},
+		{
+			name:     "scale up",
+			replicas: 3,
+			created:  3,
+			removed:  []string{},
+		},
+		{
+			name:       "scale up counts pending creates",
+			replicas:   4,
+			containers: []*serviceContainer{container("a", 1)},
+			creating:   2,
+			created:    1,
+			removed:    []string{},
+		},
+		{
+			name:       "no scale up with enough pending creates",
+			replicas:   3,
+			containers: []*serviceContainer{container("a", 1)},
+			creating:   2,
+			removed:    []string{},
+		},
+		{
+			name:       "scale down removes the lowest versions",
+			replicas:   1,
+			containers: []*serviceContainer{container("v1", 1), container("v3", 3), container("v2", 2)},
+			removed:    []string{"v1", "v2"},
+		},
+		{
+			name:       "no scale down while creating",
+			replicas:   1,
+			containers: []*serviceContainer{container("a", 1), container("b", 1)},
+			creating:   1,
+			removed:    []string{},
+		},
+		{
+			name:       "containers being removed are not counted",
+			replicas:   2,
+			containers: []*serviceContainer{container("a", 1), container("b", 1), container("c", 1)},
+			removing:   []string{"c"},
+			removed:    []string{},
+		},
+		{
+			name:       "containers being removed are replaced",
+			replicas:   3,
+			containers: []*serviceContainer{container("a", 1), container("b", 1), container("c", 1)},
+			removing:   []string{"c"},
+			created:    1,
+			removed:    []string{},
+		},
+		{
+			name:       "exited containers are removed",
+			replicas:   1,
+			containers: []*serviceContainer{container("a", 1), exited},
+			removed:    []string{"exited"},
+		},
+		{
+			name:       "exited containers are replaced",
+			replicas:   2,
+			containers: []*serviceContainer{container("a", 1), exited},
+			created:    1,
+			removed:    []string{"exited"},
+		},
+	}
+	for _, test := range tests {
+		c := testController()
+		svc := &common.Service{
+			Name:            "web",
+			ContainerConfig: &dockerclient.ContainerConfig{Image: "redis"},
+			Replicas:        test.replicas,
+			Version:         1,
+		}
+		// jobs queued by an earlier reconcile
+		c.queueLock.Lock()
+		for i := 0; i < test.creating; i++ {
+			job := c.serviceJob(svc)
+			job.Id = fmt.Sprintf("create-%d", i)
+			c.addServiceJob(job)
+		}
+		for _, id := range test.removing {
+			job := c.removeJob(svc.Name, &serviceContainer{ContainerId: id})
+			job.Id = "remove-" + id
+			c.addServiceJob(job)
+		}
+		c.queueLock.Unlock()
+
+		c.reconcile(svc, test.containers)
+
+		created := 0
+		for _, job := range c.queue.Jobs() {
+			if job.IsCreate() {
+				created++
+			}
+		}
+		if created != test.created {
+			t.Fatalf("%s: expected %d creates; received %d", test.name, test.created, created)
+		}
+		removed := queuedRemovals(c)
+		sort.Strings(removed)
+		if !reflect.DeepEqual(removed, test.removed) {
+			t.Fatalf("%s: expected removals %v; received %v", test.name, test.removed, removed)
+		}
+	}
+}
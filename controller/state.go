@@ -0,0 +1,224 @@
+package controller
+
+import (
+	"encoding/json"
+	"sort"
+	"strings"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+	"github.com/ehazlett/docker-grid/common"
+)
+
+const (
+	jobsBucket       = "jobs"
+	resultsBucket    = "results"
+	containersBucket = "containers"
+	nodesBucket      = "nodes"
+)
+
+type (
+	containerOwner struct {
+		ContainerId string      `json:"container_id,omitempty"`
+		NodeId      string      `json:"node_id,omitempty"`
+		JobId       string      `json:"job_id,omitempty"`
+		Job         *common.Job `json:"job,omitempty"`
+		Date        time.Time   `json:"date,omitempty"`
+		// Exit is set once the node reports the container exited
+		Exit *common.ContainerExit `json:"exit,omitempty"`
+		// Primary is the first member container of the group for the
+		// other members
+		Primary string `json:"primary,omitempty"`
+	}
+
+	jobsByDate []*common.Job
+)
+
+func (j jobsByDate) Len() int           { return len(j) }
+func (j jobsByDate) Swap(a, b int)      { j[a], j[b] = j[b], j[a] }
+func (j jobsByDate) Less(a, b int) bool { return j[a].Date.Before(j[b].Date) }
+
+// restore loads the persisted state.  Jobs that were queued or dispatched
+// when the controller stopped are queued again.
+func (c *Controller) restore() error {
+	jobs := []*common.Job{}
+	if err := c.store.ForEach(jobsBucket, func(key string, data []byte) error {
+		job := &common.Job{}
+		if err := json.Unmarshal(data, job); err != nil {
+			return err
+		}
+		jobs = append(jobs, job)
+		return nil
+	}); err != nil {
+		return err
+	}
+	sort.Sort(jobsByDate(jobs))
+	c.queueLock.Lock()
+	for _, job := range jobs {
+		c.queue.Add(job)
+		c.addServiceJob(job)
+	}
+	c.queueLock.Unlock()
+	c.restorePrepulls()
+
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	c.restored = time.Now()
+
+	if err := c.store.ForEach(containersBucket, func(key string, data []byte) error {
+		owner := &containerOwner{}
+		if err := json.Unmarshal(data, owner); err != nil {
+			return err
+		}
+		c.owners[key] = owner
+		return nil
+	}); err != nil {
+		return err
+	}
+
+	if err := c.store.ForEach(nodesBucket, func(key string, data []byte) error {
+		nodeData := &common.NodeData{}
+		if err := json.Unmarshal(data, nodeData); err != nil {
+			return err
+		}
+		c.registrations[key] = nodeData
+		return nil
+	}); err != nil {
+		return err
+	}
+
+	if err := c.store.ForEach(cordonsBucket, func(key string, data []byte) error {
+		cordon := &nodeCordon{}
+		if err := json.Unmarshal(data, cordon); err != nil {
+			return err
+		}
+		c.cordons[key] = cordon
+		return nil
+	}); err != nil {
+		return err
+	}
+
+	log.Infof("restored state: jobs=%d containers=%d nodes=%d", len(jobs), len(c.owners), len(c.registrations))
+	return nil
+}
+
+func (c *Controller) saveJob(job *common.Job) {
+	if err := c.store.Put(jobsBucket, job.Id, job); err != nil {
+		log.Warnf("error saving job %s: %s", job.Id, err)
+	}
+}
+
+// saveResult removes the finished job from the persisted queue and
+// records the result and container ownership.  The job is kept with the
+// owner so the container can be rescheduled.
+func (c *Controller) saveResult(result *common.JobResult, job *common.Job) {
+	// the credentials are only kept in memory with the container
+	auth := ""
+	if job != nil {
+		auth = job.RegistryAuth
+		job.RegistryAuth = ""
+	}
+	if err := c.store.Delete(jobsBucket, result.JobId); err != nil {
+		log.Warnf("error removing job %s: %s", result.JobId, err)
+	}
+	c.queueLock.Lock()
+	c.removeServiceJob(result.JobId)
+	c.queueLock.Unlock()
+	// results are kept for container inspect only and are deleted with
+	// the container
+	if result.ContainerId != "" && result.Error == "" && (job == nil || job.IsCreate()) {
+		if err := c.store.Put(resultsBucket, result.JobId, result); err != nil {
+			log.Warnf("error saving job result %s: %s", result.JobId, err)
+		}
+	}
+	if job != nil && result.Error != "" {
+		c.jobEvent(common.EventJobFail, job, map[string]string{"node": result.NodeId, "error": result.Error})
+	}
+	if job != nil && job.Service != "" && job.IsCreate() && result.Error != "" {
+		c.serviceJobFailed(job, result.Error)
+	}
+	if job != nil && job.Batch != "" && job.IsCreate() {
+		c.batchTaskStarted(job, result)
+	}
+	if job != nil && job.Cron != "" && job.IsCreate() {
+		c.cronRunStarted(job, result)
+	}
+	if result.ContainerId == "" || result.Error != "" || (job != nil && !job.IsCreate()) {
+		return
+	}
+	ids := []string{result.ContainerId}
+	if len(result.Containers) > 1 {
+		ids = append(ids, result.Containers[1:]...)
+	}
+	for i, id := range ids {
+		owner := &containerOwner{
+			ContainerId: id,
+			NodeId:      result.NodeId,
+			JobId:       result.JobId,
+			Job:         job,
+			Date:        time.Now(),
+		}
+		if i > 0 {
+			owner.Primary = result.ContainerId
+		}
+		c.mutex.Lock()
+		c.owners[owner.ContainerId] = owner
+		if i == 0 && auth != "" {
+			c.registryAuth[owner.ContainerId] = auth
+		}
+		c.mutex.Unlock()
+		if err := c.store.Put(containersBucket, owner.ContainerId, owner); err != nil {
+			log.Warnf("error saving container owner %s: %s", owner.ContainerId, err)
+		}
+	}
+}
+
+// containerAuth returns the registry credentials of the request that
+// created the container, for the jobs that create it again (restart,
+// reschedule and preemption).  They are lost when the controller restarts
+// or the leader changes.
+func (c *Controller) containerAuth(containerId string) string {
+	c.mutex.RLock()
+	defer c.mutex.RUnlock()
+	return c.registryAuth[containerId]
+}
+
+// registerNode persists the node registration when it is first seen or
+// its details change.
+func (c *Controller) registerNode(data *common.NodeData) {
+	c.mutex.Lock()
+	reg, ok := c.registrations[data.NodeId]
+	if ok && reg.IP == data.IP && reg.Version == data.Version && reg.Cpus == data.Cpus && reg.Memory == data.Memory {
+		c.mutex.Unlock()
+		return
+	}
+	reg = &common.NodeData{
+		NodeId:  data.NodeId,
+		Cpus:    data.Cpus,
+		Memory:  data.Memory,
+		Version: data.Version,
+		IP:      data.IP,
+	}
+	c.registrations[data.NodeId] = reg
+	c.mutex.Unlock()
+
+	log.Infof("node registered: id=%s ip=%s version=%s", reg.NodeId, reg.IP, reg.Version)
+	if err := c.store.Put(nodesBucket, reg.NodeId, reg); err != nil {
+		log.Warnf("error saving node %s: %s", reg.NodeId, err)
+	}
+}
+
+// findOwner returns the owner of the container by full or partial id.
+func (c *Controller) findOwner(containerId string) *containerOwner {
+	c.mutex.RLock()
+	defer c.mutex.RUnlock()
+	if owner, ok := c.owners[containerId]; ok {
+		return owner
+	}
+	for id, owner := range c.owners {
+		if strings.Index(id, containerId) == 0 {
+			return owner
+		}
+	}
+	return nil
+}
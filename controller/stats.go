@@ -0,0 +1,73 @@
+package controller
+
+import (
+	"encoding/json"
+	"net/http"
+	"sort"
+	"strings"
+
+	log "github.com/Sirupsen/logrus"
+	"github.com/ehazlett/docker-grid/common"
+	"github.com/gorilla/mux"
+)
+
+// proxyContainer forwards a container request (stats, top) to the node
+// of the container.
+func (c *Controller) proxyContainer(w http.ResponseWriter, r *http.Request) {
+	containerId := mux.Vars(r)["containerId"]
+	nd, id, err := c.findContainer(containerId)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	}
+	r.URL.Path = strings.Replace(r.URL.Path, "/containers/"+containerId+"/", "/containers/"+id+"/", 1)
+	c.hijackNode(w, r, nd.NodeId)
+}
+
+// gridStats compares the capacity, reservations and measured usage of
+// the connected nodes.
+func (c *Controller) gridStats() *common.GridStats {
+	stats := &common.GridStats{
+		Nodes: []*common.NodeStats{},
+	}
+	nodes := []*common.NodeData{}
+	for _, nd := range c.nodes() {
+		if nd.State != common.NodeStateDown {
+			nodes = append(nodes, nd)
+		}
+	}
+	sort.Sort(common.NodesById{Nodes: nodes})
+
+	for _, nd := range nodes {
+		ns := &common.NodeStats{
+			NodeId:     nd.NodeId,
+			State:      nd.State,
+			Containers: len(nd.Containers),
+			Cpus:       nd.Cpus,
+			Memory:     int64(nd.Memory * 1024 * 1024),
+		}
+		ns.CpusReserved, ns.MemoryReserved = c.nodeReserved(nd)
+		if nd.Usage != nil {
+			ns.CpusUsed = nd.Usage.Cpus
+			ns.MemoryUsed = nd.Usage.Memory
+			ns.Collected = nd.Usage.Collected
+		}
+
+		stats.Cpus += ns.Cpus
+		stats.CpusReserved += ns.CpusReserved
+		stats.CpusUsed += ns.CpusUsed
+		stats.Memory += ns.Memory
+		stats.MemoryReserved += ns.MemoryReserved
+		stats.MemoryUsed += ns.MemoryUsed
+		stats.Nodes = append(stats.Nodes, ns)
+	}
+	return stats
+}
+
+func (c *Controller) apiGridStats(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("content-type", "application/json")
+	if err := json.NewEncoder(w).Encode(c.gridStats()); err != nil {
+		log.Warnf("error encoding grid stats: %s", err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+	}
+}
@@ -0,0 +1,226 @@
+package controller
+
+import (
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+	"github.com/ehazlett/docker-grid/common"
+	"github.com/gorilla/mux"
+	"github.com/samalba/dockerclient"
+)
+
+const (
+	defaultUpdateParallelism = 1
+)
+
+// updateConfig returns the service update config with defaults.
+func updateConfig(svc *common.Service) common.UpdateConfig {
+	cfg := common.UpdateConfig{}
+	if svc.UpdateConfig != nil {
+		cfg = *svc.UpdateConfig
+	}
+	if cfg.Parallelism <= 0 {
+		cfg.Parallelism = defaultUpdateParallelism
+	}
+	if cfg.FailureAction == "" {
+		cfg.FailureAction = common.UpdateFailureActionPause
+	}
+	return cfg
+}
+
+// startUpdate replaces the service containers with the current config.
+func (c *Controller) startUpdate(svc *common.Service, previous *dockerclient.ContainerConfig, state string) {
+	svc.Version++
+	svc.PreviousContainerConfig = previous
+	svc.Update = &common.UpdateStatus{
+		State:     state,
+		Total:     svc.Replicas,
+		StartedAt: time.Now(),
+	}
+	log.Infof("updating service: name=%s version=%d state=%s", svc.Name, svc.Version, state)
+}
+
+// serviceJobFailed records a failed container create so the service
+// update can pause or roll back.
+func (c *Controller) serviceJobFailed(job *common.Job, reason string) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	c.serviceFailures[failureKey(job.Service, job.ServiceVersion)] = reason
+}
+
+func failureKey(name string, version int) string {
+	return fmt.Sprintf("%s:%d", name, version)
+}
+
+// updateFailure returns why the current version of the service failed.
+func (c *Controller) updateFailure(svc *common.Service, containers []*serviceContainer) string {
+	key := failureKey(svc.Name, svc.Version)
+	c.mutex.Lock()
+	reason, ok := c.serviceFailures[key]
+	delete(c.serviceFailures, key)
+	c.mutex.Unlock()
+	if ok {
+		return reason
+	}
+
+	for _, sc := range containers {
+		if sc.Version != svc.Version {
+			continue
+		}
+		if !sc.Running {
+			return fmt.Sprintf("container %s exited", sc.ContainerId)
+		}
+		if strings.Contains(sc.Status, "(unhealthy)") {
+			return fmt.Sprintf("container %s is unhealthy", sc.ContainerId)
+		}
+	}
+	return ""
+}
+
+// healthy reports whether the container has passed its healthcheck or has
+// been running for the monitor period.
+func (sc *serviceContainer) healthy(monitor time.Duration, now time.Time) bool {
+	switch {
+	case strings.Contains(sc.Status, "(healthy)"):
+		return true
+	case strings.Contains(sc.Status, "(health: starting)"):
+		return false
+	}
+	return now.Sub(sc.Created) >= monitor
+}
+
+// rollingUpdate replaces the containers of older versions in batches once
+// the replaced containers are healthy.  It reports whether the update
+// status changed.
+func (c *Controller) rollingUpdate(svc *common.Service, containers []*serviceContainer, running []*serviceContainer, creating int) bool {
+	update := svc.Update
+	if update.State != common.UpdateStateUpdating && update.State != common.UpdateStateRollingBack {
+		return false
+	}
+	cfg := updateConfig(svc)
+	now := time.Now()
+
+	if reason := c.updateFailure(svc, containers); reason != "" {
+		c.updateFailed(svc, cfg, reason)
+		return true
+	}
+
+	var old, current []*serviceContainer
+	for _, sc := range running {
+		if sc.Version == svc.Version {
+			current = append(current, sc)
+		} else {
+			old = append(old, sc)
+		}
+	}
+	changed := update.Updated != len(current) || update.Total != svc.Replicas
+	update.Updated = len(current)
+	update.Total = svc.Replicas
+
+	// wait for the replaced containers to start
+	if creating > 0 || len(running) < svc.Replicas {
+		return changed
+	}
+	for _, sc := range current {
+		if !sc.healthy(time.Second*time.Duration(cfg.Monitor), now) {
+			return changed
+		}
+	}
+
+	if len(old) == 0 {
+		if update.State == common.UpdateStateRollingBack {
+			update.State = common.UpdateStateRolledBack
+		} else {
+			update.State = common.UpdateStateCompleted
+		}
+		update.CompletedAt = now
+		update.NextBatch = time.Time{}
+		log.Infof("service update %s: name=%s version=%d", update.State, svc.Name, svc.Version)
+		return true
+	}
+
+	if update.NextBatch.IsZero() {
+		update.NextBatch = now.Add(time.Second * time.Duration(cfg.Delay))
+		changed = true
+	}
+	if now.Before(update.NextBatch) {
+		return changed
+	}
+
+	batch := old
+	if len(batch) > cfg.Parallelism {
+		batch = batch[:cfg.Parallelism]
+	}
+	log.Infof("updating service containers: name=%s version=%d containers=%d remaining=%d", svc.Name, svc.Version, len(batch), len(old))
+	for _, sc := range batch {
+		c.enqueue(c.removeJob(svc.Name, sc))
+	}
+	update.NextBatch = time.Time{}
+	return true
+}
+
+// updateFailed pauses the update or rolls back to the previous config.
+func (c *Controller) updateFailed(svc *common.Service, cfg common.UpdateConfig, reason string) {
+	log.Warnf("service update failed: name=%s version=%d: %s", svc.Name, svc.Version, reason)
+	if svc.Update.State == common.UpdateStateUpdating && cfg.FailureAction == common.UpdateFailureActionRollback && svc.PreviousContainerConfig != nil {
+		c.rollback(svc)
+		svc.Update.Message = fmt.Sprintf("update failed: %s", reason)
+		return
+	}
+	svc.Update.State = common.UpdateStatePaused
+	svc.Update.Message = reason
+	svc.Update.NextBatch = time.Time{}
+}
+
+func (c *Controller) rollback(svc *common.Service) {
+	config := svc.ContainerConfig
+	svc.ContainerConfig = svc.PreviousContainerConfig
+	c.startUpdate(svc, config, common.UpdateStateRollingBack)
+}
+
+func (c *Controller) apiServiceResume(w http.ResponseWriter, r *http.Request) {
+	name := mux.Vars(r)["name"]
+	c.serviceLock.Lock()
+	defer c.serviceLock.Unlock()
+	svc, err := c.getService(name)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	}
+	if svc.Update == nil || svc.Update.State != common.UpdateStatePaused {
+		http.Error(w, "service update is not paused", http.StatusConflict)
+		return
+	}
+	svc.Update.State = common.UpdateStateUpdating
+	svc.Update.Message = ""
+	if err := c.saveService(svc); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	log.Infof("service update resumed: name=%s version=%d", svc.Name, svc.Version)
+	c.writeService(w, svc)
+}
+
+func (c *Controller) apiServiceRollback(w http.ResponseWriter, r *http.Request) {
+	name := mux.Vars(r)["name"]
+	c.serviceLock.Lock()
+	defer c.serviceLock.Unlock()
+	svc, err := c.getService(name)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	}
+	if svc.PreviousContainerConfig == nil {
+		http.Error(w, "service has no previous config", http.StatusConflict)
+		return
+	}
+	c.rollback(svc)
+	if err := c.saveService(svc); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	c.writeService(w, svc)
+}
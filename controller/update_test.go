@@ -0,0 +1,316 @@
+package controller
+
+import (
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/ehazlett/docker-grid/common"
+	"github.com/ehazlett/docker-grid/utils/datastore"
+	"github.com/samalba/dockerclient"
+)
+
+// testController returns a controller with an in-memory store and no
+// nodes.
+func testController() *Controller {
+	return &Controller{
+		queue:           newJobQueue(),
+		pendingJobs:     map[string]*common.Job{},
+		serviceQueue:    map[string]map[string]*common.Job{},
+		store:           datastore.NewMemoryStore(),
+		owners:          map[string]*containerOwner{},
+		serviceFailures: map[string]string{},
+		registryAuth:    map[string]string{},
+		execs:           map[string]*execRecord{},
+		eventListeners:  map[chan *common.Event]bool{},
+	}
+}
+
+// queuedRemovals returns the containers of the queued remove jobs.
+func queuedRemovals(c *Controller) []string {
+	ids := []string{}
+	for _, job := range c.queue.Jobs() {
+		if job.Action == common.JobActionRemove {
+			ids = append(ids, job.ContainerId)
+		}
+	}
+	return ids
+}
+
+func serviceContainerAt(id string, version int, created time.Time, status string) *serviceContainer {
+	return &serviceContainer{
+		ContainerId: id,
+		NodeId:      "node-0",
+		Version:     version,
+		Created:     created,
+		Status:      status,
+		Running:     true,
+	}
+}
+
+func TestServiceContainerHealthy(t *testing.T) {
+	now := time.Now()
+	monitor := time.Minute
+	tests := []struct {
+		name     string
+		status   string
+		age      time.Duration
+		expected bool
+	}{
+		{name: "within the monitor period", status: "Up 10 seconds", age: 10 * time.Second},
+		{name: "after the monitor period", status: "Up 2 minutes", age: 2 * time.Minute, expected: true},
+		{name: "healthcheck passed", status: "Up 10 seconds (healthy)", age: 10 * time.Second, expected: true},
+		{name: "healthcheck starting", status: "Up 2 minutes (health: starting)", age: 2 * time.Minute},
+		{name: "not yet reported by the node", age: 2 * time.Minute, expected: true},
+	}
+	for _, test := range tests {
+		sc := serviceContainerAt("a", 1, now.Add(-test.age), test.status)
+		if sc.healthy(monitor, now) != test.expected {
+			t.Fatalf("%s: expected healthy %v", test.name, test.expected)
+		}
+	}
+}
+
+func TestRollingUpdate(t *testing.T) {
+	old := time.Now().Add(-time.Hour)
+	recent := time.Now()
+	v1 := func(id string) *serviceContainer { return serviceContainerAt(id, 1, old, "Up 1 hour") }
+	v2 := func(id string) *serviceContainer { return serviceContainerAt(id, 2, old, "Up 1 hour") }
+	exited := v2("exited")
+	exited.Running = false
+	previous := &dockerclient.ContainerConfig{Image: "redis:2.8"}
+
+	tests := []struct {
+		name       string
+		state      string
+		config     *common.UpdateConfig
+		previous   *dockerclient.ContainerConfig
+		nextBatch  time.Time
+		containers []*serviceContainer
+		creating   int
+		failure    string
+
+		expectedState string
+		removed       []string
+		updated       int
+		waiting       bool
+		message       string
+		version       int
+	}{
+		{
+			name:          "finished update is left alone",
+			state:         common.UpdateStateCompleted,
+			containers:    []*serviceContainer{v1("a"), v1("b"), v1("c")},
+			expectedState: common.UpdateStateCompleted,
+			removed:       []string{},
+		},
+		{
+			name:          "waits for pending creates",
+			state:         common.UpdateStateUpdating,
+			containers:    []*serviceContainer{v2("new"), v1("a"), v1("b"), v1("c")},
+			creating:      1,
+			expectedState: common.UpdateStateUpdating,
+			removed:       []string{},
+			updated:       1,
+		},
+		{
+			name:          "waits for the replicas",
+			state:         common.UpdateStateUpdating,
+			containers:    []*serviceContainer{v2("new"), v1("a")},
+			expectedState: common.UpdateStateUpdating,
+			removed:       []string{},
+			updated:       1,
+		},
+		{
+			name:          "waits for the monitor period",
+			state:         common.UpdateStateUpdating,
+			config:        &common.UpdateConfig{Monitor: 60},
+			containers:    []*serviceContainer{serviceContainerAt("new", 2, recent, "Up 1 second"), v1("a"), v1("b"), v1("c")},
+			expectedState: common.UpdateStateUpdating,
+			removed:       []string{},
+			updated:       1,
+		},
+		{
+			name:          "waits for the healthcheck",
+			state:         common.UpdateStateUpdating,
+			containers:    []*serviceContainer{serviceContainerAt("new", 2, old, "Up 1 hour (health: starting)"), v1("a"), v1("b"), v1("c")},
+			expectedState: common.UpdateStateUpdating,
+			removed:       []string{},
+			updated:       1,
+		},
+		{
+			name:          "healthcheck passed within the monitor period",
+			state:         common.UpdateStateUpdating,
+			config:        &common.UpdateConfig{Monitor: 60},
+			containers:    []*serviceContainer{serviceContainerAt("new", 2, recent, "Up 1 second (healthy)"), v1("a"), v1("b"), v1("c")},
+			expectedState: common.UpdateStateUpdating,
+			removed:       []string{"a"},
+			updated:       1,
+		},
+		{
+			name:          "batch of parallelism containers",
+			state:         common.UpdateStateUpdating,
+			config:        &common.UpdateConfig{Parallelism: 2},
+			containers:    []*serviceContainer{v2("new"), v1("a"), v1("b"), v1("c")},
+			expectedState: common.UpdateStateUpdating,
+			removed:       []string{"a", "b"},
+			updated:       1,
+		},
+		{
+			name:          "delay before the next batch",
+			state:         common.UpdateStateUpdating,
+			config:        &common.UpdateConfig{Delay: 30},
+			containers:    []*serviceContainer{v2("new"), v1("a"), v1("b"), v1("c")},
+			expectedState: common.UpdateStateUpdating,
+			removed:       []string{},
+			updated:       1,
+			waiting:       true,
+		},
+		{
+			name:          "waits for the next batch",
+			state:         common.UpdateStateUpdating,
+			config:        &common.UpdateConfig{Delay: 30},
+			nextBatch:     time.Now().Add(time.Minute),
+			containers:    []*serviceContainer{v2("new"), v1("a"), v1("b"), v1("c")},
+			expectedState: common.UpdateStateUpdating,
+			removed:       []string{},
+			updated:       1,
+			waiting:       true,
+		},
+		{
+			name:          "next batch after the delay",
+			state:         common.UpdateStateUpdating,
+			config:        &common.UpdateConfig{Delay: 30},
+			nextBatch:     time.Now().Add(-time.Second),
+			containers:    []*serviceContainer{v2("new"), v1("a"), v1("b"), v1("c")},
+			expectedState: common.UpdateStateUpdating,
+			removed:       []string{"a"},
+			updated:       1,
+		},
+		{
+			name:          "completed",
+			state:         common.UpdateStateUpdating,
+			containers:    []*serviceContainer{v2("a"), v2("b"), v2("c")},
+			expectedState: common.UpdateStateCompleted,
+			removed:       []string{},
+			updated:       3,
+		},
+		{
+			name:          "rolled back",
+			state:         common.UpdateStateRollingBack,
+			containers:    []*serviceContainer{v2("a"), v2("b"), v2("c")},
+			expectedState: common.UpdateStateRolledBack,
+			removed:       []string{},
+			updated:       3,
+		},
+		{
+			name:          "failed create pauses",
+			state:         common.UpdateStateUpdating,
+			containers:    []*serviceContainer{v2("new"), v1("a"), v1("b"), v1("c")},
+			failure:       "no node accepted the job",
+			expectedState: common.UpdateStatePaused,
+			removed:       []string{},
+			message:       "no node accepted the job",
+		},
+		{
+			name:          "exited container pauses",
+			state:         common.UpdateStateUpdating,
+			containers:    []*serviceContainer{exited, v1("a"), v1("b"), v1("c")},
+			expectedState: common.UpdateStatePaused,
+			removed:       []string{},
+			message:       "container exited exited",
+		},
+		{
+			name:          "unhealthy container rolls back",
+			state:         common.UpdateStateUpdating,
+			config:        &common.UpdateConfig{FailureAction: common.UpdateFailureActionRollback},
+			previous:      previous,
+			containers:    []*serviceContainer{serviceContainerAt("new", 2, old, "Up 1 hour (unhealthy)"), v1("a"), v1("b"), v1("c")},
+			expectedState: common.UpdateStateRollingBack,
+			removed:       []string{},
+			message:       "update failed: container new is unhealthy",
+			version:       3,
+		},
+		{
+			name:          "rollback without a previous config pauses",
+			state:         common.UpdateStateUpdating,
+			config:        &common.UpdateConfig{FailureAction: common.UpdateFailureActionRollback},
+			containers:    []*serviceContainer{v2("new"), v1("a"), v1("b"), v1("c")},
+			failure:       "no node accepted the job",
+			expectedState: common.UpdateStatePaused,
+			removed:       []string{},
+			message:       "no node accepted the job",
+		},
+		{
+			name:          "failed rollback pauses",
+			state:         common.UpdateStateRollingBack,
+			config:        &common.UpdateConfig{FailureAction: common.UpdateFailureActionRollback},
+			previous:      previous,
+			containers:    []*serviceContainer{v2("new"), v1("a"), v1("b"), v1("c")},
+			failure:       "no node accepted the job",
+			expectedState: common.UpdateStatePaused,
+			removed:       []string{},
+			message:       "no node accepted the job",
+		},
+	}
+	for _, test := range tests {
+		c := testController()
+		config := &dockerclient.ContainerConfig{Image: "redis:3.0"}
+		svc := &common.Service{
+			Name:                    "web",
+			ContainerConfig:         config,
+			PreviousContainerConfig: test.previous,
+			Replicas:                3,
+			Version:                 2,
+			UpdateConfig:            test.config,
+			Update: &common.UpdateStatus{
+				State:     test.state,
+				NextBatch: test.nextBatch,
+			},
+		}
+		if test.failure != "" {
+			c.serviceFailures[failureKey(svc.Name, svc.Version)] = test.failure
+		}
+		var running []*serviceContainer
+		for _, sc := range test.containers {
+			if sc.Running {
+				running = append(running, sc)
+			}
+		}
+
+		c.rollingUpdate(svc, test.containers, running, test.creating)
+
+		if svc.Update.State != test.expectedState {
+			t.Fatalf("%s: expected state %s; received %s", test.name, test.expectedState, svc.Update.State)
+		}
+		if removed := queuedRemovals(c); !reflect.DeepEqual(removed, test.removed) {
+			t.Fatalf("%s: expected removals %v; received %v", test.name, test.removed, removed)
+		}
+		if svc.Update.Updated != test.updated {
+			t.Fatalf("%s: expected %d updated; received %d", test.name, test.updated, svc.Update.Updated)
+		}
+		if !svc.Update.NextBatch.IsZero() != test.waiting {
+			t.Fatalf("%s: expected waiting for the next batch %v; received %s", test.name, test.waiting, svc.Update.NextBatch)
+		}
+		if svc.Update.Message != test.message {
+			t.Fatalf("%s: expected message %q; received %q", test.name, test.message, svc.Update.Message)
+		}
+		version := test.version
+		if version == 0 {
+			version = 2
+		}
+		if svc.Version != version {
+			t.Fatalf("%s: expected version %d; received %d", test.name, version, svc.Version)
+		}
+		if test.expectedState == common.UpdateStateRollingBack {
+			if svc.ContainerConfig != previous || svc.PreviousContainerConfig != config {
+				t.Fatalf("%s: expected the configs to be swapped", test.name)
+			}
+		}
+		if test.expectedState != test.state && (test.expectedState == common.UpdateStateCompleted || test.expectedState == common.UpdateStateRolledBack) {
+			if svc.Update.CompletedAt.IsZero() {
+				t.Fatalf("%s: expected the completion time", test.name)
+			}
+		}
+	}
+}
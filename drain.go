@@ -0,0 +1,96 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+
+	log "github.com/Sirupsen/logrus"
+	"github.com/codegangsta/cli"
+	"github.com/ehazlett/docker-grid/common"
+)
+
+var controllerFlag = cli.StringFlag{
+	Name:  "controller, c",
+	Value: "http://127.0.0.1:8080",
+	Usage: "URL to controller",
+}
+
+var cordonCommand = cli.Command{
+	Name:   "cordon",
+	Usage:  "stop scheduling new containers on a node",
+	Action: cordonAction,
+	Flags: []cli.Flag{
+		controllerFlag,
+	},
+}
+
+var uncordonCommand = cli.Command{
+	Name:   "uncordon",
+	Usage:  "resume scheduling containers on a node",
+	Action: uncordonAction,
+	Flags: []cli.Flag{
+		controllerFlag,
+	},
+}
+
+var drainCommand = cli.Command{
+	Name:   "drain",
+	Usage:  "take a node out of rotation for maintenance",
+	Action: drainAction,
+	Flags: []cli.Flag{
+		controllerFlag,
+		cli.BoolFlag{
+			Name:  "reschedule, r",
+			Usage: "stop the node containers and reschedule them on other nodes",
+		},
+	},
+}
+
+func nodeRequest(c *cli.Context, action string, query string) {
+	nodeId := c.Args().First()
+	if nodeId == "" {
+		log.Fatalf("you must specify a node id")
+	}
+
+	url := fmt.Sprintf("%s/grid/nodes/%s/%s%s", c.String("controller"), nodeId, action, query)
+	resp, err := http.Post(url, "application/json", nil)
+	if err != nil {
+		log.Fatalf("error sending %s: %s", action, err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		b, _ := ioutil.ReadAll(resp.Body)
+		log.Fatalf("error sending %s: %s", action, errors.New(string(b)))
+	}
+
+	data := &common.NodeData{}
+	if err := json.NewDecoder(resp.Body).Decode(data); err != nil {
+		log.Fatalf("error decoding node state: %s", err)
+	}
+
+	if data.Drain != nil && data.Drain.Reschedule {
+		fmt.Printf("%s: %s (%d containers to reschedule)\n", data.NodeId, data.State, data.Drain.Remaining)
+		return
+	}
+	fmt.Printf("%s: %s\n", data.NodeId, data.State)
+}
+
+func cordonAction(c *cli.Context) {
+	nodeRequest(c, "cordon", "")
+}
+
+func uncordonAction(c *cli.Context) {
+	nodeRequest(c, "uncordon", "")
+}
+
+func drainAction(c *cli.Context) {
+	query := ""
+	if c.Bool("reschedule") {
+		query = "?reschedule=true"
+	}
+	nodeRequest(c, "drain", query)
+}
@@ -8,10 +8,15 @@ import (
 	"github.com/codegangsta/cli"
 )
 
-func waitForInterrupt() {
+// waitForInterrupt runs the shutdown functions and exits once the process
+// is interrupted.
+func waitForInterrupt(shutdown ...func()) {
 	sigChan := make(chan os.Signal, 1)
 	signal.Notify(sigChan, os.Interrupt, syscall.SIGTERM, syscall.SIGQUIT)
 	for _ = range sigChan {
+		for _, fn := range shutdown {
+			fn()
+		}
 		os.Exit(0)
 	}
 }
@@ -28,6 +33,9 @@ func main() {
 		nodeCommand,
 		controllerCommand,
 		viewCommand,
+		cordonCommand,
+		uncordonCommand,
+		drainCommand,
 	}
 
 	app.Run(os.Args)
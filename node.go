@@ -6,6 +6,7 @@ import (
 
 	log "github.com/Sirupsen/logrus"
 	"github.com/codegangsta/cli"
+	"github.com/ehazlett/docker-grid/common"
 	"github.com/ehazlett/docker-grid/node"
 )
 
@@ -17,7 +18,7 @@ var nodeCommand = cli.Command{
 		cli.StringFlag{
 			Name:  "controller, c",
 			Value: "http://127.0.0.1:8080",
-			Usage: "URL to controller",
+			Usage: "URL to controller (comma separated for multiple controllers)",
 		},
 		cli.StringFlag{
 			Name:  "docker, d",
@@ -32,7 +33,7 @@ var nodeCommand = cli.Command{
 		cli.Float64Flag{
 			Name:  "memory",
 			Value: 0.0,
-			Usage: "maximum memory to consume",
+			Usage: "maximum memory to consume (in MB)",
 		},
 		cli.IntFlag{
 			Name:  "heartbeat, b",
@@ -48,6 +49,44 @@ var nodeCommand = cli.Command{
 			Name:  "grid-containers, g",
 			Usage: "show only grid containers",
 		},
+		cli.StringFlag{
+			Name:  "policy, p",
+			Value: "",
+			Usage: "path to container policy file",
+		},
+		cli.StringSliceFlag{
+			Name:  "allow-image",
+			Value: &cli.StringSlice{},
+			Usage: "image pattern this node will run (can be repeated)",
+		},
+		cli.IntFlag{
+			Name:  "max-container-memory",
+			Value: 0,
+			Usage: "maximum memory per container (in MB)",
+		},
+		cli.BoolFlag{
+			Name:  "deny-privileged",
+			Usage: "refuse privileged containers",
+		},
+		cli.BoolFlag{
+			Name:  "deny-binds",
+			Usage: "refuse containers with bind mounts",
+		},
+		cli.StringFlag{
+			Name:  "allowed-hours",
+			Value: "",
+			Usage: "local hours when jobs are accepted (e.g. 22-06)",
+		},
+		cli.StringFlag{
+			Name:  "registry-config",
+			Value: "",
+			Usage: "path to registry credentials (Docker config.json format)",
+		},
+		cli.IntFlag{
+			Name:  "proxy-port",
+			Value: 0,
+			Usage: "port of the proxy the controller uses for exec (disabled when 0)",
+		},
 		cli.BoolFlag{
 			Name:  "debug",
 			Usage: "enable debug logging",
@@ -103,7 +142,36 @@ func nodeAction(c *cli.Context) {
 
 	}
 
-	node, err := node.NewNode(c.String("controller"), c.String("docker"), nil, c.Float64("cpus"), c.Float64("memory"), c.Int("heartbeat"), nodeIp, c.Bool("grid-containers"), c.Bool("debug"))
+	var policy *common.Policy
+	if p := c.String("policy"); p != "" {
+		pol, err := common.LoadPolicy(p)
+		if err != nil {
+			log.Fatalf("error loading policy: %s", err)
+		}
+		policy = pol
+	}
+
+	admission := &node.Admission{
+		AllowedImages:  c.StringSlice("allow-image"),
+		MaxMemory:      int64(c.Int("max-container-memory")) * 1024 * 1024,
+		DenyPrivileged: c.Bool("deny-privileged"),
+		DenyBinds:      c.Bool("deny-binds"),
+		AllowedHours:   c.String("allowed-hours"),
+	}
+	if err := admission.Validate(); err != nil {
+		log.Fatalf("error loading admission settings: %s", err)
+	}
+
+	var credentials *node.RegistryCredentials
+	if p := c.String("registry-config"); p != "" {
+		creds, err := node.LoadRegistryCredentials(p)
+		if err != nil {
+			log.Fatalf("error loading registry credentials: %s", err)
+		}
+		credentials = creds
+	}
+
+	node, err := node.NewNode(strings.Split(c.String("controller"), ","), c.String("docker"), nil, c.Float64("cpus"), c.Float64("memory"), c.Int("heartbeat"), nodeIp, c.Bool("grid-containers"), policy, admission, credentials, c.Int("proxy-port"), c.Bool("debug"))
 	if err != nil {
 		log.Fatalf("error connecting to docker: %s", err)
 	}
@@ -0,0 +1,108 @@
+package node
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/ehazlett/docker-grid/common"
+	"github.com/samalba/dockerclient"
+)
+
+type (
+	// Admission is the local policy a node owner uses to decide which jobs
+	// this node will accept.
+	Admission struct {
+		AllowedImages  []string
+		MaxMemory      int64
+		DenyPrivileged bool
+		DenyBinds      bool
+		// AllowedHours is a range of local hours in the form "start-end"
+		// (e.g. "22-06").  Empty allows all hours.
+		AllowedHours string
+	}
+)
+
+// Admit returns a reason if the config is refused by the node.  Temporary
+// refusals (outside the allowed hours) may be accepted later.  Containers without a memory limit are given the node
+// maximum.
+func (a *Admission) Admit(config *dockerclient.ContainerConfig, now time.Time) (string, bool, error) {
+	if a.AllowedHours != "" {
+		ok, err := inHours(a.AllowedHours, now.Hour())
+		if err != nil {
+			return "", false, err
+		}
+		if !ok {
+			return fmt.Sprintf("node only accepts jobs during hours %s", a.AllowedHours), true, nil
+		}
+	}
+
+	if len(a.AllowedImages) > 0 && !common.MatchImage(a.AllowedImages, config.Image) {
+		return fmt.Sprintf("image %s is not allowed on this node", config.Image), false, nil
+	}
+
+	if a.DenyPrivileged && config.HostConfig.Privileged {
+		return "privileged containers are not allowed on this node", false, nil
+	}
+
+	if a.DenyBinds && len(config.HostConfig.Binds) > 0 {
+		return "bind mounts are not allowed on this node", false, nil
+	}
+
+	if a.MaxMemory > 0 {
+		if config.Memory > a.MaxMemory {
+			return fmt.Sprintf("memory %d exceeds node maximum of %d", config.Memory, a.MaxMemory), false, nil
+		}
+		if config.Memory == 0 {
+			config.Memory = a.MaxMemory
+		}
+	}
+
+	return "", false, nil
+}
+
+// Validate returns an error if the admission settings cannot be used.
+func (a *Admission) Validate() error {
+	if a.AllowedHours != "" {
+		if _, _, err := parseHours(a.AllowedHours); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// parseHours returns the start and end hours of a "start-end" range.
+func parseHours(hours string) (int, int, error) {
+	parts := strings.Split(hours, "-")
+	if len(parts) != 2 {
+		return 0, 0, fmt.Errorf("invalid allowed hours: %s", hours)
+	}
+	start, err := strconv.Atoi(parts[0])
+	if err != nil || start < 0 || start > 23 {
+		return 0, 0, fmt.Errorf("invalid allowed hours: %s", hours)
+	}
+	end, err := strconv.Atoi(parts[1])
+	if err != nil || end < 0 || end > 23 {
+		return 0, 0, fmt.Errorf("invalid allowed hours: %s", hours)
+	}
+	return start, end, nil
+}
+
+// inHours reports whether the hour is in the range.  The start hour is
+// included and the end hour is not; a range with the same start and end
+// allows all hours.
+func inHours(hours string, hour int) (bool, error) {
+	start, end, err := parseHours(hours)
+	if err != nil {
+		return false, err
+	}
+	if start == end {
+		return true, nil
+	}
+	// ranges such as 22-06 wrap past midnight
+	if start < end {
+		return hour >= start && hour < end, nil
+	}
+	return hour >= start || hour < end, nil
+}
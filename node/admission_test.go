@@ -0,0 +1,170 @@
+package node
+
+import (
+	"testing"
+	"time"
+
+	"github.com/samalba/dockerclient"
+)
+
+func TestInHours(t *testing.T) {
+	tests := []struct {
+		hours    string
+		hour     int
+		expected bool
+		err      bool
+	}{
+		{hours: "09-17", hour: 9, expected: true},
+		{hours: "09-17", hour: 16, expected: true},
+		{hours: "09-17", hour: 17},
+		{hours: "09-17", hour: 8},
+		{hours: "22-06", hour: 22, expected: true},
+		{hours: "22-06", hour: 23, expected: true},
+		{hours: "22-06", hour: 0, expected: true},
+		{hours: "22-06", hour: 5, expected: true},
+		{hours: "22-06", hour: 6},
+		{hours: "22-06", hour: 12},
+		{hours: "8-8", hour: 3, expected: true},
+		{hours: "0-23", hour: 23},
+		{hours: "25-06", err: true},
+		{hours: "22-24", err: true},
+		{hours: "-1-06", err: true},
+		{hours: "22-x", err: true},
+		{hours: "22", err: true},
+		{hours: "22-06-08", err: true},
+	}
+	for _, test := range tests {
+		ok, err := inHours(test.hours, test.hour)
+		if test.err {
+			if err == nil {
+				t.Fatalf("%s: expected error", test.hours)
+			}
+			continue
+		}
+		if err != nil {
+			t.Fatalf("%s: unexpected error: %s", test.hours, err)
+		}
+		if ok != test.expected {
+			t.Fatalf("%s: expected hour %d allowed %v", test.hours, test.hour, test.expected)
+		}
+	}
+}
+
+func TestAdmissionValidate(t *testing.T) {
+	tests := []struct {
+		hours string
+		err   bool
+	}{
+		{hours: ""},
+		{hours: "22-06"},
+		{hours: "25-x", err: true},
+		{hours: "8", err: true},
+	}
+	for _, test := range tests {
+		err := (&Admission{AllowedHours: test.hours}).Validate()
+		if test.err && err == nil {
+			t.Fatalf("%q: expected error", test.hours)
+		}
+		if !test.err && err != nil {
+			t.Fatalf("%q: unexpected error: %s", test.hours, err)
+		}
+	}
+}
+
+func TestAdmit(t *testing.T) {
+	const mb = int64(1024 * 1024)
+	noon := time.Date(2015, 6, 11, 12, 0, 0, 0, time.Local)
+	tests := []struct {
+		name      string
+		admission *Admission
+		config    *dockerclient.ContainerConfig
+		now       time.Time
+		refused   bool
+		temporary bool
+		memory    int64
+	}{
+		{
+			name:      "no limits",
+			admission: &Admission{},
+			config:    &dockerclient.ContainerConfig{Image: "redis"},
+		},
+		{
+			name:      "outside the allowed hours",
+			admission: &Admission{AllowedHours: "22-06"},
+			config:    &dockerclient.ContainerConfig{Image: "redis"},
+			refused:   true,
+			temporary: true,
+		},
+		{
+			name:      "within the allowed hours",
+			admission: &Admission{AllowedHours: "22-06"},
+			config:    &dockerclient.ContainerConfig{Image: "redis"},
+			now:       noon.Add(12 * time.Hour),
+		},
+		{
+			name:      "allowed image",
+			admission: &Admission{AllowedImages: []string{"ehazlett/*"}},
+			config:    &dockerclient.ContainerConfig{Image: "ehazlett/interlock"},
+		},
+		{
+			name:      "image not allowed",
+			admission: &Admission{AllowedImages: []string{"ehazlett/*"}},
+			config:    &dockerclient.ContainerConfig{Image: "redis"},
+			refused:   true,
+		},
+		{
+			name:      "privileged",
+			admission: &Admission{DenyPrivileged: true},
+			config:    &dockerclient.ContainerConfig{Image: "redis", HostConfig: dockerclient.HostConfig{Privileged: true}},
+			refused:   true,
+		},
+		{
+			name:      "bind mounts",
+			admission: &Admission{DenyBinds: true},
+			config:    &dockerclient.ContainerConfig{Image: "redis", HostConfig: dockerclient.HostConfig{Binds: []string{"/data:/data"}}},
+			refused:   true,
+		},
+		{
+			name:      "memory over the node maximum",
+			admission: &Admission{MaxMemory: 64 * mb},
+			config:    &dockerclient.ContainerConfig{Image: "redis", Memory: 128 * mb},
+			refused:   true,
+			memory:    128 * mb,
+		},
+		{
+			name:      "memory within the node maximum",
+			admission: &Admission{MaxMemory: 64 * mb},
+			config:    &dockerclient.ContainerConfig{Image: "redis", Memory: 32 * mb},
+			memory:    32 * mb,
+		},
+		{
+			name:      "node maximum as the default memory",
+			admission: &Admission{MaxMemory: 64 * mb},
+			config:    &dockerclient.ContainerConfig{Image: "redis"},
+			memory:    64 * mb,
+		},
+	}
+	for _, test := range tests {
+		now := test.now
+		if now.IsZero() {
+			now = noon
+		}
+		reason, temporary, err := test.admission.Admit(test.config, now)
+		if err != nil {
+			t.Fatalf("%s: unexpected error: %s", test.name, err)
+		}
+		if (reason != "") != test.refused {
+			t.Fatalf("%s: expected refused %v; received %q", test.name, test.refused, reason)
+		}
+		if temporary != test.temporary {
+			t.Fatalf("%s: expected temporary %v; received %v", test.name, test.temporary, temporary)
+		}
+		if test.config.Memory != test.memory {
+			t.Fatalf("%s: expected memory %d; received %d", test.name, test.memory, test.config.Memory)
+		}
+	}
+
+	if _, _, err := (&Admission{AllowedHours: "25-x"}).Admit(&dockerclient.ContainerConfig{Image: "redis"}, noon); err == nil {
+		t.Fatalf("expected error for invalid allowed hours")
+	}
+}
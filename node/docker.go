@@ -0,0 +1,180 @@
+package node
+
+import (
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"sort"
+	"strings"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+	"github.com/ehazlett/docker-grid/common"
+	"github.com/samalba/dockerclient"
+)
+
+const (
+	maxLogLines = 1000
+	// imageRefresh is how often the images are listed when no image
+	// event was seen
+	imageRefresh = time.Minute
+)
+
+type (
+	imageInfo struct {
+		Id          string
+		RepoDigests []string
+	}
+)
+
+// dockerRequest sends a request directly to the local Docker daemon for
+// API calls not covered by dockerclient.
+func (node *Node) dockerRequest(method string, path string, body io.Reader, header http.Header) (*http.Response, error) {
+	url := fmt.Sprintf("%s%s", node.client.URL.String(), path)
+	req, err := http.NewRequest(method, url, body)
+	if err != nil {
+		return nil, err
+	}
+	for k, v := range header {
+		req.Header[k] = v
+	}
+	if body != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+	resp, err := node.client.HTTPClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode == http.StatusNotFound {
+		resp.Body.Close()
+		return nil, dockerclient.ErrNotFound
+	}
+	if resp.StatusCode >= 400 {
+		b, _ := ioutil.ReadAll(resp.Body)
+		resp.Body.Close()
+		return nil, dockerclient.Error{StatusCode: resp.StatusCode, Status: strings.TrimSpace(string(b))}
+	}
+	return resp, nil
+}
+
+func (node *Node) inspectImage(name string) (*imageInfo, error) {
+	resp, err := node.dockerRequest("GET", fmt.Sprintf("/images/%s/json", name), nil, nil)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	info := &imageInfo{}
+	if err := json.NewDecoder(resp.Body).Decode(info); err != nil {
+		return nil, err
+	}
+	return info, nil
+}
+
+// verifyImageDigest checks that the local image the daemon uses for a
+// reference by digest carries that digest for the same repository.  The
+// image is inspected by id since a reference by digest only resolves when
+// it already matches.
+func (node *Node) verifyImageDigest(image string) error {
+	ref := common.ParseImage(image)
+	if ref.Digest == "" {
+		return nil
+	}
+
+	resolved, err := node.inspectImage(image)
+	if err != nil {
+		return err
+	}
+	info, err := node.inspectImage(resolved.Id)
+	if err != nil {
+		return err
+	}
+
+	for _, d := range info.RepoDigests {
+		r := common.ParseImage(d)
+		if r.Name() == ref.Name() && r.Digest == ref.Digest {
+			return nil
+		}
+	}
+	return fmt.Errorf("image %s (%s) does not match digest %s", image, info.Id, ref.Digest)
+}
+
+// localImages returns the local images so the controller can list them and
+// prefer this node for containers using them, with a hash of the list.  The
+// images are only listed again after an image event or imageRefresh.
+func (node *Node) localImages() ([]*dockerclient.Image, string) {
+	node.imageLock.Lock()
+	defer node.imageLock.Unlock()
+	if !node.imagesStale && time.Since(node.imagesListed) < imageRefresh {
+		return node.images, node.imagesHash
+	}
+	images, err := node.client.ListImages()
+	if err != nil {
+		log.Warnf("error listing images: %s", err)
+		return node.images, node.imagesHash
+	}
+	node.images = images
+	node.imagesHash = imagesHash(images)
+	node.imagesListed = time.Now()
+	node.imagesStale = false
+	return node.images, node.imagesHash
+}
+
+// imagesChanged lists the images again for the next heartbeat.
+func (node *Node) imagesChanged() {
+	node.imageLock.Lock()
+	node.imagesStale = true
+	node.imageLock.Unlock()
+}
+
+func imagesHash(images []*dockerclient.Image) string {
+	lines := []string{}
+	for _, img := range images {
+		tags := append([]string{}, img.RepoTags...)
+		sort.Strings(tags)
+		lines = append(lines, img.Id+" "+strings.Join(tags, ","))
+	}
+	sort.Strings(lines)
+	sum := sha256.Sum256([]byte(strings.Join(lines, "\n")))
+	return hex.EncodeToString(sum[:])
+}
+
+// containerLogs returns the last lines of the container output.
+func (node *Node) containerLogs(id string) (string, error) {
+	resp, err := node.dockerRequest("GET", fmt.Sprintf("/containers/%s/logs?stdout=1&stderr=1&tail=%d", id, maxLogLines), nil, nil)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+
+	b, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return "", err
+	}
+	return string(demuxLogs(b)), nil
+}
+
+// demuxLogs strips the stream headers Docker adds to the output of
+// containers without a tty.
+func demuxLogs(b []byte) []byte {
+	out := []byte{}
+	for len(b) >= 8 {
+		if b[0] > 2 || b[1] != 0 || b[2] != 0 || b[3] != 0 {
+			// tty output has no headers
+			return b
+		}
+		size := int(binary.BigEndian.Uint32(b[4:8]))
+		b = b[8:]
+		if size > len(b) {
+			size = len(b)
+		}
+		out = append(out, b[:size]...)
+		b = b[size:]
+	}
+	return append(out, b...)
+}
@@ -0,0 +1,186 @@
+package node
+
+import (
+	"encoding/json"
+	"fmt"
+	"strings"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+	"github.com/ehazlett/docker-grid/common"
+)
+
+const (
+	// maxEvents is the number of events kept while the controller cannot
+	// be reached; older events are dropped
+	maxEvents = 1000
+)
+
+// watchEvents follows the Docker event stream and keeps the events for the
+// next heartbeat.  The stream is reopened from the last event when it
+// ends.
+func (node *Node) watchEvents() {
+	cursor := newEventCursor()
+	// grid records whether the containers seen are grid containers; it
+	// is needed once a container is destroyed and cannot be inspected
+	grid := map[string]bool{}
+	for {
+		path := "/events"
+		if cursor.since > 0 {
+			path = fmt.Sprintf("/events?since=%d", cursor.since)
+		}
+		cursor.reopen()
+		resp, err := node.dockerRequest("GET", path, nil, nil)
+		if err != nil {
+			log.Warnf("error getting docker events: %s", err)
+			time.Sleep(time.Millisecond * time.Duration(node.heartbeatInterval))
+			continue
+		}
+		dec := json.NewDecoder(resp.Body)
+		for {
+			evt := &common.Event{}
+			if err := dec.Decode(evt); err != nil {
+				log.Debugf("docker event stream ended: %s", err)
+				break
+			}
+			if !cursor.add(evt) {
+				continue
+			}
+			if imageEvent(evt) {
+				node.imagesChanged()
+			}
+			if node.showOnlyGridContainers && evt.EventType() == "container" && !node.gridEvent(evt, grid) {
+				continue
+			}
+			evt.SetNode(node.Id)
+			node.addEvents(evt)
+		}
+		resp.Body.Close()
+		time.Sleep(time.Millisecond * time.Duration(node.heartbeatInterval))
+	}
+}
+
+// eventCursor tracks the position in the event stream so that the events
+// replayed when the stream is reopened are skipped.  The since parameter is
+// in whole seconds: events with a timeNano are compared on it, while for
+// daemons that do not send it the events of the last second are counted
+// and as many are skipped after reopening.
+type eventCursor struct {
+	since     int64
+	sinceNano int64
+	// seen counts the events of the second since without a timeNano
+	seen map[string]int
+	// skip counts the events of the second since still to be replayed
+	skip map[string]int
+}
+
+func newEventCursor() *eventCursor {
+	return &eventCursor{seen: map[string]int{}}
+}
+
+// reopen prepares the cursor for a stream reopened from since.
+func (c *eventCursor) reopen() {
+	c.skip = map[string]int{}
+	for key, n := range c.seen {
+		c.skip[key] = n
+	}
+}
+
+// add reports whether the event is new and moves the cursor past it.
+func (c *eventCursor) add(evt *common.Event) bool {
+	if evt.Time < c.since {
+		return false
+	}
+	if evt.Time > c.since {
+		c.since, c.sinceNano = evt.Time, 0
+		c.seen = map[string]int{}
+		c.skip = nil
+	}
+	if evt.TimeNano != 0 {
+		if evt.TimeNano <= c.sinceNano {
+			return false
+		}
+		c.sinceNano = evt.TimeNano
+		return true
+	}
+	key := eventKey(evt)
+	if c.skip[key] > 0 {
+		c.skip[key]--
+		return false
+	}
+	c.seen[key]++
+	return true
+}
+
+// eventKey identifies an event within a second.
+func eventKey(evt *common.Event) string {
+	actor := ""
+	if evt.Actor != nil {
+		actor = evt.Actor.ID
+	}
+	return strings.Join([]string{evt.Type, evt.Action, evt.Status, evt.ID, evt.From, actor}, "\x00")
+}
+
+// imageEvent reports whether the event changes the local images.  Daemons
+// older than API 1.22 send image events without a type.
+func imageEvent(evt *common.Event) bool {
+	if evt.Type != "" {
+		return evt.Type == "image"
+	}
+	switch evt.Status {
+	case "pull", "tag", "untag", "delete", "import", "load":
+		return true
+	}
+	return false
+}
+
+// gridEvent reports whether the container event is for a grid container.
+func (node *Node) gridEvent(evt *common.Event, grid map[string]bool) bool {
+	id := evt.ID
+	if evt.Actor != nil && evt.Actor.ID != "" {
+		id = evt.Actor.ID
+	}
+	ok, known := grid[id]
+	if !known {
+		isGrid, err := node.gridContainer(id)
+		if err != nil {
+			return false
+		}
+		grid[id] = isGrid
+		ok = isGrid
+	}
+	if evt.EventAction() == "destroy" {
+		delete(grid, id)
+	}
+	return ok
+}
+
+func (node *Node) addEvents(events ...*common.Event) {
+	node.eventLock.Lock()
+	defer node.eventLock.Unlock()
+	node.events = trimEvents(append(node.events, events...))
+}
+
+// takeEvents returns the events for the heartbeat.
+func (node *Node) takeEvents() []*common.Event {
+	node.eventLock.Lock()
+	defer node.eventLock.Unlock()
+	events := node.events
+	node.events = nil
+	return events
+}
+
+// requeueEvents keeps the events of a failed heartbeat for the next one,
+// before the events received since.
+func (node *Node) requeueEvents(events []*common.Event) {
+	node.eventLock.Lock()
+	defer node.eventLock.Unlock()
+	node.events = trimEvents(append(events, node.events...))
+}
+
+func trimEvents(events []*common.Event) []*common.Event {
+	if len(events) > maxEvents {
+		return events[len(events)-maxEvents:]
+	}
+	return events
+}
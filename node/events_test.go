@@ -0,0 +1,44 @@
+package node
+
+import (
+	"testing"
+
+	"github.com/ehazlett/docker-grid/common"
+)
+
+func TestEventCursor(t *testing.T) {
+	event := func(status, id string, time, timeNano int64) *common.Event {
+		return &common.Event{Status: status, ID: id, Time: time, TimeNano: timeNano}
+	}
+	tests := []struct {
+		name   string
+		reopen bool
+		evt    *common.Event
+		added  bool
+	}{
+		{name: "first", evt: event("create", "a", 100, 0), added: true},
+		{name: "same second", evt: event("start", "a", 100, 0), added: true},
+		{name: "same event again in the second", evt: event("start", "a", 100, 0), added: true},
+		// the stream is reopened with since=100 and replays the second
+		{name: "replayed create", reopen: true, evt: event("create", "a", 100, 0)},
+		{name: "replayed start", evt: event("start", "a", 100, 0)},
+		{name: "replayed second start", evt: event("start", "a", 100, 0)},
+		{name: "new event in the second", evt: event("die", "a", 100, 0), added: true},
+		{name: "older", evt: event("create", "b", 99, 0)},
+		{name: "next second", evt: event("create", "b", 101, 0), added: true},
+		{name: "replayed next second", reopen: true, evt: event("create", "b", 101, 0)},
+		{name: "same event in the next second", evt: event("create", "b", 101, 0), added: true},
+		{name: "with time nano", evt: event("start", "b", 102, 102000000005), added: true},
+		{name: "replayed time nano", reopen: true, evt: event("start", "b", 102, 102000000005)},
+		{name: "later time nano", evt: event("die", "b", 102, 102000000006), added: true},
+	}
+	c := newEventCursor()
+	for _, test := range tests {
+		if test.reopen {
+			c.reopen()
+		}
+		if c.add(test.evt) != test.added {
+			t.Fatalf("%s: expected added %v", test.name, test.added)
+		}
+	}
+}
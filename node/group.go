@@ -0,0 +1,52 @@
+package node
+
+import (
+	"fmt"
+
+	log "github.com/Sirupsen/logrus"
+	"github.com/ehazlett/docker-grid/common"
+)
+
+// runGroup creates the group members in order.  The members after the
+// first join its network namespace.  When a member fails the members
+// already created are removed.
+func (node *Node) runGroup(job *common.Job) *common.JobResult {
+	result := &common.JobResult{
+		JobId:  job.Id,
+		NodeId: node.Id,
+	}
+
+	created := []string{}
+	for i, m := range job.Group.Members {
+		cfg := m.ContainerConfig
+		if i > 0 && cfg.HostConfig.NetworkMode == "" {
+			cfg.HostConfig.NetworkMode = fmt.Sprintf("container:%s", created[0])
+		}
+		id, err := node.launch(job, cfg, job.Group.MemberName(m))
+		if err != nil {
+			node.rollbackGroup(job, created)
+			result.Error = fmt.Sprintf("%s: %s (group rolled back)", m.Name, err)
+			return result
+		}
+		created = append(created, id)
+	}
+
+	result.ContainerId = created[0]
+	result.Containers = created
+	info, err := node.client.InspectContainer(created[0])
+	if err != nil {
+		log.Warnf("error inspecting container: %s", err)
+		result.Warnings = append(result.Warnings, err.Error())
+	}
+	result.ContainerInfo = info
+	return result
+}
+
+func (node *Node) rollbackGroup(job *common.Job, created []string) {
+	for i := len(created) - 1; i >= 0; i-- {
+		log.Infof("removing group member: job=%s container=%s", job.Id, created[i])
+		if err := node.client.RemoveContainer(created[i], true); err != nil {
+			log.Warnf("error removing group member %s: %s", created[i], err)
+		}
+	}
+}
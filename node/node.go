@@ -6,10 +6,12 @@ import (
 	"encoding/json"
 	"errors"
 	"fmt"
+	"io"
 	"io/ioutil"
 	"net"
 	"net/http"
 	"strings"
+	"sync"
 	"time"
 
 	log "github.com/Sirupsen/logrus"
@@ -25,16 +27,51 @@ type (
 		Id                     string
 		client                 *dockerclient.DockerClient
 		conn                   *net.Conn
-		controllerUrl          string
+		controllerUrls         []string
+		controllerIndex        int
+		controllerLock         sync.Mutex
 		heartbeatInterval      int
 		showOnlyGridContainers bool
 		ip                     string
 		Cpus                   float64
 		Memory                 float64
+		policy                 *common.Policy
+		admission              *Admission
+		credentials            *RegistryCredentials
+		tlsConfig              *tls.Config
+		// proxyPort is the port of the proxy to the Docker daemon; the
+		// proxy is disabled when zero
+		proxyPort  int
+		proxyToken string
+		// proxyTLS serves the self-signed proxyCert; proxySent records
+		// that the controller has the token and certificate
+		proxyTLS  *tls.Config
+		proxyCert string
+		proxySent bool
+		// running are the grid containers seen in the last heartbeat
+		running map[string]bool
+		// exits are reported until the controller receives them
+		exits []*common.ContainerExit
+		// usage is measured for the usageContainers by collectUsage
+		usageLock       sync.Mutex
+		usage           *common.NodeUsage
+		usageContainers []string
+		samples         map[string]*cpuSample
+		// events are the Docker events not yet sent to the controller
+		eventLock sync.Mutex
+		events    []*common.Event
+		// images are listed again when stale or after imageRefresh and
+		// sent when their hash differs from the hash last sent
+		imageLock      sync.Mutex
+		images         []*dockerclient.Image
+		imagesHash     string
+		imagesListed   time.Time
+		imagesStale    bool
+		sentImagesHash string
 	}
 )
 
-func NewNode(controllerUrl string, dockerUrl string, tlsConfig *tls.Config, cpus float64, memory float64, heartbeatInterval int, ip string, showOnlyGridContainers bool, enableDebug bool) (*Node, error) {
+func NewNode(controllerUrls []string, dockerUrl string, tlsConfig *tls.Config, cpus float64, memory float64, heartbeatInterval int, ip string, showOnlyGridContainers bool, policy *common.Policy, admission *Admission, credentials *RegistryCredentials, proxyPort int, enableDebug bool) (*Node, error) {
 	if enableDebug {
 		log.SetLevel(log.DebugLevel)
 	}
@@ -47,34 +84,79 @@ func NewNode(controllerUrl string, dockerUrl string, tlsConfig *tls.Config, cpus
 		return nil, err
 	}
 
+	var (
+		proxyTLS  *tls.Config
+		proxyCert string
+	)
+	if proxyPort > 0 {
+		proxyTLS, proxyCert, err = proxyCertificate(ip)
+		if err != nil {
+			return nil, err
+		}
+	}
+
 	node := &Node{
 		Id:                     id,
 		client:                 client,
-		controllerUrl:          controllerUrl,
+		controllerUrls:         controllerUrls,
 		heartbeatInterval:      heartbeatInterval,
 		showOnlyGridContainers: showOnlyGridContainers,
-		ip:     ip,
-		Cpus:   cpus,
-		Memory: memory,
+		ip:                     ip,
+		Cpus:                   cpus,
+		Memory:                 memory,
+		policy:                 policy,
+		admission:              admission,
+		credentials:            credentials,
+		tlsConfig:              tlsConfig,
+		proxyPort:              proxyPort,
+		proxyToken:             uuid.Formatter(uuid.NewV4(), uuid.CleanHyphen),
+		proxyTLS:               proxyTLS,
+		proxyCert:              proxyCert,
+		running:                map[string]bool{},
+		samples:                map[string]*cpuSample{},
 	}
 	return node, nil
 }
 
-func (node *Node) buildUrl(path string) string {
-	return fmt.Sprintf("%s%s", node.controllerUrl, path)
+func (node *Node) controllerUrl() string {
+	node.controllerLock.Lock()
+	defer node.controllerLock.Unlock()
+	return node.controllerUrls[node.controllerIndex]
+}
+
+// failover switches to the next controller after the current one is
+// unreachable.
+func (node *Node) failover(failed string) {
+	node.controllerLock.Lock()
+	defer node.controllerLock.Unlock()
+	if node.controllerUrls[node.controllerIndex] != failed {
+		return
+	}
+	node.controllerIndex = (node.controllerIndex + 1) % len(node.controllerUrls)
+	log.Warnf("controller %s unreachable; switching to %s", failed, node.controllerUrls[node.controllerIndex])
 }
 
 func (node *Node) doRequest(path string, method string, expectedStatus int, b []byte) (*http.Response, error) {
-	url := node.buildUrl(path)
-	buf := bytes.NewBuffer(b)
-	req, err := http.NewRequest(method, url, buf)
-	if err != nil {
-		return nil, err
+	var (
+		resp *http.Response
+		err  error
+	)
+	for i := 0; i < len(node.controllerUrls); i++ {
+		controllerUrl := node.controllerUrl()
+		url := fmt.Sprintf("%s%s", controllerUrl, path)
+		req, reqErr := http.NewRequest(method, url, bytes.NewBuffer(b))
+		if reqErr != nil {
+			return nil, reqErr
 
-	}
-	req.Header.Set("User-Agent", "grid-node")
+		}
+		req.Header.Set("User-Agent", "grid-node")
 
-	resp, err := http.DefaultClient.Do(req)
+		resp, err = http.DefaultClient.Do(req)
+		if err == nil {
+			break
+		}
+		node.failover(controllerUrl)
+	}
 	if err != nil {
 		return nil, err
 
@@ -100,6 +182,7 @@ func (node *Node) sendNodeInfo() {
 	}
 
 	var containers []*dockerclient.Container
+	running := map[string]bool{}
 	// filter non-grid containers
 	for _, cnt := range allContainers {
 		c := cnt
@@ -109,27 +192,50 @@ func (node *Node) sendNodeInfo() {
 			continue
 		}
 
+		grid := common.EnvValue(info.Config, common.GridEnv) != ""
+		if grid {
+			running[c.Id] = true
+		}
+
 		// filter if needed
-		if node.showOnlyGridContainers {
-			for _, e := range info.Config.Env {
-				k := strings.Split(e, "=")
-				if k[0] == "DOCKER_GRID" {
-					containers = append(containers, &c)
-					break
-				}
-			}
-		} else {
+		if !node.showOnlyGridContainers || grid {
 			containers = append(containers, &c)
 		}
 	}
+	node.containerExits(running)
+
+	ids := []string{}
+	for id := range running {
+		ids = append(ids, id)
+	}
+	node.usageLock.Lock()
+	node.usageContainers = ids
+	usage := node.usage
+	node.usageLock.Unlock()
 
 	d := &common.NodeData{
-		NodeId:     node.Id,
-		Cpus:       node.Cpus,
-		Memory:     node.Memory,
-		Containers: containers,
-		Version:    VERSION,
-		IP:         node.ip,
+		NodeId:            node.Id,
+		Cpus:              node.Cpus,
+		Memory:            node.Memory,
+		Containers:        containers,
+		Version:           VERSION,
+		IP:                node.ip,
+		HeartbeatInterval: node.heartbeatInterval,
+		Exits:             node.exits,
+		Usage:             usage,
+		Events:            node.takeEvents(),
+	}
+	images, imagesHash := node.localImages()
+	d.ImagesHash = imagesHash
+	if imagesHash != node.sentImagesHash {
+		d.Images = images
+	}
+	if node.proxyPort > 0 {
+		d.ProxyURL = fmt.Sprintf("https://%s", node.proxyAddr())
+		if !node.proxySent {
+			d.ProxyToken = node.proxyToken
+			d.ProxyCert = node.proxyCert
+		}
 	}
 
 	b, err := json.Marshal(d)
@@ -137,13 +243,57 @@ func (node *Node) sendNodeInfo() {
 		log.Fatalf("error marshaling containers: %s", err)
 	}
 
-	if _, err := node.doRequest(fmt.Sprintf("/grid/nodes/%s/update", node.Id), "POST", 200, b); err != nil {
+	resp, err := node.doRequest(fmt.Sprintf("/grid/nodes/%s/update", node.Id), "POST", 200, b)
+	if err != nil {
 		log.Warnf("error sending heartbeat: %s", err)
+		node.requeueEvents(d.Events)
+		return
+	}
+	defer resp.Body.Close()
+	node.exits = nil
+	node.sentImagesHash = imagesHash
+	node.proxySent = true
+
+	reply := &common.NodeUpdateReply{}
+	if err := json.NewDecoder(resp.Body).Decode(reply); err != nil && err != io.EOF {
+		log.Warnf("error decoding heartbeat reply: %s", err)
+	}
+	if reply.Resend {
+		node.sentImagesHash = ""
+		node.proxySent = false
 	}
 }
 
+// containerExits records the grid containers that stopped running since
+// the last heartbeat.
+func (node *Node) containerExits(running map[string]bool) {
+	for id := range node.running {
+		if running[id] {
+			continue
+		}
+		exit := &common.ContainerExit{
+			ContainerId: id,
+			ExitCode:    -1,
+		}
+		if info, err := node.client.InspectContainer(id); err == nil {
+			exit.ExitCode = info.State.ExitCode
+			exit.FinishedAt = info.State.FinishedAt
+			if common.EnvValue(info.Config, common.BatchEnv) != "" {
+				logs, err := node.containerLogs(id)
+				if err != nil {
+					log.Warnf("error getting logs for container %s: %s", id, err)
+				}
+				exit.Logs = logs
+			}
+		}
+		log.Infof("container exited: id=%s code=%d", id, exit.ExitCode)
+		node.exits = append(node.exits, exit)
+	}
+	node.running = running
+}
+
 func (node *Node) checkQueue() {
-	resp, err := node.doRequest("/grid/queue/next", "GET", 200, nil)
+	resp, err := node.doRequest(fmt.Sprintf("/grid/queue/next?node=%s", node.Id), "GET", 200, nil)
 	if err != nil {
 		log.Warnf("error checking queue: %s", err)
 		return
@@ -155,64 +305,264 @@ func (node *Node) checkQueue() {
 		return
 	}
 
-	if job.Id != "" {
-		log.Infof("processing job: id=%s image=%s", job.Id, job.ContainerConfig.Image)
-		// TODO: inject "grid" env var
-		cntCfg := job.ContainerConfig
-		if cntCfg.Env == nil {
-			env := []string{"DOCKER_GRID=true"}
-			cntCfg.Env = env
-		} else {
-			cntCfg.Env = append(cntCfg.Env, "DOCKER_GRID=true")
+	if job.Id == "" {
+		return
+	}
+	job.RegistryAuth = resp.Header.Get(common.RegistryAuthHeader)
+
+	if !job.IsCreate() {
+		node.sendJobResult(node.runAction(&job))
+		return
+	}
+
+	configs := []*dockerclient.ContainerConfig{job.ContainerConfig}
+	if job.Group != nil {
+		configs = []*dockerclient.ContainerConfig{}
+		for _, m := range job.Group.Members {
+			configs = append(configs, m.ContainerConfig)
 		}
-		containerId, err := node.createContainer(cntCfg, job.ContainerName)
-		if err != nil {
-			log.Warnf("error creating container: %s")
+	}
+
+	if node.admission != nil {
+		for _, cfg := range configs {
+			reason, temporary, err := node.admission.Admit(cfg, time.Now())
+			if err != nil {
+				log.Warnf("error checking admission: %s", err)
+				reason = err.Error()
+			}
+			if reason != "" {
+				node.nackJob(&job, reason, temporary)
+				return
+			}
+		}
+	}
+
+	// the controller should have already applied its policy; check again
+	// in case this node has a stricter one.  Another node may accept the
+	// job.
+	warnings, err := node.applyPolicy(&job)
+	if err != nil {
+		node.nackJob(&job, err.Error(), false)
+		return
+	}
+
+	// leave the job for a node that has the image
+	if job.PullPolicy == common.PullNever {
+		for _, cfg := range configs {
+			present, err := node.hasImage(cfg.Image)
+			if err != nil {
+				log.Warnf("error checking image %s: %s", cfg.Image, err)
+			}
+			if !present {
+				node.nackJob(&job, (&ImageNotPresentError{Image: cfg.Image}).Error(), true)
+				return
+			}
 		}
-		result := &common.JobResult{
-			JobId:       job.Id,
-			NodeId:      node.Id,
-			ContainerId: containerId,
+	}
+
+	log.Infof("processing job: id=%s image=%s", job.Id, job.ContainerConfig.Image)
+	var result *common.JobResult
+	if job.Group != nil {
+		result = node.runGroup(&job)
+	} else {
+		result = node.runJob(&job)
+	}
+	result.Warnings = append(warnings, result.Warnings...)
+	// track the containers so an exit before the next heartbeat is
+	// reported
+	if result.Error == "" {
+		node.running[result.ContainerId] = true
+		for _, id := range result.Containers {
+			node.running[id] = true
 		}
-		hostCfg := job.ContainerConfig.HostConfig
-		if err := node.client.StartContainer(containerId, &hostCfg); err != nil {
-			log.Warnf("error starting container: %s", err)
+	}
+	node.sendJobResult(result)
+}
+
+func (node *Node) sendJobResult(result *common.JobResult) {
+	b, err := json.Marshal(result)
+	if err != nil {
+		log.Fatalf("error marshaling job result: %s", err)
+	}
+	resp, err := node.doRequest("/grid/queue/result", "POST", 200, b)
+	if resp != nil {
+		resp.Body.Close()
+	}
+	if err != nil {
+		log.Warnf("error sending job result: %s", err)
+	}
+}
+
+// runAction runs a job for an existing container on this node.
+func (node *Node) runAction(job *common.Job) *common.JobResult {
+	log.Infof("processing job: id=%s action=%s container=%s", job.Id, job.Action, job.ContainerId)
+	result := &common.JobResult{
+		JobId:       job.Id,
+		NodeId:      node.Id,
+		ContainerId: job.ContainerId,
+	}
+
+	// containers stopped by the grid are not reported as exited
+	delete(node.running, job.ContainerId)
+
+	var err error
+	switch job.Action {
+	case common.JobActionStop:
+		err = node.client.StopContainer(job.ContainerId, 10)
+	case common.JobActionRemove:
+		// the container may have already exited
+		if err := node.client.StopContainer(job.ContainerId, 10); err != nil {
+			log.Debugf("error stopping container %s: %s", job.ContainerId, err)
 		}
+		err = node.client.RemoveContainer(job.ContainerId, true)
+	case common.JobActionPull:
+		err = node.pullImage(job, job.Image())
+	default:
+		err = fmt.Errorf("unknown job action: %s", job.Action)
+	}
+	if err != nil {
+		log.Warnf("error running job %s: %s", job.Id, err)
+		result.Error = err.Error()
+	}
+	return result
+}
 
-		info, err := node.client.InspectContainer(containerId)
+// applyPolicy applies the node policy to the containers of the job.
+func (node *Node) applyPolicy(job *common.Job) ([]string, error) {
+	if node.policy == nil {
+		return nil, nil
+	}
+	if job.Group == nil {
+		return node.policy.Apply(job.ContainerConfig)
+	}
+	warnings := []string{}
+	for _, m := range job.Group.Members {
+		w, err := node.policy.Apply(m.ContainerConfig)
 		if err != nil {
-			log.Warnf("error inspecting container: %s", err)
+			return nil, fmt.Errorf("%s: %s", m.Name, err)
 		}
+		warnings = append(warnings, w...)
+	}
+	return warnings, nil
+}
 
-		result.ContainerInfo = info
+// nackJob returns the job to the controller so it can be scheduled on
+// another node.  A temporary rejection lets the controller send the job
+// to this node again later.
+func (node *Node) nackJob(job *common.Job, reason string, temporary bool) {
+	log.Infof("rejecting job: id=%s image=%s reason=%s temporary=%v", job.Id, job.ContainerConfig.Image, reason, temporary)
+	nack := &common.JobNack{
+		JobId:     job.Id,
+		NodeId:    node.Id,
+		Reason:    reason,
+		Temporary: temporary,
+	}
+	b, err := json.Marshal(nack)
+	if err != nil {
+		log.Fatalf("error marshaling job nack: %s", err)
+	}
+	resp, err := node.doRequest("/grid/queue/nack", "POST", 200, b)
+	if resp != nil {
+		resp.Body.Close()
+	}
+	if err != nil {
+		log.Warnf("error sending job nack: %s", err)
+	}
+}
 
-		if err != nil {
-			result.Warnings = []string{err.Error()}
+func (node *Node) runJob(job *common.Job) *common.JobResult {
+	result := &common.JobResult{
+		JobId:  job.Id,
+		NodeId: node.Id,
+	}
+
+	cntCfg := job.ContainerConfig
+
+	containerId, err := node.launch(job, cntCfg, job.ContainerName)
+	result.ContainerId = containerId
+	if err != nil {
+		result.Error = err.Error()
+		return result
+	}
+
+	info, err := node.client.InspectContainer(containerId)
+	if err != nil {
+		log.Warnf("error inspecting container: %s", err)
+		result.Warnings = append(result.Warnings, err.Error())
+	}
+
+	result.ContainerInfo = info
+
+	return result
+}
+
+// launch injects the grid env var, then creates and starts the container.
+// A container that fails to start is removed.
+func (node *Node) launch(job *common.Job, cntCfg *dockerclient.ContainerConfig, containerName string) (string, error) {
+	gridEnv := fmt.Sprintf("%s=true", common.GridEnv)
+	if cntCfg.Env == nil {
+		env := []string{gridEnv}
+		cntCfg.Env = env
+	} else {
+		cntCfg.Env = append(cntCfg.Env, gridEnv)
+	}
+	containerId, err := node.createContainer(job, cntCfg, containerName)
+	if err != nil {
+		log.Warnf("error creating container: %s", err)
+		return "", err
+	}
+
+	hostCfg := cntCfg.HostConfig
+	if err := node.client.StartContainer(containerId, &hostCfg); err != nil {
+		log.Warnf("error starting container: %s", err)
+		// do not leave a container the grid does not own
+		if rmErr := node.client.RemoveContainer(containerId, true); rmErr != nil {
+			log.Warnf("error removing container %s: %s", containerId, rmErr)
 		}
+		return "", err
+	}
+	return containerId, nil
+}
 
-		b, err := json.Marshal(result)
+// createContainer pulls the image following the job pull policy and
+// creates the container.
+func (node *Node) createContainer(job *common.Job, config *dockerclient.ContainerConfig, containerName string) (string, error) {
+	digest := common.ParseImage(config.Image).Digest != ""
+
+	pull := job.PullPolicy == common.PullAlways
+	// images pinned by digest are pulled before create so they can be
+	// verified
+	if !pull && digest && job.PullPolicy != common.PullNever {
+		present, err := node.hasImage(config.Image)
 		if err != nil {
-			log.Fatalf("error marshaling job result: %s", err)
+			return "", err
 		}
-		if _, err := node.doRequest("/grid/queue/result", "POST", 200, b); err != nil {
-			log.Warnf("error sending job result: %s", err)
+		pull = !present
+	}
+	if pull {
+		if err := node.pullImage(job, config.Image); err != nil {
+			return "", err
+		}
+	}
+	if digest {
+		if err := node.verifyImageDigest(config.Image); err != nil {
+			log.Warnf("error verifying image: %s", err)
+			return "", err
 		}
 	}
-}
 
-func (node *Node) createContainer(config *dockerclient.ContainerConfig, containerName string) (string, error) {
 	id, err := node.client.CreateContainer(config, containerName)
-	if err != nil {
-		if err.Error() == "Not found" {
-			log.Debugf("attempting to pull image %s: ", config.Image)
-			if imgErr := node.client.PullImage(config.Image); imgErr != nil {
-				log.Warnf("error pulling image: %s", imgErr)
-				return "", imgErr
-			}
-			id, err = node.client.CreateContainer(config, containerName)
-		} else {
-			log.Warnf("error creating container: %s", err)
+	if err == dockerclient.ErrNotFound {
+		if job.PullPolicy == common.PullNever {
+			return "", &ImageNotPresentError{Image: config.Image}
 		}
+		if err := node.pullImage(job, config.Image); err != nil {
+			return "", err
+		}
+		id, err = node.client.CreateContainer(config, containerName)
+	}
+	if err != nil {
+		log.Warnf("error creating container: %s", err)
 	}
 	return id, err
 }
@@ -220,6 +570,12 @@ func (node *Node) createContainer(config *dockerclient.ContainerConfig, containe
 func (node *Node) Run() {
 	ticker := time.NewTicker(time.Millisecond * time.Duration(node.heartbeatInterval))
 
+	if node.proxyPort > 0 {
+		go node.serveProxy()
+	}
+	go node.collectUsage()
+	go node.watchEvents()
+
 	go func() {
 		for _ = range ticker.C {
 			node.sendNodeInfo()
@@ -227,7 +583,7 @@ func (node *Node) Run() {
 		}
 	}()
 
-	log.Infof("node started: version=%s id=%s cpus=%.2f memory=%.2f heartbeat=%dms ip=%s", VERSION, node.Id, node.Cpus, node.Memory, node.heartbeatInterval, node.ip)
+	log.Infof("node started: version=%s controllers=%s id=%s cpus=%.2f memory=%.2f heartbeat=%dms ip=%s", VERSION, strings.Join(node.controllerUrls, ","), node.Id, node.Cpus, node.Memory, node.heartbeatInterval, node.ip)
 }
 
 func (node *Node) ListContainers(all bool) ([]dockerclient.Container, error) {
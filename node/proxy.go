@@ -0,0 +1,186 @@
+package node
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/subtle"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/json"
+	"encoding/pem"
+	"fmt"
+	"math/big"
+	"net"
+	"net/http"
+	"strconv"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+	"github.com/ehazlett/docker-grid/common"
+	"github.com/ehazlett/docker-grid/utils/proxy"
+	"github.com/gorilla/mux"
+	"github.com/samalba/dockerclient"
+)
+
+const (
+	// proxyCertValidity is how long the proxy certificate is valid; nodes
+	// create a new one each time they start
+	proxyCertValidity = time.Hour * 24 * 365
+)
+
+type (
+	execInfo struct {
+		// ContainerID is set by newer daemons; older ones set Container
+		ContainerID string
+		Container   *struct {
+			ID string
+		}
+	}
+)
+
+// serveProxy forwards the exec, stats and top requests of the controller
+// to the Docker daemon.  Only grid containers can be reached.
+func (node *Node) serveProxy() {
+	r := mux.NewRouter()
+	node.proxyRoute(r, "/containers/{id}/exec", "POST", node.gridContainer)
+	node.proxyRoute(r, "/containers/{id}/stats", "GET", node.gridContainer)
+	node.proxyRoute(r, "/containers/{id}/top", "GET", node.gridContainer)
+	node.proxyRoute(r, "/exec/{id}/start", "POST", node.gridExec)
+	node.proxyRoute(r, "/exec/{id}/resize", "POST", node.gridExec)
+	node.proxyRoute(r, "/exec/{id}/json", "GET", node.gridExec)
+
+	// only the controller needs to reach the proxy
+	addr := node.proxyAddr()
+	l, err := tls.Listen("tcp", addr, node.proxyTLS)
+	if err != nil {
+		log.Errorf("error starting node proxy: %s", err)
+		return
+	}
+	log.Infof("node proxy started: addr=%s", addr)
+	if err := http.Serve(l, r); err != nil {
+		log.Errorf("error running node proxy: %s", err)
+	}
+}
+
+func (node *Node) proxyAddr() string {
+	return net.JoinHostPort(node.ip, strconv.Itoa(node.proxyPort))
+}
+
+// proxyCertificate creates the self-signed certificate of the proxy.  The
+// controller trusts it because the node sends it when it registers.
+func proxyCertificate(ip string) (*tls.Config, string, error) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return nil, "", err
+	}
+	serial, err := rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), 128))
+	if err != nil {
+		return nil, "", err
+	}
+	now := time.Now()
+	template := &x509.Certificate{
+		SerialNumber:          serial,
+		Subject:               pkix.Name{CommonName: ip},
+		NotBefore:             now.Add(-time.Hour),
+		NotAfter:              now.Add(proxyCertValidity),
+		KeyUsage:              x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+	}
+	if addr := net.ParseIP(ip); addr != nil {
+		template.IPAddresses = []net.IP{addr}
+	} else {
+		template.DNSNames = []string{ip}
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		return nil, "", err
+	}
+	config := &tls.Config{
+		Certificates: []tls.Certificate{{Certificate: [][]byte{der}, PrivateKey: key}},
+		MinVersion:   tls.VersionTLS12,
+	}
+	cert := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})
+	return config, string(cert), nil
+}
+
+func (node *Node) proxyRoute(r *mux.Router, path string, method string, allowed func(id string) (bool, error)) {
+	h := func(w http.ResponseWriter, req *http.Request) {
+		token := req.Header.Get(common.ProxyTokenHeader)
+		if subtle.ConstantTimeCompare([]byte(token), []byte(node.proxyToken)) != 1 {
+			http.Error(w, "invalid proxy token", http.StatusUnauthorized)
+			return
+		}
+		req.Header.Del(common.ProxyTokenHeader)
+
+		id := mux.Vars(req)["id"]
+		ok, err := allowed(id)
+		if err != nil {
+			if err == dockerclient.ErrNotFound {
+				http.Error(w, fmt.Sprintf("no such container or exec: %s", id), http.StatusNotFound)
+				return
+			}
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		if !ok {
+			http.Error(w, fmt.Sprintf("%s is not a grid container", id), http.StatusForbidden)
+			return
+		}
+
+		conn, err := node.dialDocker()
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadGateway)
+			return
+		}
+		log.Debugf("proxying to docker: %s %s", req.Method, req.URL)
+		if err := proxy.Hijack(w, req, conn); err != nil {
+			log.Warnf("error proxying %s %s: %s", req.Method, req.URL, err)
+		}
+	}
+	r.HandleFunc(path, h).Methods(method)
+	r.HandleFunc("/{apiVersion:v[^/]+}"+path, h).Methods(method)
+}
+
+// dialDocker opens a connection to the Docker daemon.
+func (node *Node) dialDocker() (net.Conn, error) {
+	u := node.client.URL
+	switch u.Scheme {
+	case "unix":
+		return net.Dial("unix", u.Path)
+	}
+	if node.tlsConfig != nil {
+		return tls.Dial("tcp", u.Host, node.tlsConfig)
+	}
+	return net.Dial("tcp", u.Host)
+}
+
+func (node *Node) gridContainer(id string) (bool, error) {
+	info, err := node.client.InspectContainer(id)
+	if err != nil {
+		return false, err
+	}
+	return common.EnvValue(info.Config, common.GridEnv) != "", nil
+}
+
+// gridExec reports whether the exec runs in a grid container.
+func (node *Node) gridExec(id string) (bool, error) {
+	resp, err := node.dockerRequest("GET", fmt.Sprintf("/exec/%s/json", id), nil, nil)
+	if err != nil {
+		return false, err
+	}
+	defer resp.Body.Close()
+
+	info := &execInfo{}
+	if err := json.NewDecoder(resp.Body).Decode(info); err != nil {
+		return false, err
+	}
+	containerId := info.ContainerID
+	if containerId == "" && info.Container != nil {
+		containerId = info.Container.ID
+	}
+	return node.gridContainer(containerId)
+}
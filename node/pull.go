@@ -0,0 +1,163 @@
+package node
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+	"github.com/ehazlett/docker-grid/common"
+	"github.com/samalba/dockerclient"
+)
+
+const (
+	// progressInterval is how often pull progress is sent to the
+	// controller
+	progressInterval = time.Second
+)
+
+type (
+	// PullError is returned when an image cannot be pulled.
+	PullError struct {
+		Image string
+		Err   error
+	}
+
+	// ImageNotPresentError is returned when the image is not on the node
+	// and the pull policy does not allow pulling it.
+	ImageNotPresentError struct {
+		Image string
+	}
+
+	// pullReporter sends the pull progress of a job to the controller
+	pullReporter struct {
+		node     *Node
+		jobId    string
+		progress []*common.PullProgress
+		sent     time.Time
+	}
+)
+
+func (e *PullError) Error() string {
+	return fmt.Sprintf("error pulling image %s: %s", e.Image, e.Err)
+}
+
+func (e *ImageNotPresentError) Error() string {
+	return fmt.Sprintf("image %s is not present and the pull policy is %s", e.Image, common.PullNever)
+}
+
+// add records the message and sends the progress when it was last sent
+// more than progressInterval ago.
+func (r *pullReporter) add(msg *common.PullProgress) {
+	r.progress = common.MergeProgress(r.progress, msg)
+	if time.Since(r.sent) >= progressInterval {
+		r.flush()
+	}
+}
+
+func (r *pullReporter) flush() {
+	if len(r.progress) == 0 {
+		return
+	}
+	p := &common.JobProgress{
+		JobId:    r.jobId,
+		NodeId:   r.node.Id,
+		Progress: r.progress,
+	}
+	r.progress = nil
+	r.sent = time.Now()
+	b, err := json.Marshal(p)
+	if err != nil {
+		log.Warnf("error marshaling job progress: %s", err)
+		return
+	}
+	resp, err := r.node.doRequest("/grid/queue/progress", "POST", 200, b)
+	if resp != nil {
+		resp.Body.Close()
+	}
+	if err != nil {
+		log.Warnf("error sending job progress: %s", err)
+	}
+}
+
+// hasImage reports whether the image is on the node.
+func (node *Node) hasImage(image string) (bool, error) {
+	_, err := node.inspectImage(image)
+	switch err {
+	case nil:
+		return true, nil
+	case dockerclient.ErrNotFound:
+		return false, nil
+	}
+	return false, err
+}
+
+// pullImage pulls the image with the registry credentials of the job or
+// of this node.  The progress is sent to the controller with the job.
+func (node *Node) pullImage(job *common.Job, image string) error {
+	if err := node.pull(job, image); err != nil {
+		log.Warnf("error pulling image %s: %s", image, err)
+		return &PullError{Image: image, Err: err}
+	}
+	return nil
+}
+
+func (node *Node) pull(job *common.Job, image string) error {
+	ref := common.ParseImage(image)
+	name, tag := strings.TrimSuffix(image, ":"+ref.Tag), ref.Tag
+	if ref.Digest != "" {
+		name, tag = strings.TrimSuffix(image, "@"+ref.Digest), ref.Digest
+	}
+	q := url.Values{}
+	q.Set("fromImage", name)
+	q.Set("tag", tag)
+
+	header := http.Header{}
+	auth := job.RegistryAuth
+	if auth == "" {
+		a, err := node.credentials.Header(image)
+		if err != nil {
+			return err
+		}
+		auth = a
+	}
+	if auth != "" {
+		header.Set(common.RegistryAuthHeader, auth)
+	}
+
+	log.Infof("pulling image: job=%s image=%s", job.Id, image)
+	resp, err := node.dockerRequest("POST", "/images/create?"+q.Encode(), nil, header)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	reporter := &pullReporter{
+		node:  node,
+		jobId: job.Id,
+	}
+	defer reporter.flush()
+
+	dec := json.NewDecoder(resp.Body)
+	for {
+		msg := &common.PullProgress{}
+		if err := dec.Decode(msg); err != nil {
+			if err == io.EOF {
+				return nil
+			}
+			return err
+		}
+		reporter.add(msg)
+		if msg.Error != "" {
+			return fmt.Errorf("%s", msg.Error)
+		}
+		// the registry reports the digest of the manifest it sent
+		if d := strings.TrimPrefix(msg.Status, "Digest: "); ref.Digest != "" && d != msg.Status && d != ref.Digest {
+			return fmt.Errorf("registry sent digest %s for %s", d, image)
+		}
+	}
+}
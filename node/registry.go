@@ -0,0 +1,96 @@
+package node
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"strings"
+
+	"github.com/ehazlett/docker-grid/common"
+)
+
+type (
+	// RegistryCredentials are the registry logins of this node in the
+	// Docker config.json format.  They are used for pulls when the job
+	// has no credentials of its own.
+	RegistryCredentials struct {
+		Auths map[string]*RegistryLogin `json:"auths"`
+	}
+
+	RegistryLogin struct {
+		// Auth is base64 encoded "username:password"
+		Auth          string `json:"auth,omitempty"`
+		Username      string `json:"username,omitempty"`
+		Password      string `json:"password,omitempty"`
+		Email         string `json:"email,omitempty"`
+		ServerAddress string `json:"serveraddress,omitempty"`
+	}
+)
+
+func LoadRegistryCredentials(path string) (*RegistryCredentials, error) {
+	b, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	creds := &RegistryCredentials{}
+	if err := json.Unmarshal(b, creds); err != nil {
+		return nil, fmt.Errorf("error parsing registry credentials %s: %s", path, err)
+	}
+	for registry, login := range creds.Auths {
+		if login.Auth == "" {
+			continue
+		}
+		// the error does not include the credentials
+		b, err := base64.StdEncoding.DecodeString(login.Auth)
+		if err != nil {
+			return nil, fmt.Errorf("invalid auth for registry %s", registry)
+		}
+		parts := strings.SplitN(string(b), ":", 2)
+		if len(parts) != 2 {
+			return nil, fmt.Errorf("invalid auth for registry %s", registry)
+		}
+		login.Username, login.Password = parts[0], parts[1]
+	}
+	return creds, nil
+}
+
+// normalizeRegistry strips the scheme and path from a config.json registry
+// key such as "https://index.docker.io/v1/".
+func normalizeRegistry(registry string) string {
+	registry = strings.TrimPrefix(registry, "https://")
+	registry = strings.TrimPrefix(registry, "http://")
+	if i := strings.Index(registry, "/"); i != -1 {
+		registry = registry[:i]
+	}
+	if registry == "index.docker.io" || registry == "registry-1.docker.io" {
+		return common.DefaultRegistry
+	}
+	return registry
+}
+
+// Header returns the X-Registry-Auth for the registry of the image or ""
+// when there is no login for it.
+func (r *RegistryCredentials) Header(image string) (string, error) {
+	if r == nil {
+		return "", nil
+	}
+	registry, _ := common.ParseImageRegistry(image)
+	for key, login := range r.Auths {
+		if normalizeRegistry(key) != registry {
+			continue
+		}
+		auth := &RegistryLogin{
+			Username:      login.Username,
+			Password:      login.Password,
+			Email:         login.Email,
+			ServerAddress: key,
+		}
+		b, err := json.Marshal(auth)
+		if err != nil {
+			return "", err
+		}
+		return base64.URLEncoding.EncodeToString(b), nil
+	}
+	return "", nil
+}
@@ -0,0 +1,102 @@
+package node
+
+import (
+	"encoding/json"
+	"fmt"
+	"sync"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+	"github.com/ehazlett/docker-grid/common"
+)
+
+type (
+	// cpuSample is the previous cpu reading of a container
+	cpuSample struct {
+		total  uint64
+		system uint64
+	}
+)
+
+func (node *Node) containerStats(id string) (*common.ContainerStats, error) {
+	resp, err := node.dockerRequest("GET", fmt.Sprintf("/containers/%s/stats?stream=false", id), nil, nil)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	stats := &common.ContainerStats{}
+	if err := json.NewDecoder(resp.Body).Decode(stats); err != nil {
+		return nil, err
+	}
+	return stats, nil
+}
+
+// collectUsage measures the usage of the grid containers in the
+// background.  A stats request takes about a second so it is kept out of
+// the heartbeat.
+func (node *Node) collectUsage() {
+	ticker := time.NewTicker(time.Millisecond * time.Duration(node.heartbeatInterval))
+	for _ = range ticker.C {
+		node.usageLock.Lock()
+		ids := node.usageContainers
+		node.usageLock.Unlock()
+
+		usage := node.measureUsage(ids)
+
+		node.usageLock.Lock()
+		node.usage = usage
+		node.usageLock.Unlock()
+	}
+}
+
+func (node *Node) measureUsage(ids []string) *common.NodeUsage {
+	stats := make([]*common.ContainerStats, len(ids))
+	var wg sync.WaitGroup
+	for i, id := range ids {
+		wg.Add(1)
+		go func(i int, id string) {
+			defer wg.Done()
+			s, err := node.containerStats(id)
+			if err != nil {
+				log.Debugf("error getting stats for container %s: %s", id, err)
+				return
+			}
+			stats[i] = s
+		}(i, id)
+	}
+	wg.Wait()
+
+	usage := &common.NodeUsage{
+		Collected: time.Now(),
+	}
+	samples := map[string]*cpuSample{}
+	for i, s := range stats {
+		if s == nil {
+			continue
+		}
+		id := ids[i]
+		cu := &common.ContainerUsage{
+			ContainerId: id,
+			Memory:      int64(s.MemoryStats.Usage),
+		}
+		sample := &cpuSample{
+			total:  s.CpuStats.CpuUsage.TotalUsage,
+			system: s.CpuStats.SystemUsage,
+		}
+		// cpu usage is measured between two readings
+		if prev, ok := node.samples[id]; ok && sample.system > prev.system && sample.total >= prev.total {
+			cpuDelta := float64(sample.total - prev.total)
+			systemDelta := float64(sample.system - prev.system)
+			cu.Cpus = cpuDelta / systemDelta * float64(len(s.CpuStats.CpuUsage.PercpuUsage))
+		}
+		samples[id] = sample
+
+		usage.Cpus += cu.Cpus
+		usage.Memory += cu.Memory
+		usage.Containers = append(usage.Containers, cu)
+	}
+	// containers that are gone are dropped
+	node.samples = samples
+	return usage
+}
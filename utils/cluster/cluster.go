@@ -0,0 +1,204 @@
+package cluster
+
+import (
+	"encoding/json"
+	"errors"
+	"net"
+	"os"
+	"path/filepath"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+	"github.com/ehazlett/docker-grid/utils/datastore"
+	"github.com/hashicorp/raft"
+	raftboltdb "github.com/hashicorp/raft-boltdb"
+)
+
+const (
+	applyTimeout = time.Second * 5
+)
+
+type (
+	// Cluster is a datastore.Store replicated between controllers using
+	// raft.  Writes must be made on the leader; reads are served from the
+	// local copy.
+	Cluster struct {
+		addr      string
+		raft      *raft.Raft
+		fsm       *fsm
+		transport *raft.NetworkTransport
+		logStore  *raftboltdb.BoltStore
+	}
+
+	Status struct {
+		Addr   string   `json:"addr,omitempty"`
+		State  string   `json:"state,omitempty"`
+		Leader string   `json:"leader,omitempty"`
+		Peers  []string `json:"peers,omitempty"`
+	}
+)
+
+var (
+	ErrNotLeader = errors.New("not the cluster leader")
+)
+
+// New starts the raft server on addr.  When there is no existing state the
+// cluster is bootstrapped with addr and the peers.
+func New(dataDir string, addr string, peers []string, enableDebug bool) (*Cluster, error) {
+	raftDir := filepath.Join(dataDir, "raft")
+	if err := os.MkdirAll(raftDir, 0700); err != nil {
+		return nil, err
+	}
+
+	conf := raft.DefaultConfig()
+	conf.LocalID = raft.ServerID(addr)
+	conf.LogLevel = "WARN"
+	if enableDebug {
+		conf.LogLevel = "DEBUG"
+	}
+
+	tcpAddr, err := net.ResolveTCPAddr("tcp", addr)
+	if err != nil {
+		return nil, err
+	}
+	transport, err := raft.NewTCPTransport(addr, tcpAddr, 3, time.Second*10, os.Stderr)
+	if err != nil {
+		return nil, err
+	}
+	snapshots, err := raft.NewFileSnapshotStore(raftDir, 2, os.Stderr)
+	if err != nil {
+		return nil, err
+	}
+	logStore, err := raftboltdb.NewBoltStore(filepath.Join(raftDir, "raft.db"))
+	if err != nil {
+		return nil, err
+	}
+
+	f := &fsm{
+		store: datastore.NewMemoryStore(),
+	}
+
+	hasState, err := raft.HasExistingState(logStore, logStore, snapshots)
+	if err != nil {
+		return nil, err
+	}
+	if !hasState {
+		servers := []raft.Server{
+			{ID: conf.LocalID, Address: transport.LocalAddr()},
+		}
+		for _, p := range peers {
+			if p == addr {
+				continue
+			}
+			servers = append(servers, raft.Server{ID: raft.ServerID(p), Address: raft.ServerAddress(p)})
+		}
+		log.Infof("bootstrapping cluster: servers=%d", len(servers))
+		if err := raft.BootstrapCluster(conf, logStore, logStore, snapshots, transport, raft.Configuration{Servers: servers}); err != nil {
+			return nil, err
+		}
+	}
+
+	r, err := raft.NewRaft(conf, f, logStore, logStore, snapshots, transport)
+	if err != nil {
+		return nil, err
+	}
+
+	return &Cluster{
+		addr:      addr,
+		raft:      r,
+		fsm:       f,
+		transport: transport,
+		logStore:  logStore,
+	}, nil
+}
+
+func (c *Cluster) IsLeader() bool {
+	return c.raft.State() == raft.Leader
+}
+
+// Leader returns the raft address of the current leader.
+func (c *Cluster) Leader() string {
+	return string(c.raft.Leader())
+}
+
+// LeaderCh receives true when this controller becomes the leader and
+// false when it loses leadership.
+func (c *Cluster) LeaderCh() <-chan bool {
+	return c.raft.LeaderCh()
+}
+
+func (c *Cluster) Status() (*Status, error) {
+	future := c.raft.GetConfiguration()
+	if err := future.Error(); err != nil {
+		return nil, err
+	}
+	peers := []string{}
+	for _, s := range future.Configuration().Servers {
+		peers = append(peers, string(s.Address))
+	}
+	return &Status{
+		Addr:   c.addr,
+		State:  c.raft.State().String(),
+		Leader: c.Leader(),
+		Peers:  peers,
+	}, nil
+}
+
+func (c *Cluster) apply(cmd *command) error {
+	if !c.IsLeader() {
+		return ErrNotLeader
+	}
+	b, err := json.Marshal(cmd)
+	if err != nil {
+		return err
+	}
+	future := c.raft.Apply(b, applyTimeout)
+	if err := future.Error(); err != nil {
+		return err
+	}
+	if err, ok := future.Response().(error); ok {
+		return err
+	}
+	return nil
+}
+
+func (c *Cluster) Put(bucket string, key string, v interface{}) error {
+	b, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+	return c.apply(&command{
+		Op:     opPut,
+		Bucket: bucket,
+		Key:    key,
+		Data:   b,
+	})
+}
+
+func (c *Cluster) Get(bucket string, key string, v interface{}) error {
+	return c.fsm.store.Get(bucket, key, v)
+}
+
+func (c *Cluster) Delete(bucket string, key string) error {
+	return c.apply(&command{
+		Op:     opDelete,
+		Bucket: bucket,
+		Key:    key,
+	})
+}
+
+func (c *Cluster) ForEach(bucket string, fn func(key string, data []byte) error) error {
+	return c.fsm.store.ForEach(bucket, fn)
+}
+
+// Close stops the raft server and releases the raft log so the data
+// directory can be opened again.
+func (c *Cluster) Close() error {
+	if err := c.raft.Shutdown().Error(); err != nil {
+		return err
+	}
+	if err := c.transport.Close(); err != nil {
+		return err
+	}
+	return c.logStore.Close()
+}
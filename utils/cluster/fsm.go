@@ -0,0 +1,75 @@
+package cluster
+
+import (
+	"encoding/json"
+	"io"
+	"io/ioutil"
+
+	"github.com/ehazlett/docker-grid/utils/datastore"
+	"github.com/hashicorp/raft"
+)
+
+const (
+	opPut    = "put"
+	opDelete = "delete"
+)
+
+type (
+	command struct {
+		Op     string          `json:"op"`
+		Bucket string          `json:"bucket"`
+		Key    string          `json:"key"`
+		Data   json.RawMessage `json:"data,omitempty"`
+	}
+
+	// fsm applies replicated commands to an in-memory store.  The raft log
+	// and snapshots are persisted so the store is rebuilt on start.
+	fsm struct {
+		store *datastore.MemoryStore
+	}
+
+	fsmSnapshot struct {
+		data []byte
+	}
+)
+
+func (f *fsm) Apply(l *raft.Log) interface{} {
+	cmd := &command{}
+	if err := json.Unmarshal(l.Data, cmd); err != nil {
+		return err
+	}
+	switch cmd.Op {
+	case opPut:
+		return f.store.Put(cmd.Bucket, cmd.Key, cmd.Data)
+	case opDelete:
+		return f.store.Delete(cmd.Bucket, cmd.Key)
+	}
+	return nil
+}
+
+func (f *fsm) Snapshot() (raft.FSMSnapshot, error) {
+	b, err := f.store.Snapshot()
+	if err != nil {
+		return nil, err
+	}
+	return &fsmSnapshot{data: b}, nil
+}
+
+func (f *fsm) Restore(rc io.ReadCloser) error {
+	defer rc.Close()
+	b, err := ioutil.ReadAll(rc)
+	if err != nil {
+		return err
+	}
+	return f.store.Restore(b)
+}
+
+func (s *fsmSnapshot) Persist(sink raft.SnapshotSink) error {
+	if _, err := sink.Write(s.data); err != nil {
+		sink.Cancel()
+		return err
+	}
+	return sink.Close()
+}
+
+func (s *fsmSnapshot) Release() {}
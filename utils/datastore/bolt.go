@@ -0,0 +1,84 @@
+package datastore
+
+import (
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/boltdb/bolt"
+)
+
+type (
+	// BoltStore is a Store persisted to a single file in the data directory.
+	BoltStore struct {
+		db *bolt.DB
+	}
+)
+
+func NewBoltStore(dataDir string) (*BoltStore, error) {
+	if err := os.MkdirAll(dataDir, 0700); err != nil {
+		return nil, err
+	}
+	db, err := bolt.Open(filepath.Join(dataDir, "grid.db"), 0600, &bolt.Options{Timeout: time.Second * 5})
+	if err != nil {
+		return nil, err
+	}
+	return &BoltStore{
+		db: db,
+	}, nil
+}
+
+func (s *BoltStore) Put(bucket string, key string, v interface{}) error {
+	b, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+	return s.db.Update(func(tx *bolt.Tx) error {
+		bkt, err := tx.CreateBucketIfNotExists([]byte(bucket))
+		if err != nil {
+			return err
+		}
+		return bkt.Put([]byte(key), b)
+	})
+}
+
+func (s *BoltStore) Get(bucket string, key string, v interface{}) error {
+	return s.db.View(func(tx *bolt.Tx) error {
+		bkt := tx.Bucket([]byte(bucket))
+		if bkt == nil {
+			return ErrKeyDoesNotExist
+		}
+		b := bkt.Get([]byte(key))
+		if b == nil {
+			return ErrKeyDoesNotExist
+		}
+		return json.Unmarshal(b, v)
+	})
+}
+
+func (s *BoltStore) Delete(bucket string, key string) error {
+	return s.db.Update(func(tx *bolt.Tx) error {
+		bkt := tx.Bucket([]byte(bucket))
+		if bkt == nil {
+			return nil
+		}
+		return bkt.Delete([]byte(key))
+	})
+}
+
+func (s *BoltStore) ForEach(bucket string, fn func(key string, data []byte) error) error {
+	return s.db.View(func(tx *bolt.Tx) error {
+		bkt := tx.Bucket([]byte(bucket))
+		if bkt == nil {
+			return nil
+		}
+		return bkt.ForEach(func(k, v []byte) error {
+			return fn(string(k), v)
+		})
+	})
+}
+
+func (s *BoltStore) Close() error {
+	return s.db.Close()
+}
@@ -2,15 +2,40 @@ package datastore
 
 import (
 	"errors"
+	"strings"
 	"sync"
 	"time"
 )
 
+const (
+	EventSet    EventType = "set"
+	EventDelete EventType = "delete"
+	EventExpire EventType = "expire"
+
+	watchBuffer = 64
+)
+
 type (
+	EventType string
+
+	Event struct {
+		Type EventType
+		Key  string
+		Item *Item
+	}
+
 	Datastore struct {
-		mutex sync.RWMutex
-		data  map[string]*Item
-		ttl   time.Duration
+		mutex    sync.RWMutex
+		data     map[string]*Item
+		ttl      time.Duration
+		watchers map[*watcher]struct{}
+		expireFn []func(*Event)
+		stop     chan struct{}
+	}
+
+	watcher struct {
+		prefix string
+		ch     chan *Event
 	}
 )
 
@@ -18,50 +43,173 @@ var (
 	ErrKeyDoesNotExist = errors.New("key does not exist")
 )
 
+// New returns a datastore where items expire after ttl unless set with
+// their own ttl.
 func New(ttl time.Duration) (*Datastore, error) {
 	d := &Datastore{
-		ttl:  ttl,
-		data: map[string]*Item{},
+		ttl:      ttl,
+		data:     map[string]*Item{},
+		watchers: map[*watcher]struct{}{},
+		stop:     make(chan struct{}),
 	}
 
-	ticker := time.NewTicker(ttl)
+	interval := ttl
+	if interval <= 0 || interval > time.Second {
+		interval = time.Second
+	}
+	ticker := time.NewTicker(interval)
 
 	go func() {
-		for _ = range ticker.C {
-			d.cleanup()
+		for {
+			select {
+			case <-ticker.C:
+				d.cleanup()
+			case <-d.stop:
+				ticker.Stop()
+				return
+			}
 		}
 	}()
 
 	return d, nil
 }
 
+// Close stops expiring items.
+func (d *Datastore) Close() {
+	close(d.stop)
+}
+
+// Items returns a snapshot of the unexpired items.
 func (d *Datastore) Items() map[string]*Item {
-	return d.data
+	now := time.Now()
+	d.mutex.RLock()
+	defer d.mutex.RUnlock()
+	items := make(map[string]*Item, len(d.data))
+	for key, item := range d.data {
+		if !item.expired(now) {
+			items[key] = item.copy()
+		}
+	}
+	return items
 }
 
 func (d *Datastore) Set(key string, data interface{}) error {
-	exp := time.Now().Add(d.ttl)
-	item := &Item{
-		expires: &exp,
-		Data:    data,
-	}
+	return d.SetWithTTL(key, data, d.ttl)
+}
+
+// SetWithTTL sets the key with its own ttl.  A ttl of zero never expires.
+func (d *Datastore) SetWithTTL(key string, data interface{}, ttl time.Duration) error {
+	item := newItem(data, ttl)
+	d.mutex.Lock()
 	d.data[key] = item
+	d.mutex.Unlock()
+
+	d.notify(&Event{Type: EventSet, Key: key, Item: item.copy()})
 	return nil
 }
 
-func (d *Datastore) Get(key string) (interface{}, error) {
-	if v, ok := d.data[key]; ok {
-		return v, nil
+func (d *Datastore) Get(key string) (*Item, error) {
+	d.mutex.RLock()
+	defer d.mutex.RUnlock()
+	if v, ok := d.data[key]; ok && !v.expired(time.Now()) {
+		return v.copy(), nil
 	}
 	return nil, ErrKeyDoesNotExist
 }
 
+func (d *Datastore) Delete(key string) error {
+	d.mutex.Lock()
+	item, ok := d.data[key]
+	delete(d.data, key)
+	d.mutex.Unlock()
+
+	if !ok {
+		return ErrKeyDoesNotExist
+	}
+	d.notify(&Event{Type: EventDelete, Key: key, Item: item.copy()})
+	return nil
+}
+
+// Touch resets the expiration of the key using its ttl.
+func (d *Datastore) Touch(key string) error {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+	item, ok := d.data[key]
+	if !ok || item.expired(time.Now()) {
+		return ErrKeyDoesNotExist
+	}
+	updated := item.copy()
+	updated.touch()
+	d.data[key] = updated
+	return nil
+}
+
+// Watch returns a channel of events for keys with the prefix.  Events are
+// dropped for a watcher that falls behind so writers never block; use
+// OnExpire for expirations that must not be missed.  Call the returned
+// func to stop watching; it closes the channel.
+func (d *Datastore) Watch(prefix string) (<-chan *Event, func()) {
+	w := &watcher{
+		prefix: prefix,
+		ch:     make(chan *Event, watchBuffer),
+	}
+	d.mutex.Lock()
+	d.watchers[w] = struct{}{}
+	d.mutex.Unlock()
+
+	var once sync.Once
+	cancel := func() {
+		once.Do(func() {
+			d.mutex.Lock()
+			delete(d.watchers, w)
+			close(w.ch)
+			d.mutex.Unlock()
+		})
+	}
+	return w.ch, cancel
+}
+
+// OnExpire calls fn with every expired item.  fn runs on the expiration
+// goroutine: a slow fn delays later expirations but not writers.
+func (d *Datastore) OnExpire(fn func(*Event)) {
+	d.mutex.Lock()
+	d.expireFn = append(d.expireFn, fn)
+	d.mutex.Unlock()
+}
+
+// notify sends the event to the watchers.  It must not be called with the
+// mutex held.
+func (d *Datastore) notify(evt *Event) {
+	d.mutex.RLock()
+	defer d.mutex.RUnlock()
+	for w := range d.watchers {
+		if !strings.HasPrefix(evt.Key, w.prefix) {
+			continue
+		}
+		select {
+		case w.ch <- evt:
+		default:
+		}
+	}
+}
+
 func (d *Datastore) cleanup() {
+	now := time.Now()
+	expired := []*Event{}
 	d.mutex.Lock()
 	for key, item := range d.data {
-		if item.expired() {
+		if item.expired(now) {
 			delete(d.data, key)
+			expired = append(expired, &Event{Type: EventExpire, Key: key, Item: item.copy()})
 		}
 	}
+	fns := d.expireFn
 	d.mutex.Unlock()
+
+	for _, evt := range expired {
+		d.notify(evt)
+		for _, fn := range fns {
+			fn(evt)
+		}
+	}
 }
@@ -0,0 +1,265 @@
+package datastore
+
+import (
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+)
+
+func newTestDatastore(t *testing.T, ttl time.Duration) *Datastore {
+	d, err := New(ttl)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return d
+}
+
+func waitForEvent(t *testing.T, events <-chan *Event, typ EventType) *Event {
+	timeout := time.After(time.Second * 2)
+	for {
+		select {
+		case evt := <-events:
+			if evt.Type == typ {
+				return evt
+			}
+		case <-timeout:
+			t.Fatalf("timed out waiting for %s event", typ)
+		}
+	}
+}
+
+func TestSetGet(t *testing.T) {
+	d := newTestDatastore(t, time.Minute)
+	defer d.Close()
+
+	d.Set("foo", 42)
+	item, err := d.Get("foo")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if item.Data.(int) != 42 {
+		t.Fatalf("expected 42; received %v", item.Data)
+	}
+
+	if _, err := d.Get("bar"); err != ErrKeyDoesNotExist {
+		t.Fatalf("expected ErrKeyDoesNotExist; received %v", err)
+	}
+}
+
+func TestExpire(t *testing.T) {
+	d := newTestDatastore(t, time.Millisecond*50)
+	defer d.Close()
+
+	d.Set("foo", 42)
+	time.Sleep(time.Millisecond * 100)
+
+	if _, err := d.Get("foo"); err != ErrKeyDoesNotExist {
+		t.Fatalf("expected ErrKeyDoesNotExist; received %v", err)
+	}
+	if len(d.Items()) != 0 {
+		t.Fatalf("expected no items")
+	}
+}
+
+func TestSetWithTTL(t *testing.T) {
+	d := newTestDatastore(t, time.Millisecond*50)
+	defer d.Close()
+
+	d.SetWithTTL("forever", 1, 0)
+	d.SetWithTTL("long", 2, time.Minute)
+	d.Set("short", 3)
+	time.Sleep(time.Millisecond * 100)
+
+	items := d.Items()
+	if len(items) != 2 {
+		t.Fatalf("expected 2 items; received %d", len(items))
+	}
+	if _, ok := items["short"]; ok {
+		t.Fatalf("expected short to expire")
+	}
+	if !items["forever"].Expires().IsZero() {
+		t.Fatalf("expected forever to never expire")
+	}
+}
+
+func TestDelete(t *testing.T) {
+	d := newTestDatastore(t, time.Minute)
+	defer d.Close()
+
+	d.Set("foo", 42)
+	if err := d.Delete("foo"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := d.Get("foo"); err != ErrKeyDoesNotExist {
+		t.Fatalf("expected ErrKeyDoesNotExist; received %v", err)
+	}
+	if err := d.Delete("foo"); err != ErrKeyDoesNotExist {
+		t.Fatalf("expected ErrKeyDoesNotExist; received %v", err)
+	}
+}
+
+func TestTouch(t *testing.T) {
+	d := newTestDatastore(t, time.Millisecond*100)
+	defer d.Close()
+
+	d.Set("foo", 42)
+	for i := 0; i < 4; i++ {
+		time.Sleep(time.Millisecond * 50)
+		if err := d.Touch("foo"); err != nil {
+			t.Fatalf("expected touch to keep key: %s", err)
+		}
+	}
+	if _, err := d.Get("foo"); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := d.Touch("bar"); err != ErrKeyDoesNotExist {
+		t.Fatalf("expected ErrKeyDoesNotExist; received %v", err)
+	}
+}
+
+func TestItemsSnapshot(t *testing.T) {
+	d := newTestDatastore(t, time.Minute)
+	defer d.Close()
+
+	d.Set("foo", 1)
+	items := d.Items()
+	d.Set("foo", 2)
+	d.Set("bar", 3)
+
+	if len(items) != 1 || items["foo"].Data.(int) != 1 {
+		t.Fatalf("expected snapshot to be unchanged")
+	}
+}
+
+func TestWatch(t *testing.T) {
+	d := newTestDatastore(t, time.Millisecond*50)
+	defer d.Close()
+
+	events, cancel := d.Watch("node-")
+	defer cancel()
+
+	d.Set("job-1", 1)
+	d.Set("node-1", 2)
+
+	evt := waitForEvent(t, events, EventSet)
+	if evt.Key != "node-1" || evt.Item.Data.(int) != 2 {
+		t.Fatalf("unexpected event: %+v", evt)
+	}
+
+	evt = waitForEvent(t, events, EventExpire)
+	if evt.Key != "node-1" {
+		t.Fatalf("expected node-1 to expire; received %s", evt.Key)
+	}
+}
+
+func TestWatchCancel(t *testing.T) {
+	d := newTestDatastore(t, time.Minute)
+	defer d.Close()
+
+	_, cancel := d.Watch("")
+	cancel()
+	cancel()
+
+	// must not block on the cancelled watcher
+	for i := 0; i < watchBuffer*2; i++ {
+		d.Set(fmt.Sprintf("key-%d", i), i)
+	}
+}
+
+func TestWatchCancelCloses(t *testing.T) {
+	d := newTestDatastore(t, time.Minute)
+	defer d.Close()
+
+	events, cancel := d.Watch("")
+	done := make(chan struct{})
+	go func() {
+		for _ = range events {
+		}
+		close(done)
+	}()
+	cancel()
+
+	select {
+	case <-done:
+	case <-time.After(time.Second * 2):
+		t.Fatalf("expected the channel to be closed on cancel")
+	}
+}
+
+func TestSlowWatcher(t *testing.T) {
+	d := newTestDatastore(t, time.Minute)
+	defer d.Close()
+
+	// never drained
+	_, cancel := d.Watch("")
+	defer cancel()
+
+	done := make(chan struct{})
+	go func() {
+		for i := 0; i < watchBuffer*2; i++ {
+			d.Set(fmt.Sprintf("key-%d", i), i)
+		}
+		close(done)
+	}()
+
+	select {
+	case <-done:
+	case <-time.After(time.Second * 2):
+		t.Fatalf("set blocked on a slow watcher")
+	}
+}
+
+func TestOnExpire(t *testing.T) {
+	d := newTestDatastore(t, time.Millisecond*50)
+	defer d.Close()
+
+	expired := make(chan string, 1)
+	d.OnExpire(func(evt *Event) {
+		expired <- evt.Key
+	})
+	d.Set("node-1", 1)
+
+	select {
+	case key := <-expired:
+		if key != "node-1" {
+			t.Fatalf("expected node-1 to expire; received %s", key)
+		}
+	case <-time.After(time.Second * 2):
+		t.Fatalf("timed out waiting for expiration")
+	}
+}
+
+func TestConcurrentAccess(t *testing.T) {
+	d := newTestDatastore(t, time.Millisecond*5)
+	defer d.Close()
+
+	events, cancel := d.Watch("")
+	defer cancel()
+	go func() {
+		for _ = range events {
+		}
+	}()
+
+	var wg sync.WaitGroup
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func(n int) {
+			defer wg.Done()
+			for j := 0; j < 200; j++ {
+				key := fmt.Sprintf("key-%d", j%10)
+				d.Set(key, n)
+				d.Get(key)
+				d.Touch(key)
+				for _, item := range d.Items() {
+					_ = item.Data
+				}
+				if j%7 == 0 {
+					d.Delete(key)
+				}
+			}
+		}(i)
+	}
+	wg.Wait()
+}
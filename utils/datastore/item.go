@@ -1,25 +1,47 @@
 package datastore
 
 import (
-	"sync"
 	"time"
 )
 
 type (
+	// Item is a value in the datastore.  Items returned by the datastore
+	// are copies and are safe to use after the key changes.
 	Item struct {
-		sync.RWMutex
-		expires *time.Time
 		Data    interface{}
+		ttl     time.Duration
+		expires time.Time
 	}
 )
 
-func (item *Item) expired() bool {
-	expired := false
-	item.RLock()
-	if item.expires == nil {
-		return true
+func newItem(data interface{}, ttl time.Duration) *Item {
+	item := &Item{
+		Data: data,
+		ttl:  ttl,
 	}
-	expired = item.expires.Before(time.Now())
-	item.RUnlock()
-	return expired
+	item.touch()
+	return item
+}
+
+// Expires returns when the item expires.  A zero time never expires.
+func (item *Item) Expires() time.Time {
+	return item.expires
+}
+
+func (item *Item) touch() {
+	if item.ttl > 0 {
+		item.expires = time.Now().Add(item.ttl)
+	}
+}
+
+func (item *Item) expired(now time.Time) bool {
+	if item.expires.IsZero() {
+		return false
+	}
+	return item.expires.Before(now)
+}
+
+func (item *Item) copy() *Item {
+	c := *item
+	return &c
 }
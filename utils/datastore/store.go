@@ -0,0 +1,106 @@
+package datastore
+
+import (
+	"encoding/json"
+	"sort"
+	"sync"
+)
+
+type (
+	// Store is persistent key/value storage grouped into buckets.  Values
+	// are stored as JSON.
+	Store interface {
+		Put(bucket string, key string, v interface{}) error
+		Get(bucket string, key string, v interface{}) error
+		Delete(bucket string, key string) error
+		// ForEach calls fn for every key in the bucket in key order
+		ForEach(bucket string, fn func(key string, data []byte) error) error
+		Close() error
+	}
+
+	MemoryStore struct {
+		mutex   sync.RWMutex
+		buckets map[string]map[string][]byte
+	}
+)
+
+// NewMemoryStore returns a Store that is not persisted.  It is used when
+// the controller is run without a data directory.
+func NewMemoryStore() *MemoryStore {
+	return &MemoryStore{
+		buckets: map[string]map[string][]byte{},
+	}
+}
+
+func (s *MemoryStore) Put(bucket string, key string, v interface{}) error {
+	b, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if _, ok := s.buckets[bucket]; !ok {
+		s.buckets[bucket] = map[string][]byte{}
+	}
+	s.buckets[bucket][key] = b
+	return nil
+}
+
+func (s *MemoryStore) Get(bucket string, key string, v interface{}) error {
+	s.mutex.RLock()
+	b, ok := s.buckets[bucket][key]
+	s.mutex.RUnlock()
+	if !ok {
+		return ErrKeyDoesNotExist
+	}
+	return json.Unmarshal(b, v)
+}
+
+func (s *MemoryStore) Delete(bucket string, key string) error {
+	s.mutex.Lock()
+	delete(s.buckets[bucket], key)
+	s.mutex.Unlock()
+	return nil
+}
+
+func (s *MemoryStore) ForEach(bucket string, fn func(key string, data []byte) error) error {
+	s.mutex.RLock()
+	keys := []string{}
+	data := map[string][]byte{}
+	for k, v := range s.buckets[bucket] {
+		keys = append(keys, k)
+		data[k] = v
+	}
+	s.mutex.RUnlock()
+
+	sort.Strings(keys)
+	for _, k := range keys {
+		if err := fn(k, data[k]); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (s *MemoryStore) Close() error {
+	return nil
+}
+
+// Snapshot returns the contents of every bucket as JSON.
+func (s *MemoryStore) Snapshot() ([]byte, error) {
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+	return json.Marshal(s.buckets)
+}
+
+// Restore replaces the contents of the store with a snapshot.
+func (s *MemoryStore) Restore(b []byte) error {
+	buckets := map[string]map[string][]byte{}
+	if err := json.Unmarshal(b, &buckets); err != nil {
+		return err
+	}
+	s.mutex.Lock()
+	s.buckets = buckets
+	s.mutex.Unlock()
+	return nil
+}
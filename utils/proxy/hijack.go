@@ -0,0 +1,53 @@
+package proxy
+
+import (
+	"errors"
+	"io"
+	"net"
+	"net/http"
+)
+
+var (
+	ErrHijackNotSupported = errors.New("connection cannot be hijacked")
+)
+
+type closeWriter interface {
+	CloseWrite() error
+}
+
+// Hijack sends the request on the backend connection and then copies the
+// raw streams between the client and the backend until the backend is
+// done.  It is used for the Docker attach and exec streams which are not
+// plain HTTP responses.  Requests that do not upgrade the connection are
+// sent with "Connection: close" so the backend ends the stream after the
+// response.
+func Hijack(w http.ResponseWriter, r *http.Request, backend net.Conn) error {
+	defer backend.Close()
+
+	hj, ok := w.(http.Hijacker)
+	if !ok {
+		return ErrHijackNotSupported
+	}
+	if r.Header.Get("Upgrade") == "" {
+		r.Header.Set("Connection", "close")
+	}
+	if err := r.Write(backend); err != nil {
+		return err
+	}
+
+	conn, rw, err := hj.Hijack()
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	go func() {
+		// the client input, including what was buffered with the request
+		io.Copy(backend, rw.Reader)
+		if cw, ok := backend.(closeWriter); ok {
+			cw.CloseWrite()
+		}
+	}()
+	_, err = io.Copy(conn, backend)
+	return err
+}
@@ -90,6 +90,22 @@ func (v *View) getNodes() ([]*common.NodeData, error) {
 	return nodeData, nil
 }
 
+func (v *View) getServices() ([]*common.Service, error) {
+	resp, err := v.doRequest("/grid/services", "GET", 200, nil)
+	if err != nil {
+		log.Warnf("error getting service list: %s", err)
+		return nil, err
+	}
+
+	services := []*common.Service{}
+	if err := json.NewDecoder(resp.Body).Decode(&services); err != nil {
+		log.Warnf("error decoding services: %s", err)
+		return nil, err
+	}
+
+	return services, nil
+}
+
 func (v *View) refresh() {
 	nodes, err := v.getNodes()
 	if err != nil {
@@ -109,7 +125,7 @@ func (v *View) refresh() {
 		fmt.Println("|")
 	} else {
 		t := tablewriter.NewWriter(os.Stdout)
-		t.SetHeader([]string{"", "ID", "CPUs", "Memory", "Version", "IP", "CONTAINERS"})
+		t.SetHeader([]string{"", "ID", "State", "CPUs", "Memory", "Version", "IP", "CONTAINERS"})
 
 		for i, node := range nodes {
 			cpus := fmt.Sprintf("%.2f", node.Cpus)
@@ -120,9 +136,43 @@ func (v *View) refresh() {
 			if node.Memory == 0.0 {
 				memory = ""
 			}
-			t.Append([]string{fmt.Sprintf("%d", i), node.NodeId, cpus, memory, node.Version, node.IP, fmt.Sprintf("%d", len(node.Containers))})
+			state := node.State
+			if node.Drain != nil && node.Drain.Reschedule {
+				state = fmt.Sprintf("%s (%d/%d)", state, node.Drain.Total-node.Drain.Remaining, node.Drain.Total)
+			}
+			t.Append([]string{fmt.Sprintf("%d", i), node.NodeId, state, cpus, memory, node.Version, node.IP, fmt.Sprintf("%d", len(node.Containers))})
 		}
 
 		t.Render()
 	}
+	services, err := v.getServices()
+	if err != nil {
+		log.Fatalf("unable to get services: %s", err)
+	}
+	if len(services) == 0 {
+		return
+	}
+
+	fmt.Print("|\n")
+	t := tablewriter.NewWriter(os.Stdout)
+	t.SetHeader([]string{"SERVICE", "Image", "Replicas", "Update"})
+	for _, svc := range services {
+		image := ""
+		if svc.ContainerConfig != nil {
+			image = svc.ContainerConfig.Image
+		}
+		replicas := fmt.Sprintf("%d", svc.Replicas)
+		if svc.Status != nil {
+			replicas = fmt.Sprintf("%d/%d", svc.Status.Running, svc.Replicas)
+		}
+		update := ""
+		if svc.Update != nil {
+			update = fmt.Sprintf("%s (%d/%d)", svc.Update.State, svc.Update.Updated, svc.Update.Total)
+			if svc.Update.Message != "" {
+				update = fmt.Sprintf("%s: %s", update, svc.Update.Message)
+			}
+		}
+		t.Append([]string{svc.Name, image, replicas, update})
+	}
+	t.Render()
 }